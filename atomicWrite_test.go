@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "zones.conf")
+
+	if err := writeFileAtomic(filename, []byte("first"), 0640); err != nil {
+		t.Fatal("expected success", err)
+	}
+	if err := writeFileAtomic(filename, []byte("second"), 0640); err != nil {
+		t.Fatal("expected success", err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	info, _ := os.Stat(filename)
+	files, _ := ioutil.ReadDir(dir)
+	if string(data) != "second" || info.Mode().Perm() != 0640 || len(files) != 1 {
+		t.Error("expected file replaced with the requested permissions and no temporary files left", string(data), info.Mode(), len(files))
+	}
+
+	// an existing file keeps its mode and owner
+	os.Chmod(filename, 0604)
+	before, _ := os.Stat(filename)
+	if err := writeFileAtomic(filename, []byte("third"), 0640); err != nil {
+		t.Fatal("expected success", err)
+	}
+	info, _ = os.Stat(filename)
+	if info.Mode().Perm() != 0604 || info.Sys().(*syscall.Stat_t).Uid != before.Sys().(*syscall.Stat_t).Uid ||
+		info.Sys().(*syscall.Stat_t).Gid != before.Sys().(*syscall.Stat_t).Gid {
+		t.Error("expected existing mode and owner to be kept", info.Mode())
+	}
+
+	// rename onto a directory fails without leaving the temporary file behind
+	os.Mkdir(filepath.Join(dir, "zone.txt"), 0755)
+	if err := writeFileAtomic(filepath.Join(dir, "zone.txt"), []byte("zone"), 0644); err == nil {
+		t.Error("expected rename error")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Error("expected temporary file to be removed", len(files))
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "zone.txt"), []byte("zone"), 0644); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
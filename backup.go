@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// backupData is the database contents written by export and read by import. Templates are
+// referenced by name so the data can be loaded into a different database
+type backupData struct {
+	Templates  []zoneTemplate
+	Domains    []domainBackup
+	PTRRecords []ptrRecord
+}
+
+type domainBackup struct {
+	Name            string
+	TTL             int32 // seconds. 0 for the default
+	Refresh         int32
+	Retry           int32
+	Expire          int32
+	NegativeTTL     int32
+	Hostmaster      string
+	Template        string
+	PublishCDS      bool
+	DNSSECDelete    bool
+	DenialType      string
+	NSEC3Iterations int16
+	NSEC3Salt       string
+	NSEC3OptOut     bool
+	ARecords        []aRecord
+	CNameRecords    []cnameRecord
+	DKIMRecords     []dkimRecord
+	DMARCRecords    []dmarcRecord
+	MxRecords       []mxRecord
+	NsRecords       []nsRecord
+	SPFRecords      []spfRecord
+	SRVRecords      []srvRecord
+	TXTRecords      []txtRecord
+	CAARecords      []caaRecord
+}
+
+// exportData reads everything in the database that zones are built from
+func exportData(db dnsBackend) (*backupData, error) {
+	templates, err := db.GetTemplates()
+	if err != nil {
+		return nil, errors.New("Unable to retrieve templates from database " + err.Error())
+	}
+	domains, err := db.GetDomains()
+	if err != nil {
+		return nil, errors.New("Unable to retrieve domains from database " + err.Error())
+	}
+	ptrRecords, err := db.GetPTRRecords()
+	if err != nil {
+		return nil, errors.New("Unable to retrieve PTR records from database " + err.Error())
+	}
+
+	templateNames := make(map[int16]string)
+	for _, template := range templates {
+		templateNames[template.ID] = template.Name
+	}
+	data := &backupData{Templates: templates, Domains: []domainBackup{}, PTRRecords: ptrRecords}
+	seconds := func(d time.Duration) int32 { return int32(d / time.Second) }
+	for _, d := range domains {
+		data.Domains = append(data.Domains, domainBackup{Name: d.Name, TTL: seconds(d.DefaultTTL), Refresh: seconds(d.SOA.Refresh),
+			Retry: seconds(d.SOA.Retry), Expire: seconds(d.SOA.Expire), NegativeTTL: seconds(d.SOA.NegativeTTL), Hostmaster: d.SOA.Hostmaster,
+			Template: templateNames[d.TemplateID], PublishCDS: d.PublishCDS, DNSSECDelete: d.DNSSECDelete, DenialType: d.Denial.Type,
+			NSEC3Iterations: d.Denial.Iterations, NSEC3Salt: d.Denial.Salt, NSEC3OptOut: d.Denial.OptOut,
+			ARecords: d.ARecords, CNameRecords: d.CNameRecords, DKIMRecords: d.DKIMRecords, DMARCRecords: d.DMARCRecords,
+			MxRecords: d.MxRecords, NsRecords: d.NsRecords, SPFRecords: d.SPFRecords, SRVRecords: d.SRVRecords,
+			TXTRecords: d.TXTRecords, CAARecords: d.CAARecords})
+	}
+	return data, nil
+}
+
+// Import adds or replaces the templates, domains and PTR records in data. Domains are matched by name and
+// their records replaced. Anything in the database that isn't in data is left alone. Everything is imported in
+// one transaction, so a failed import leaves the database as it was
+func (d *db) Import(data *backupData) error {
+	tx, err := d.begin()
+	if err != nil {
+		return err
+	}
+	if err := importData(tx, data); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func importData(tx dbTx, data *backupData) error {
+	for _, t := range data.Templates {
+		err := tx.Execute(`insert into templates (name, nameservers, mailservers, spf, dmarcpolicy, dmarcreportaddress, caaissuers, tlsaports)
+values ($1, nullif($2, ''), nullif($3, ''), nullif($4, ''), nullif($5, ''), nullif($6, ''), nullif($7, ''), nullif($8, ''))
+on conflict (name) do update set nameservers = excluded.nameservers, mailservers = excluded.mailservers, spf = excluded.spf,
+dmarcpolicy = excluded.dmarcpolicy, dmarcreportaddress = excluded.dmarcreportaddress, caaissuers = excluded.caaissuers, tlsaports = excluded.tlsaports`,
+			t.Name, t.NameServers, t.MailServers, t.SPF, t.DMARCPolicy, t.DMARCReportAddress, t.CAAIssuers, t.TLSAPorts)
+		if err != nil {
+			return errors.New("Unable to import template " + t.Name + " " + err.Error())
+		}
+	}
+	for i := range data.Domains {
+		if err := importDomain(tx, &data.Domains[i]); err != nil {
+			return errors.New("Unable to import domain " + data.Domains[i].Name + " " + err.Error())
+		}
+	}
+	for _, r := range data.PTRRecords {
+		err := tx.Execute(`insert into ptrrecords (ipaddress, name, ttl) values ($1, $2, nullif($3, 0))
+on conflict (ipaddress) do update set name = excluded.name, ttl = excluded.ttl`, r.IPAddress, r.Name, r.TTL)
+		if err != nil {
+			return errors.New("Unable to import PTR record " + r.IPAddress + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+func importDomain(tx dbTx, b *domainBackup) error {
+	id, err := tx.QueryID("select id from domains where name = $1", b.Name)
+	if err == errNoRows {
+		id, err = tx.QueryID("insert into domains (name) values ($1) returning id", b.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tx.Execute(`update domains set ttl = nullif($2, 0), refresh = nullif($3, 0), retry = nullif($4, 0),
+expire = nullif($5, 0), negativettl = nullif($6, 0), hostmaster = nullif($7, ''), templateid = (select id from templates where name = $8),
+publishcds = $9, dnssecdelete = $10, denialtype = nullif($11, ''), nsec3iterations = nullif($12, 0), nsec3salt = nullif($13, ''),
+nsec3optout = $14 where id = $1`, id, b.TTL, b.Refresh, b.Retry, b.Expire, b.NegativeTTL, b.Hostmaster, b.Template,
+		b.PublishCDS, b.DNSSECDelete, b.DenialType, b.NSEC3Iterations, b.NSEC3Salt, b.NSEC3OptOut)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"arecords", "cnamerecords", "dkimrecords", "dmarcrecords", "mxrecords", "nsrecords", "spfrecords",
+		"srvrecords", "txtrecords", "caarecords"} {
+		if err := tx.Execute("delete from "+table+" where domainid = $1", id); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.ARecords {
+		if err := tx.Execute("insert into arecords (domainid, name, ipaddress, dynamicfqdn, ttl) values ($1, $2, $3, $4, nullif($5, 0))",
+			id, r.Name, r.IPAddress, r.DynamicFQDN, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.CNameRecords {
+		if err := tx.Execute("insert into cnamerecords (domainid, name, canonicalname, ttl) values ($1, $2, $3, nullif($4, 0))",
+			id, r.Name, r.CanonicalName, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.DKIMRecords {
+		if err := tx.Execute("insert into dkimrecords (domainid, name, value, ttl) values ($1, $2, $3, nullif($4, 0))",
+			id, r.Name, r.Value, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.DMARCRecords {
+		if err := tx.Execute("insert into dmarcrecords (domainid, name, value, ttl) values ($1, $2, $3, nullif($4, 0))",
+			id, r.Name, r.Value, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.MxRecords {
+		if err := tx.Execute("insert into mxrecords (domainid, name, value, priority, ttl) values ($1, $2, $3, $4, nullif($5, 0))",
+			id, r.Name, r.Value, r.Priority, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.NsRecords {
+		if err := tx.Execute("insert into nsrecords (domainid, name, value, sortorder, ttl) values ($1, $2, $3, $4, nullif($5, 0))",
+			id, r.Name, r.Value, r.SortOrder, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.SPFRecords {
+		if err := tx.Execute("insert into spfrecords (domainid, name, value, ttl) values ($1, $2, $3, nullif($4, 0))",
+			id, r.Name, r.Value, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.SRVRecords {
+		if err := tx.Execute(`insert into srvrecords (domainid, service, protocol, priority, weight, port, target, ttl)
+values ($1, $2, $3, $4, $5, $6, $7, nullif($8, 0))`, id, r.Service, r.Protocol, r.Priority, r.Weight, r.Port, r.Target, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.TXTRecords {
+		if err := tx.Execute("insert into txtrecords (domainid, name, value, ttl) values ($1, $2, $3, nullif($4, 0))",
+			id, r.Name, r.Value, r.TTL); err != nil {
+			return err
+		}
+	}
+	for _, r := range b.CAARecords {
+		if err := tx.Execute("insert into caarecords (domainid, name, flags, tag, value, ttl) values ($1, $2, $3, $4, $5, nullif($6, 0))",
+			id, r.Name, r.Flags, r.Tag, r.Value, r.TTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
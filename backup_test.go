@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeTx counts the rows of each table. Statements change a copy that only replaces the rows on Commit
+type fakeTx struct {
+	rows       map[string]int
+	pending    map[string]int
+	ids        []int16 // returned by QueryID in turn. errNoRows once used up
+	failOn     string  // statements containing this fail
+	committed  bool
+	rolledBack bool
+}
+
+func newFakeTx(rows map[string]int, ids ...int16) *fakeTx {
+	tx := &fakeTx{rows: rows, pending: make(map[string]int), ids: ids}
+	for table, count := range rows {
+		tx.pending[table] = count
+	}
+	return tx
+}
+
+func (t *fakeTx) Execute(query string, args ...interface{}) error {
+	if t.failOn != "" && strings.Contains(query, t.failOn) {
+		return errors.New("fail")
+	}
+	fields := strings.Fields(query)
+	if fields[0] == "delete" {
+		t.pending[fields[2]] = 0
+	} else if fields[0] == "insert" {
+		t.pending[fields[2]]++
+	}
+	return nil
+}
+
+func (t *fakeTx) QueryID(query string, args ...interface{}) (int16, error) {
+	if len(t.ids) == 0 {
+		return 0, errNoRows
+	}
+	id := t.ids[0]
+	t.ids = t.ids[1:]
+	return id, nil
+}
+
+func (t *fakeTx) Commit() error {
+	t.rows, t.committed = t.pending, true
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.rolledBack = true
+	return nil
+}
+
+func TestImport(t *testing.T) {
+	data := &backupData{Templates: []zoneTemplate{zoneTemplate{Name: "web"}},
+		Domains: []domainBackup{domainBackup{Name: "example.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}},
+			MxRecords: []mxRecord{mxRecord{Value: "mail"}}, SRVRecords: []srvRecord{srvRecord{Service: "xmpp-client"}}}},
+		PTRRecords: []ptrRecord{ptrRecord{IPAddress: "10.1.0.6", Name: "example.com."}}}
+	tx := newFakeTx(map[string]int{"arecords": 2, "srvrecords": 3}, 1)
+	d := db{begin: func() (dbTx, error) { return tx, nil }}
+	if err := d.Import(data); err != nil || !tx.committed || tx.rows["arecords"] != 1 || tx.rows["srvrecords"] != 1 ||
+		tx.rows["mxrecords"] != 1 || tx.rows["templates"] != 1 || tx.rows["ptrrecords"] != 1 {
+		t.Error("expected records to be replaced", err, tx.rows)
+	}
+
+	// new domain
+	tx = newFakeTx(map[string]int{})
+	d = db{begin: func() (dbTx, error) { return tx, nil }}
+	if err := d.Import(&backupData{Domains: data.Domains}); err == nil || !tx.rolledBack {
+		t.Error("expected error due to failed domain insert", err)
+	}
+
+	d = db{begin: func() (dbTx, error) { return nil, errors.New("fail") }}
+	if err := d.Import(data); err == nil {
+		t.Error("expected error due to failed begin")
+	}
+
+	for _, failOn := range []string{"insert into templates", "insert into srvrecords", "insert into ptrrecords"} {
+		tx = newFakeTx(map[string]int{"arecords": 2, "srvrecords": 3}, 1)
+		tx.failOn = failOn
+		d = db{begin: func() (dbTx, error) { return tx, nil }}
+		if err := d.Import(data); err == nil || tx.committed || !tx.rolledBack || tx.rows["arecords"] != 2 || tx.rows["srvrecords"] != 3 {
+			t.Error("expected existing records to be kept after failed insert", failOn, err, tx.rows)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// exit codes shared by every command so cron and systemd can tell failures apart
+const (
+	exitSuccess   = 0
+	exitFailure   = 1 // the command failed
+	exitUsage     = 2 // invalid command or arguments
+	exitAttention = 3 // the command ran but found something that needs attention
+)
+
+const usage = `Usage: dnsZoneWriter [--config path] <command> [arguments]
+
+Commands:
+  write [--dry-run] [--force]
+                            write, sign and publish the zones that changed (default). --force
+                            rebuilds every zone even if its inputs haven't changed
+  daemon                    keep running and write zones as they change or need re-signing
+  diff [--force]            print what write would change without writing anything
+  sign [domain...]          re-sign zones now. Every zone if no domains are given
+  report                    list the earliest signature expiry of each signed zone
+  history <domain>          list the snapshots of a zone with their serials and what changed
+  rollback <domain> <time>  restore the zone snapshot taken at time, re-sign it and reload NSD
+  keys list [domain...]     list DNSSEC keys and their state
+  keys rollover <domain>    start a KSK rollover on the next write
+  keys confirm-ds <domain>  confirm the parent publishes the DS of the new KSK
+  validate                  check the configuration and lint the zones built from the database
+  export [file]             write the database contents as JSON. To stdout if no file is given
+  import <file>             add or replace templates, domains and PTR records from an export
+  init-schema               create the database schema or bring it up to date
+
+Options:
+`
+
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+type cli struct {
+	stdout    io.Writer
+	stderr    io.Writer
+	addresser ipAddresser
+	openDb    func(w *dnsZoneWriter) (dnsBackend, error)
+	listen    func(w *dnsZoneWriter) (changeListener, error) // nil if the daemon only polls
+}
+
+func newCLI() *cli {
+	return &cli{stdout: os.Stdout, stderr: os.Stderr, addresser: &ipAddressHelper{}, openDb: func(w *dnsZoneWriter) (dnsBackend, error) {
+		db, err := newDb(w.DbServer, w.DbPort, w.DbUser, w.DbPassword, w.DbDatabase)
+		if err != nil {
+			return nil, errors.New("Unable to connect to database " + err.Error())
+		}
+		return db, nil
+	}, listen: func(w *dnsZoneWriter) (changeListener, error) {
+		return newListener(w.DbServer, w.DbPort, w.DbUser, w.DbPassword, w.DbDatabase)
+	}}
+}
+
+// run executes the command in args and returns the process exit code
+func (c *cli) run(args []string) int {
+	flags := flag.NewFlagSet("dnsZoneWriter", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.Usage = func() {
+		fmt.Fprint(c.stderr, usage)
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", "dnsZoneWriter.conf", "path to the configuration file")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return exitSuccess
+	} else if err != nil {
+		return exitUsage
+	}
+	args = flags.Args()
+	command := "write"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	code, err := c.runCommand(*configPath, command, args)
+	if _, ok := err.(usageError); ok {
+		fmt.Fprintln(c.stderr, err)
+		flags.Usage()
+		return exitUsage
+	} else if err != nil {
+		fmt.Fprintln(c.stderr, "Error:", err)
+		return exitFailure
+	}
+	return code
+}
+
+func (c *cli) runCommand(configPath string, command string, args []string) (int, error) {
+	switch command {
+	case "write", "daemon", "diff", "sign", "report", "history", "rollback", "keys", "validate", "export", "import", "init-schema":
+	default:
+		return exitUsage, usageError{"Unknown command " + command}
+	}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	dryRun := flags.Bool("dry-run", false, "")
+	force := flags.Bool("force", false, "")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage, usageError{err.Error()}
+	}
+	args = flags.Args()
+	if *dryRun && command != "write" {
+		return exitUsage, usageError{"--dry-run is only supported by write"}
+	}
+	if *force && command != "write" && command != "diff" {
+		return exitUsage, usageError{"--force is only supported by write and diff"}
+	}
+	if command == "daemon" {
+		return exitSuccess, c.daemon(configPath)
+	}
+
+	w, err := newDNSZoneWriter(configPath, c.addresser)
+	if err != nil {
+		return exitFailure, err
+	}
+	w.DryRun = *dryRun || command == "diff"
+	w.Force = *force
+	w.output = c.stdout
+
+	switch command {
+	case "report":
+		problems, err := w.SignatureReport(c.stdout, time.Now())
+		if err != nil || problems == 0 {
+			return exitSuccess, err
+		}
+		return exitAttention, nil
+	case "keys":
+		return exitSuccess, c.keys(w, args)
+	case "history":
+		if len(args) != 1 {
+			return exitUsage, usageError{"history needs a domain"}
+		}
+		return exitSuccess, w.ZoneHistory(c.stdout, args[0])
+	case "rollback":
+		if len(args) != 2 {
+			return exitUsage, usageError{"rollback needs a domain and the time of a snapshot from history"}
+		}
+	}
+
+	db, err := c.openDb(w)
+	if err != nil {
+		return exitFailure, err
+	}
+	switch command {
+	case "write", "diff":
+		return c.zoneResult(w.UpdateZoneData(db))
+	case "sign":
+		return c.zoneResult(w.SignZones(db, args))
+	case "rollback":
+		return exitSuccess, w.Rollback(db, args[0], args[1])
+	case "validate":
+		w.DryRun = true // don't upgrade the schema or create keys
+		w.Force = true  // build every zone
+		zones, err := w.GetZones(db)
+		if err != nil {
+			return exitFailure, err
+		}
+		warnings := 0
+		for i := range zones {
+			if zones[i].err == nil {
+				var zoneWarnings []lintProblem
+				zoneWarnings, zones[i].err = zones[i].Lint()
+				w.warn(zoneWarnings)
+				warnings += len(zoneWarnings)
+			}
+		}
+		if err := zoneFailures(zones); err != nil {
+			return exitFailure, err
+		}
+		fmt.Fprintf(c.stdout, "Configuration and %d zones are valid\n", len(zones))
+		if warnings > 0 {
+			return exitAttention, nil
+		}
+		return exitSuccess, nil
+	case "export":
+		return exitSuccess, c.export(db, args)
+	case "import":
+		if len(args) != 1 {
+			return exitUsage, usageError{"import needs the file to import"}
+		}
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return exitFailure, err
+		}
+		backup := &backupData{}
+		if err := json.Unmarshal(data, backup); err != nil {
+			return exitFailure, errors.New("Unable to read " + args[0] + " " + err.Error())
+		}
+		return exitSuccess, db.Import(backup)
+	}
+	return exitSuccess, db.CreateSchema()
+}
+
+// daemon runs until it receives SIGTERM or SIGINT
+func (c *cli) daemon(configPath string) error {
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	d, err := newDaemon(c, configPath, signals)
+	if err != nil {
+		return err
+	}
+	return d.run()
+}
+
+// zoneResult reports zones that failed while the others were written
+func (c *cli) zoneResult(err error) (int, error) {
+	if _, partial := err.(zoneErrors); partial {
+		fmt.Fprintln(c.stderr, err)
+		return exitAttention, nil
+	}
+	return exitSuccess, err
+}
+
+func (c *cli) keys(w *dnsZoneWriter, args []string) error {
+	if len(args) == 0 {
+		return usageError{"keys needs a subcommand: list, rollover or confirm-ds"}
+	}
+	switch args[0] {
+	case "list":
+		return w.ListKeys(c.stdout, args[1:])
+	case "rollover", "confirm-ds":
+		if len(args) != 2 {
+			return usageError{"keys " + args[0] + " needs a domain"}
+		}
+		if args[0] == "confirm-ds" {
+			return w.ConfirmDS(args[1])
+		}
+		if err := w.RollKSK(args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, "KSK rollover for", args[1], "starts on the next write")
+		return nil
+	}
+	return usageError{"Unknown keys subcommand " + args[0]}
+}
+
+func (c *cli) export(db dnsBackend, args []string) error {
+	if len(args) > 1 {
+		return usageError{"export takes at most one file"}
+	}
+	data, err := exportData(db)
+	if err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		_, err := fmt.Fprintln(c.stdout, string(output))
+		return err
+	}
+	return writeFileAtomic(args[0], output, 0600)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCLIUsage(t *testing.T) {
+	c, _, stderr, dir := newTestCLI(nil)
+	defer os.RemoveAll(dir)
+	for _, args := range [][]string{[]string{"bogus"}, []string{"--bogus"}, []string{"keys"}, []string{"keys", "bogus"},
+		[]string{"keys", "rollover"}, []string{"diff", "--dry-run"}, []string{"sign", "--force"}, []string{"import"}, []string{"export", "a", "b"},
+		[]string{"history"}, []string{"rollback", "example.com"}} {
+		stderr.Reset()
+		if code := c.run(append([]string{"--config", filepath.Join(dir, "test.conf")}, args...)); code != exitUsage ||
+			!strings.Contains(stderr.String(), "Usage:") {
+			t.Error("expected usage error", args, code, stderr.String())
+		}
+	}
+	if code := c.run([]string{"--help"}); code != exitSuccess {
+		t.Error("expected help to succeed", code)
+	}
+	if code := c.run([]string{"--config", filepath.Join(dir, "bogus.conf"), "report"}); code != exitFailure {
+		t.Error("expected failure due to missing config", code)
+	}
+}
+
+func TestCLIPartialFailure(t *testing.T) {
+	backend := &mockBackend{domains: []domain{domain{Name: "example.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}},
+		domain{Name: "bad.com", SOA: soaSettings{Retry: 3 * time.Hour}}}}
+	c, _, stderr, dir := newTestCLI(backend)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "test.conf")
+
+	if code := c.run([]string{"--config", config, "write"}); code != exitAttention || !strings.Contains(stderr.String(), "1 zone failed\n  bad.com: Invalid SOA settings") ||
+		!fileExists(filepath.Join(dir, "example.com.txt.signed")) {
+		t.Error("expected the good zone to be written and the failed one reported", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := c.run([]string{"--config", config, "validate"}); code != exitFailure || !strings.Contains(stderr.String(), "bad.com: Invalid SOA settings") {
+		t.Error("expected validate to fail", code, stderr.String())
+	}
+}
+
+func TestCLIWrite(t *testing.T) {
+	backend := &mockBackend{domains: []domain{domain{Name: "example.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}},
+		NsRecords: []nsRecord{nsRecord{Value: "ns1.example.net."}}}}}
+	c, stdout, stderr, dir := newTestCLI(backend)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "test.conf")
+
+	if code := c.run([]string{"--config", config, "diff"}); code != exitSuccess || !strings.Contains(stdout.String(), "+++ b/example.com.txt") {
+		t.Fatal("expected diff", code, stdout.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com.txt")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written by diff")
+	}
+	if code := c.run([]string{"--config", config}); code != exitSuccess {
+		t.Fatal("expected write to be the default command", code, stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com.txt.signed")); err != nil {
+		t.Error("expected signed zone to be written", err)
+	}
+	if code := c.run([]string{"--config", config, "sign", "example.com"}); code != exitSuccess {
+		t.Error("expected zone to be re-signed", code)
+	}
+	if code := c.run([]string{"--config", config, "sign", "example.org"}); code != exitFailure {
+		t.Error("expected failure due to unknown zone", code)
+	}
+	stdout.Reset()
+	if code := c.run([]string{"--config", config, "report"}); code != exitSuccess || !strings.Contains(stdout.String(), "example.com") {
+		t.Error("expected signature report", code, stdout.String())
+	}
+	stdout.Reset()
+	if code := c.run([]string{"--config", config, "validate"}); code != exitSuccess || !strings.Contains(stdout.String(), "1 zones are valid") {
+		t.Error("expected zones to be valid", code, stdout.String())
+	}
+
+	backend.createSchemaErr = errors.New("fail")
+	if code := c.run([]string{"--config", config, "init-schema"}); code != exitFailure {
+		t.Error("expected failure from schema creation", code)
+	}
+	c.openDb = func(w *dnsZoneWriter) (dnsBackend, error) { return nil, errors.New("fail") }
+	if code := c.run([]string{"--config", config, "write"}); code != exitFailure {
+		t.Error("expected failure due to database connection", code)
+	}
+}
+
+func TestCLIReportAttention(t *testing.T) {
+	c, _, _, dir := newTestCLI(nil)
+	defer os.RemoveAll(dir)
+	expiration := time.Now().Add(time.Hour).UTC().Format("20060102150405")
+	ioutil.WriteFile(filepath.Join(dir, "example.com.txt.signed"),
+		[]byte("example.com. 1800 IN RRSIG SOA 8 2 1800 "+expiration+" 20160921090003 27633 example.com. AAAA"), 0644)
+	if code := c.run([]string{"--config", filepath.Join(dir, "test.conf"), "report"}); code != exitAttention {
+		t.Error("expected zone to need attention", code)
+	}
+}
+
+func TestCLIKeys(t *testing.T) {
+	c, stdout, _, dir := newTestCLI(nil)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "test.conf")
+	if code := c.run([]string{"--config", config, "keys", "list", "example.com"}); code != exitFailure {
+		t.Error("expected failure due to missing keys", code)
+	}
+	if code := c.run([]string{"--config", config, "keys", "rollover", "example.com"}); code != exitFailure || fileExists(filepath.Join(dir, "example.com.keys.json")) {
+		t.Error("expected failure without creating keys", code)
+	}
+	keys, _ := loadDomainKeys(dir, "example.com", testKeyPolicy())
+	keys.save()
+	if code := c.run([]string{"--config", config, "keys", "rollover", "example.com"}); code != exitSuccess {
+		t.Error("expected rollover to be requested", code)
+	}
+	stdout.Reset()
+	if code := c.run([]string{"--config", config, "keys", "list"}); code != exitSuccess || !strings.Contains(stdout.String(), "KSK rollover requested") ||
+		strings.Count(stdout.String(), "active") != 2 {
+		t.Error("expected keys to be listed", code, stdout.String())
+	}
+	if code := c.run([]string{"--config", config, "keys", "confirm-ds", "example.com"}); code != exitFailure {
+		t.Error("expected failure since rollover hasn't started", code)
+	}
+}
+
+func TestCLIExportImport(t *testing.T) {
+	backend := &mockBackend{domains: []domain{domain{Name: "example.com", DefaultTTL: time.Hour, TemplateID: 1,
+		ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}}}, templates: []zoneTemplate{zoneTemplate{ID: 1, Name: "web"}},
+		ptrRecords: []ptrRecord{ptrRecord{IPAddress: "10.1.0.6", Name: "example.com."}}}
+	c, stdout, _, dir := newTestCLI(backend)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "test.conf")
+	if code := c.run([]string{"--config", config, "export"}); code != exitSuccess || !strings.Contains(stdout.String(), `"Template": "web"`) {
+		t.Error("expected export to stdout", code, stdout.String())
+	}
+	file := filepath.Join(dir, "export.json")
+	if code := c.run([]string{"--config", config, "export", file}); code != exitSuccess {
+		t.Error("expected export to file", code)
+	}
+	if code := c.run([]string{"--config", config, "import", file}); code != exitSuccess || backend.imported == nil ||
+		backend.imported.Domains[0].TTL != 3600 || backend.imported.Domains[0].ARecords[0].IPAddress != "10.1.0.6" ||
+		len(backend.imported.PTRRecords) != 1 {
+		t.Error("expected exported data to be imported", code, backend.imported)
+	}
+	ioutil.WriteFile(file, []byte("bogus"), 0600)
+	if code := c.run([]string{"--config", config, "import", file}); code != exitFailure {
+		t.Error("expected failure due to invalid file", code)
+	}
+	backend.getDomainsErr = errors.New("fail")
+	if code := c.run([]string{"--config", config, "export"}); code != exitFailure {
+		t.Error("expected failure due to database error", code)
+	}
+}
+
+func TestCLIValidateLint(t *testing.T) {
+	backend := &mockBackend{domains: []domain{domain{Name: "example.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"},
+		aRecord{Name: "_host", IPAddress: "10.1.0.7"}}}}}
+	c, stdout, stderr, dir := newTestCLI(backend)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "test.conf")
+	if code := c.run([]string{"--config", config, "validate"}); code != exitAttention ||
+		!strings.Contains(stdout.String(), "Warning: _host.example.com. A record name isn't a valid host name") {
+		t.Error("expected warning", code, stdout.String())
+	}
+
+	backend.domains[0].CNameRecords = []cnameRecord{cnameRecord{Name: "_host", CanonicalName: "example.net."}}
+	if code := c.run([]string{"--config", config, "validate"}); code != exitFailure ||
+		!strings.Contains(stderr.String(), "example.com: Zone has errors: _host.example.com. CNAME can't share its name with other records (A, TXT)") {
+		t.Error("expected lint error", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := c.run([]string{"--config", config, "write"}); code != exitAttention || fileExists(filepath.Join(dir, "example.com.txt")) {
+		t.Error("expected zone with errors not to be written", code, stderr.String())
+	}
+}
+
+func TestCLIHistoryRollback(t *testing.T) {
+	backend := &mockBackend{domains: []domain{domain{Name: "example.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}}}}
+	c, stdout, _, dir := newTestCLI(backend)
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "test.conf")
+	filename := filepath.Join(dir, "example.com.txt")
+	// snapshots are named to the second, so move each one back in time before the next is taken
+	age := func(hours int) string {
+		timestamp := time.Now().Add(time.Duration(-hours) * time.Hour).Format(snapshotTimeFormat)
+		os.Rename(filename+"_"+time.Now().Format(snapshotTimeFormat), filename+"_"+timestamp)
+		return timestamp
+	}
+
+	if code := c.run([]string{"--config", config, "history", "example.com"}); code != exitFailure {
+		t.Error("expected failure without history", code)
+	}
+	c.run([]string{"--config", config, "write"})
+	first := age(2)
+	backend.domains[0].ARecords[0].IPAddress = "10.1.0.7"
+	c.run([]string{"--config", config, "write"})
+	age(1)
+	_, serial := getFileMatch(filename, `SOA.*\((\d*)`)
+
+	stdout.Reset()
+	if code := c.run([]string{"--config", config, "history", "example.com"}); code != exitSuccess || !strings.Contains(stdout.String(), first+"  serial") ||
+		!strings.Contains(stdout.String(), "+example.com.\t1800\tIN\tA\t10.1.0.7") {
+		t.Error("expected history with the change", code, stdout.String())
+	}
+	if code := c.run([]string{"--config", config, "rollback", "example.com", "20000101-000000"}); code != exitFailure {
+		t.Error("expected failure due to unknown snapshot", code)
+	}
+	if code := c.run([]string{"--config", config, "rollback", "example.com", first}); code != exitSuccess {
+		t.Fatal("expected rollback", code)
+	}
+	zone, newSerial := getFileMatch(filename, `SOA.*\((\d*)`)
+	signed, _ := ioutil.ReadFile(filename + ".signed")
+	if !strings.Contains(zone, "10.1.0.6") || newSerial != getSerialNumberRevision(serial, serial) || !strings.Contains(string(signed), "10.1.0.6") {
+		t.Error("expected first zone restored with a new serial and signed", serial, newSerial, zone)
+	}
+	if snapshots, _ := zoneSnapshots(dir, "example.com"); len(snapshots) != 3 {
+		t.Error("expected rollback to be added to the history", snapshots)
+	}
+	if !strings.Contains(stdout.String(), "The zone is kept until example.com changes in the database") {
+		t.Error("expected pinned zone to be reported", stdout.String())
+	}
+
+	// the rolled back zone is re-signed as it is, not rebuilt from the database
+	os.Remove(filename + ".signed")
+	if code := c.run([]string{"--config", config, "write"}); code != exitSuccess {
+		t.Fatal("expected write", code)
+	}
+	zone, resignedSerial := getFileMatch(filename, `SOA.*\((\d*)`)
+	if !strings.Contains(zone, "10.1.0.6") || resignedSerial == newSerial || !fileExists(filename+".signed") {
+		t.Error("expected rolled back zone to be re-signed with a new serial", newSerial, resignedSerial, zone)
+	}
+
+	// a change in the database ends the rollback
+	backend.domains[0].ARecords[0].IPAddress = "10.1.0.8"
+	if code := c.run([]string{"--config", config, "write"}); code != exitSuccess {
+		t.Fatal("expected write", code)
+	}
+	if zone, _ := getFileMatch(filename, `SOA.*\((\d*)`); !strings.Contains(zone, "10.1.0.8") || fileExists(filename+".pinned") {
+		t.Error("expected zone to be rebuilt from the database", zone)
+	}
+}
+
+func newTestCLI(backend dnsBackend) (*cli, *bytes.Buffer, *bytes.Buffer, string) {
+	dir := tempDir()
+	config := "NsdDir=" + dir + "\nZoneFileDirectory=" + dir + "\nDNSSecKeyDir=" + dir + "\nSigningAlgorithm=RSASHA256\nDNSMasterIP=10.1.0.6\n" +
+		"DefaultNameServers=ns1.example.net.\n"
+	ioutil.WriteFile(filepath.Join(dir, "test.conf"), []byte(config), 0644)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	return &cli{stdout: stdout, stderr: stderr, addresser: newMockIPAddresser("", nil),
+		openDb: func(w *dnsZoneWriter) (dnsBackend, error) { return backend, nil }}, stdout, stderr, dir
+}
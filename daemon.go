@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const daemonInterval time.Duration = 5 * time.Minute
+const daemonDebounce time.Duration = 10 * time.Second
+const dynamicFQDNCacheLifetime time.Duration = 5 * time.Minute
+const listenRetry time.Duration = 30 * time.Second
+
+// daemonPolicy controls how often the daemon regenerates the zones. Every Interval the zones are updated, which
+// also re-signs any whose signatures are due to expire. Changes are collected until none have arrived for Debounce
+type daemonPolicy struct {
+	Interval          time.Duration
+	Debounce          time.Duration
+	NameCacheLifetime time.Duration // how long dynamic FQDN lookups are reused
+	ListenRetry       time.Duration // wait before reconnecting after losing database notifications
+}
+
+func (p daemonPolicy) validate(signatures signaturePolicy) error {
+	if p.Interval <= 0 || p.Debounce < 0 || p.NameCacheLifetime < 0 {
+		return errors.New("Daemon interval must be greater than zero and debounce and cache lifetime can't be negative")
+	}
+	if p.Debounce >= p.Interval {
+		return errors.New("Daemon debounce must be less than the daemon interval")
+	}
+	if p.Interval >= signatures.Refresh {
+		return errors.New("Daemon interval must be less than the signature refresh so zones are re-signed in time")
+	}
+	return nil
+}
+
+// daemon keeps the zones up to date until it receives SIGTERM or SIGINT. SIGHUP reloads the configuration and
+// SIGUSR1 requests an update now. Domains reported by the database triggers are updated on their own. Updates
+// run one at a time so a signal received during an update is handled once it ends
+type daemon struct {
+	cli            *cli
+	configPath     string
+	writer         *dnsZoneWriter
+	db             dnsBackend
+	policy         daemonPolicy
+	signals        chan os.Signal
+	changes        chan struct{}
+	notifications  chan int16
+	listenerErrors chan error
+	stopListening  context.CancelFunc
+}
+
+func newDaemon(c *cli, configPath string, signals chan os.Signal) (*daemon, error) {
+	d := &daemon{cli: c, configPath: configPath, signals: signals, changes: make(chan struct{}, 1),
+		notifications: make(chan int16), listenerErrors: make(chan error)}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load reads the configuration and connects to the database if this is the first load or the database settings changed.
+// The previous connection is closed once it's replaced
+func (d *daemon) load() error {
+	w, err := newDNSZoneWriter(d.configPath, d.cli.addresser)
+	if err != nil {
+		return err
+	}
+	policy, err := w.GetDaemonPolicy()
+	if err != nil {
+		return err
+	}
+	w.output = d.cli.stdout
+	db := d.db
+	if d.writer == nil || w.DbServer != d.writer.DbServer || w.DbPort != d.writer.DbPort || w.DbUser != d.writer.DbUser ||
+		w.DbPassword != d.writer.DbPassword || w.DbDatabase != d.writer.DbDatabase {
+		if db, err = d.cli.openDb(w); err != nil {
+			return err
+		}
+	}
+	previous := d.db
+	d.writer, d.db, d.policy = w, db, policy
+	if previous != nil && previous != db {
+		previous.Close()
+	}
+	return nil
+}
+
+// changed asks for the zones to be updated once the current burst of changes is over
+func (d *daemon) changed() {
+	select {
+	case d.changes <- struct{}{}:
+	default: // an update is already pending
+	}
+}
+
+func (d *daemon) run() error {
+	d.startListener()
+	defer func() { d.stopListening() }()
+	d.update(nil)
+	ticker := time.NewTicker(d.policy.Interval)
+	defer func() { ticker.Stop() }()
+	var settled <-chan time.Time
+	var burstStarted time.Time
+	full := false
+	domains := make(map[int16]bool)
+	// wait for the changes to settle, but no longer than an interval after the first one
+	settle := func() {
+		now := time.Now()
+		if settled == nil {
+			burstStarted = now
+		}
+		wait := d.policy.Debounce
+		if limit := burstStarted.Add(d.policy.Interval).Sub(now); limit < wait {
+			wait = limit
+		}
+		settled = time.After(wait)
+	}
+	for {
+		select {
+		case sig := <-d.signals:
+			switch sig {
+			case syscall.SIGHUP:
+				interval, db := d.policy.Interval, d.db
+				if err := d.load(); err != nil {
+					fmt.Fprintln(d.cli.stderr, "Unable to reload configuration. Keeping the current one.", err)
+					continue
+				}
+				fmt.Fprintln(d.cli.stdout, "Reloaded configuration")
+				if d.policy.Interval != interval {
+					ticker.Stop()
+					ticker = time.NewTicker(d.policy.Interval)
+				}
+				if d.db != db {
+					d.startListener()
+				}
+				d.changed()
+			case syscall.SIGUSR1:
+				d.changed()
+			default:
+				fmt.Fprintln(d.cli.stdout, "Stopping on", sig)
+				return nil
+			}
+		case <-d.changes:
+			full = true
+			settle()
+		case id := <-d.notifications:
+			if id == 0 {
+				full = true
+			}
+			domains[id] = true
+			settle()
+		case err := <-d.listenerErrors:
+			fmt.Fprintln(d.cli.stderr, "Lost database notifications. Retrying in", d.policy.ListenRetry, err)
+		case <-settled:
+			settled = nil
+			if full {
+				d.update(nil)
+			} else {
+				ids := []int16{}
+				for id := range domains {
+					ids = append(ids, id)
+				}
+				d.update(ids)
+			}
+			full = false
+			domains = make(map[int16]bool)
+		case <-ticker.C:
+			if settled == nil {
+				d.update(nil)
+			}
+		}
+	}
+}
+
+// update writes and signs the zones of the given domains or, if nil, every zone that changed or is due to be
+// re-signed. Errors are logged and retried on the next update
+func (d *daemon) update(ids []int16) {
+	expireNameCache(time.Now(), d.policy.NameCacheLifetime)
+	var err error
+	if ids == nil {
+		err = d.writer.UpdateZoneData(d.db)
+	} else {
+		err = d.writer.UpdateDomains(d.db, ids)
+	}
+	if err != nil {
+		fmt.Fprintln(d.cli.stderr, "Error:", err)
+	}
+}
+
+// startListener listens for database notifications with the current configuration, replacing any earlier listener
+func (d *daemon) startListener() {
+	if d.stopListening != nil {
+		d.stopListening()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stopListening = cancel
+	if d.cli.listen != nil {
+		go d.listen(ctx, d.writer, d.policy.ListenRetry)
+	}
+}
+
+// listen passes the IDs of changed domains to the daemon until ctx is cancelled, reconnecting after errors.
+// Every zone is updated after connecting following an error, including a failed first attempt, since changes
+// made in the meantime weren't reported
+func (d *daemon) listen(ctx context.Context, w *dnsZoneWriter, retry time.Duration) {
+	for retrying := false; ; retrying = true {
+		listener, err := d.cli.listen(w)
+		if err == nil {
+			if retrying {
+				d.changed()
+			}
+			err = d.forward(ctx, listener)
+			listener.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case d.listenerErrors <- err:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *daemon) forward(ctx context.Context, listener changeListener) error {
+	for {
+		id, err := listener.WaitForChange(ctx)
+		if err != nil {
+			return err
+		}
+		select {
+		case d.notifications <- id:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type countingBackend struct {
+	*mockBackend
+	updates int32
+}
+
+func (b *countingBackend) GetDomains() ([]domain, error) {
+	atomic.AddInt32(&b.updates, 1)
+	return b.mockBackend.GetDomains()
+}
+
+func (b *countingBackend) count() int32 {
+	return atomic.LoadInt32(&b.updates)
+}
+
+func waitFor(t *testing.T, message string, condition func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+	}
+}
+
+type fakeListener struct {
+	changes chan int16
+}
+
+func (l *fakeListener) WaitForChange(ctx context.Context) (int16, error) {
+	select {
+	case id := <-l.changes:
+		return id, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (l *fakeListener) Close() error {
+	return nil
+}
+
+func startTestDaemon(t *testing.T, policy daemonPolicy) (*daemon, *countingBackend, chan error, string) {
+	return startListeningDaemon(t, policy, newMockBackend(nil), nil)
+}
+
+func startListeningDaemon(t *testing.T, policy daemonPolicy, mock *mockBackend,
+	listen func(w *dnsZoneWriter) (changeListener, error)) (*daemon, *countingBackend, chan error, string) {
+	backend := &countingBackend{mockBackend: mock}
+	c, _, _, dir := newTestCLI(backend)
+	c.listen = listen
+	d, err := newDaemon(c, filepath.Join(dir, "test.conf"), make(chan os.Signal, 4))
+	if err != nil {
+		t.Fatal("unable to start daemon", err)
+	}
+	d.policy = policy
+	done := make(chan error)
+	go func() { done <- d.run() }()
+	waitFor(t, "expected update on start", func() bool { return backend.count() == 1 })
+	return d, backend, done, dir
+}
+
+func TestDaemonDebounce(t *testing.T) {
+	d, backend, done, dir := startTestDaemon(t, daemonPolicy{Interval: time.Hour, Debounce: 20 * time.Millisecond})
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 5; i++ {
+		d.changed()
+	}
+	waitFor(t, "expected update after changes settled", func() bool { return backend.count() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if backend.count() != 2 {
+		t.Fatal("expected burst of changes to cause a single update", backend.count())
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "test.conf"), []byte("DaemonIntervalSeconds=bogus"), 0644)
+	d.signals <- syscall.SIGHUP
+	d.signals <- syscall.SIGUSR1
+	waitFor(t, "expected update on SIGUSR1", func() bool { return backend.count() == 3 })
+
+	d.signals <- syscall.SIGTERM
+	if err := <-done; err != nil {
+		t.Fatal("expected clean stop", err)
+	}
+	stderr := d.cli.stderr.(interface{ String() string }).String()
+	stdout := d.cli.stdout.(interface{ String() string }).String()
+	if !strings.Contains(stderr, "Unable to reload configuration") || !strings.Contains(stdout, "Stopping on terminated") ||
+		d.policy.Debounce != 20*time.Millisecond {
+		t.Error("expected failed reload to keep the current configuration", stdout, stderr, d.policy)
+	}
+}
+
+func TestDaemonPolling(t *testing.T) {
+	d, backend, done, dir := startTestDaemon(t, daemonPolicy{Interval: 20 * time.Millisecond})
+	defer os.RemoveAll(dir)
+	waitFor(t, "expected updates on every interval", func() bool { return backend.count() >= 3 })
+	d.signals <- os.Interrupt
+	if err := <-done; err != nil {
+		t.Fatal("expected clean stop", err)
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	d, backend, done, dir := startTestDaemon(t, daemonPolicy{Interval: time.Hour, Debounce: time.Millisecond})
+	defer os.RemoveAll(dir)
+	config, _ := ioutil.ReadFile(filepath.Join(dir, "test.conf"))
+	ioutil.WriteFile(filepath.Join(dir, "test.conf"), append(config, []byte("DaemonIntervalSeconds=60\nDaemonDebounceSeconds=0\n")...), 0644)
+	d.signals <- syscall.SIGHUP
+	waitFor(t, "expected update after reload", func() bool { return backend.count() == 2 })
+	d.signals <- syscall.SIGTERM
+	if err := <-done; err != nil || d.policy.Interval != time.Minute || d.policy.Debounce != 0 || d.db != backend {
+		t.Error("expected reloaded configuration with the same database", err, d.policy)
+	}
+}
+
+func TestDaemonReloadDatabase(t *testing.T) {
+	d, backend, done, dir := startTestDaemon(t, daemonPolicy{Interval: time.Hour, Debounce: time.Millisecond})
+	defer os.RemoveAll(dir)
+	replacement := &countingBackend{mockBackend: newMockBackend(nil)}
+	d.cli.openDb = func(w *dnsZoneWriter) (dnsBackend, error) { return replacement, nil }
+	config, _ := ioutil.ReadFile(filepath.Join(dir, "test.conf"))
+	ioutil.WriteFile(filepath.Join(dir, "test.conf"), append(config, []byte("DbServer=db2.example.com\nDaemonDebounceSeconds=0\n")...), 0644)
+	d.signals <- syscall.SIGHUP
+	waitFor(t, "expected update with the new database", func() bool { return replacement.count() == 1 })
+	d.signals <- syscall.SIGTERM
+	if err := <-done; err != nil || d.db != replacement || !backend.closed || replacement.closed {
+		t.Error("expected the replaced database to be closed", err, backend.closed, replacement.closed)
+	}
+}
+
+func TestDaemonNotifications(t *testing.T) {
+	listener := &fakeListener{changes: make(chan int16)}
+	var attempts int32
+	listen := func(w *dnsZoneWriter) (changeListener, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return listener, nil
+	}
+	mock := newMockBackend([]domain{domain{ID: 1, Name: "a.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}},
+		domain{ID: 2, Name: "b.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.7"}}}})
+	d, backend, done, dir := startListeningDaemon(t, daemonPolicy{Interval: time.Hour, Debounce: 20 * time.Millisecond,
+		ListenRetry: time.Millisecond}, mock, listen)
+	defer os.RemoveAll(dir)
+	waitFor(t, "expected zones written on start", func() bool { return fileExists(filepath.Join(dir, "b.com.txt.signed")) })
+	// the first connection failed, so every zone is updated once the listener connects
+	waitFor(t, "expected update after the listener connected", func() bool { return backend.count() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	os.Remove(filepath.Join(dir, "a.com.txt"))
+	os.Remove(filepath.Join(dir, "b.com.txt"))
+
+	listener.changes <- 1
+	listener.changes <- 1
+	waitFor(t, "expected changed domain to be written", func() bool { return fileExists(filepath.Join(dir, "a.com.txt")) })
+	d.signals <- syscall.SIGTERM
+	if err := <-done; err != nil || backend.count() != 3 || fileExists(filepath.Join(dir, "b.com.txt")) {
+		t.Error("expected a single update of only the changed domain", err, backend.count())
+	}
+	if stderr := d.cli.stderr.(interface{ String() string }).String(); !strings.Contains(stderr, "Lost database notifications") {
+		t.Error("expected listener error to be logged", stderr)
+	}
+}
+
+func TestDaemonPolicyValidate(t *testing.T) {
+	signatures := signaturePolicy{Validity: signatureValidity, Refresh: signatureRefresh, Jitter: signatureJitter}
+	if err := (daemonPolicy{Interval: daemonInterval, Debounce: daemonDebounce}).validate(signatures); err != nil {
+		t.Error("expected valid policy", err)
+	}
+	for _, policy := range []daemonPolicy{daemonPolicy{}, daemonPolicy{Interval: time.Minute, Debounce: -1},
+		daemonPolicy{Interval: time.Minute, NameCacheLifetime: -1}, daemonPolicy{Interval: time.Minute, Debounce: time.Minute},
+		daemonPolicy{Interval: signatureRefresh}} {
+		if err := policy.validate(signatures); err == nil {
+			t.Error("expected error", policy)
+		}
+	}
+}
+
+func TestCLIDaemon(t *testing.T) {
+	c, _, stderr, dir := newTestCLI(nil)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "test.conf"), []byte("ZoneFileDirectory="+dir+"\nDaemonDebounceSeconds=bogus"), 0644)
+	if code := c.run([]string{"--config", filepath.Join(dir, "test.conf"), "daemon"}); code != exitFailure ||
+		!strings.Contains(stderr.String(), "Invalid daemon debounce") {
+		t.Error("expected invalid configuration to stop the daemon from starting", code, stderr.String())
+	}
+}
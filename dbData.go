@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	_ "embed" // schema scripts
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx"
 	"github.com/robarchibald/onedb"
-	"io/ioutil"
+	"regexp"
 	"strconv"
+	"time"
 )
 
 type aRecord struct {
@@ -12,24 +18,28 @@ type aRecord struct {
 	Name        string
 	IPAddress   string
 	DynamicFQDN string
+	TTL         int32
 }
 
 type cnameRecord struct {
 	DomainID      int16
 	Name          string
 	CanonicalName string
+	TTL           int32
 }
 
 type dkimRecord struct {
 	DomainID int16
 	Name     string
 	Value    string
+	TTL      int32
 }
 
 type dmarcRecord struct {
 	DomainID int16
 	Name     string
 	Value    string
+	TTL      int32
 }
 
 type mxRecord struct {
@@ -37,6 +47,7 @@ type mxRecord struct {
 	Name     string
 	Value    string
 	Priority int16
+	TTL      int32
 }
 
 type nsRecord struct {
@@ -44,45 +55,83 @@ type nsRecord struct {
 	Name      string
 	Value     string
 	SortOrder int16
+	TTL       int32
 }
 
 type spfRecord struct {
 	DomainID int16
 	Name     string
 	Value    string
+	TTL      int32
 }
 
 type srvRecord struct {
+	DomainID int16
+	Service  string
+	Protocol string
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+	TTL      int32
+}
+
+type txtRecord struct {
 	DomainID int16
 	Name     string
 	Value    string
+	TTL      int32
 }
 
-type txtRecord struct {
+type caaRecord struct {
 	DomainID int16
-	Service  string
-	Protocol string
-	Priority int16
-	Weight   int16
-	Port     int16
-	Target   string
+	Name     string
+	Flags    int16
+	Tag      string
+	Value    string
+	TTL      int32
+}
+
+type ptrRecord struct {
+	IPAddress string
+	Name      string
+	TTL       int32
 }
 
 type domainResult struct {
-	ID    int16
-	Name  string
-	A     string
-	CNAME string
-	DKIM  string
-	DMARC string
-	MX    string
-	NS    string
-	SPF   string
-	SRV   string
-	TXT   string
-}
-
-const domainQuery string = `select d.id, d.name, 
+	ID           int16
+	Name         string
+	TTL          int32
+	Refresh      int32
+	Retry        int32
+	Expire       int32
+	NegativeTTL  int32
+	Hostmaster   string
+	TemplateID   int16
+	PublishCDS   bool
+	DNSSECDelete bool
+	DenialType   string
+	Iterations   int16
+	Salt         string
+	OptOut       bool
+	A            string
+	CNAME        string
+	DKIM         string
+	DMARC        string
+	MX           string
+	NS           string
+	SPF          string
+	SRV          string
+	TXT          string
+	CAA          string
+}
+
+const domainQuery string = `select d.id, d.name, coalesce(d.ttl, 0) as ttl, 
+coalesce(d.refresh, 0) as refresh, coalesce(d.retry, 0) as retry, coalesce(d.expire, 0) as expire, 
+coalesce(d.negativettl, 0) as negativettl, coalesce(d.hostmaster, '') as hostmaster, 
+coalesce(d.templateid, 0) as templateid, coalesce(d.publishcds, false) as publishcds, 
+coalesce(d.dnssecdelete, false) as dnssecdelete, coalesce(d.denialtype, '') as denialtype, 
+coalesce(d.nsec3iterations, 0) as iterations, coalesce(d.nsec3salt, '') as salt, coalesce(d.nsec3optout, false) as optout, 
 array_to_json(array_agg(distinct a)) as a, 
 array_to_json(array_agg(distinct c)) as cname, 
 array_to_json(array_agg(distinct dk)) as dkim, 
@@ -91,7 +140,8 @@ array_to_json(array_agg(distinct m)) as mx,
 array_to_json(array_agg(distinct n)) as ns, 
 array_to_json(array_agg(distinct spf)) as spf, 
 array_to_json(array_agg(distinct srv)) as srv, 
-array_to_json(array_agg(distinct t)) as txt
+array_to_json(array_agg(distinct t)) as txt, 
+array_to_json(array_agg(distinct caa)) as caa
 from domains d
 left outer join arecords a on a.domainid = d.id
 left outer join cnamerecords c on c.domainid = d.id
@@ -102,16 +152,33 @@ left outer join nsrecords n on n.domainid = d.id
 left outer join spfrecords spf on spf.domainid = d.id
 left outer join srvrecords srv on srv.domainid = d.id
 left outer join txtrecords t on t.domainid = d.id
-group by d.id, d.name
+left outer join caarecords caa on caa.domainid = d.id
+group by d.id, d.name, d.ttl, d.refresh, d.retry, d.expire, d.negativettl, d.hostmaster, d.templateid, d.publishcds, d.dnssecdelete, 
+d.denialtype, d.nsec3iterations, d.nsec3salt, d.nsec3optout
 `
 
+const templateQuery string = `select id, name, coalesce(nameservers, '') as nameservers, 
+coalesce(mailservers, '') as mailservers, coalesce(spf, '') as spf, coalesce(dmarcpolicy, '') as dmarcpolicy, 
+coalesce(dmarcreportaddress, '') as dmarcreportaddress, coalesce(caaissuers, '') as caaissuers, coalesce(tlsaports, '') as tlsaports 
+from templates`
+
+const ptrQuery string = `select ipaddress, name, coalesce(ttl, 0) as ttl from ptrrecords`
+
+// changeChannel is notified by the triggers in schema.sql with the ID of the domain that changed or 0 if any domain could be affected
+const changeChannel string = "dnszonewriter"
+
 type dnsBackend interface {
 	CreateSchema() error
 	GetDomains() ([]domain, error)
+	GetPTRRecords() ([]ptrRecord, error)
+	GetTemplates() ([]zoneTemplate, error)
+	Import(data *backupData) error
+	Close() error
 }
 
 type db struct {
-	Db onedb.DBer
+	Db    onedb.DBer
+	begin func() (dbTx, error) // starts a transaction on a connection of its own
 }
 
 func newDb(host string, dbPort string, user string, password string, database string) (*db, error) {
@@ -125,31 +192,85 @@ func newDb(host string, dbPort string, user string, password string, database st
 		return nil, err
 	}
 
-	return &db{conn}, nil
+	config := pgx.ConnConfig{Host: host, Port: uint16(port), User: user, Password: password, Database: database}
+	return &db{Db: conn, begin: func() (dbTx, error) { return beginTx(config) }}, nil
 }
 
-type exists struct {
-	Found string
+func (d *db) Close() error {
+	return d.Db.Close()
 }
 
+// schemaSQL creates the database. schemaUpgradeSQL holds the numbered versions that bring an existing
+// database up to date. Both are built in so the schema doesn't depend on the working directory
+//
+//go:embed schema.sql
+var schemaSQL string
+
+//go:embed schemaUpgrade.sql
+var schemaUpgradeSQL string
+
+var schemaVersionMarker = regexp.MustCompile(`(?m)^-- Version (\d+)\s*$`)
+
+const schemaStateQuery string = `select coalesce(max(case when table_name = 'domains' then '1' end), '') as Found, 
+coalesce(max(case when table_name = 'schemaversion' then '1' end), '') as Versioned 
+from information_schema.tables where table_schema = 'public'`
+
+type schemaState struct {
+	Found     string // the domains table exists
+	Versioned string // the SchemaVersion table exists
+}
+
+type schemaVersion struct {
+	Version int16
+}
+
+// CreateSchema creates the database on first run and applies the upgrades that are newer than the
+// version recorded in SchemaVersion. A database created before versions were recorded is at version 0
 func (d *db) CreateSchema() error {
-	item := exists{}
-	err := d.Db.QueryStructRow(onedb.NewSqlQuery("Select '1' as Found from information_schema.tables where table_schema = 'public' and table_name = 'domains'"), &item)
-	if err != nil && err.Error() != "no rows in result set" {
+	state := schemaState{}
+	if err := d.Db.QueryStructRow(onedb.NewSqlQuery(schemaStateQuery), &state); err != nil {
 		return err
 	}
-
-	// schema already exists... exit
-	if item.Found == "1" {
-		return nil
+	if state.Found != "1" {
+		return d.Db.Execute(onedb.NewSqlQuery(schemaSQL))
 	}
 
-	schema, err := ioutil.ReadFile("schema.sql")
+	current := schemaVersion{}
+	if state.Versioned == "1" {
+		err := d.Db.QueryStructRow(onedb.NewSqlQuery("select coalesce(max(Version), 0) as Version from SchemaVersion"), &current)
+		if err != nil {
+			return err
+		}
+	}
+	upgrades, err := schemaUpgrades(schemaUpgradeSQL)
 	if err != nil {
 		return err
 	}
-	err = d.Db.Execute(onedb.NewSqlQuery(string(schema)))
-	return err
+	for version := int(current.Version) + 1; version <= len(upgrades); version++ {
+		// the version is recorded in the same statement batch so Postgres applies both or neither
+		sql := upgrades[version-1] + fmt.Sprintf("\nDELETE FROM SchemaVersion;\nINSERT INTO SchemaVersion (Version) VALUES (%d);\n", version)
+		if err := d.Db.Execute(onedb.NewSqlQuery(sql)); err != nil {
+			return fmt.Errorf("Unable to upgrade database to version %d %s", version, err.Error())
+		}
+	}
+	return nil
+}
+
+// schemaUpgrades splits the upgrade script into its versions. Element i holds version i+1
+func schemaUpgrades(script string) ([]string, error) {
+	markers := schemaVersionMarker.FindAllStringSubmatchIndex(script, -1)
+	upgrades := make([]string, len(markers))
+	for i, marker := range markers {
+		if version, _ := strconv.Atoi(script[marker[2]:marker[3]]); version != i+1 {
+			return nil, fmt.Errorf("Schema upgrade version %d is out of order. Expected version %d", version, i+1)
+		}
+		end := len(script)
+		if i+1 < len(markers) {
+			end = markers[i+1][0]
+		}
+		upgrades[i] = script[marker[1]:end]
+	}
+	return upgrades, nil
 }
 
 func (d *db) GetDomains() ([]domain, error) {
@@ -169,7 +290,12 @@ func (d *db) GetDomains() ([]domain, error) {
 
 	domains := make([]domain, len(res))
 	for i := range res {
-		domain := domain{ID: res[i].ID, Name: res[i].Name}
+		domain := domain{ID: res[i].ID, Name: res[i].Name, DefaultTTL: time.Duration(res[i].TTL) * time.Second,
+			SOA: soaSettings{Refresh: time.Duration(res[i].Refresh) * time.Second, Retry: time.Duration(res[i].Retry) * time.Second,
+				Expire: time.Duration(res[i].Expire) * time.Second, NegativeTTL: time.Duration(res[i].NegativeTTL) * time.Second,
+				Hostmaster: res[i].Hostmaster},
+			TemplateID: res[i].TemplateID, PublishCDS: res[i].PublishCDS, DNSSECDelete: res[i].DNSSECDelete,
+			Denial: denialSettings{Type: res[i].DenialType, Iterations: res[i].Iterations, Salt: res[i].Salt, OptOut: res[i].OptOut}}
 		if err := unmarshal(res[i].A, &domain.ARecords); err != nil {
 			return nil, err
 		}
@@ -197,7 +323,127 @@ func (d *db) GetDomains() ([]domain, error) {
 		if err := unmarshal(res[i].TXT, &domain.TXTRecords); err != nil {
 			return nil, err
 		}
+		if err := unmarshal(res[i].CAA, &domain.CAARecords); err != nil {
+			return nil, err
+		}
 		domains[i] = domain
 	}
 	return domains, nil
 }
+
+func (d *db) GetPTRRecords() ([]ptrRecord, error) {
+	res := []ptrRecord{}
+	err := d.Db.QueryStruct(onedb.NewSqlQuery(ptrQuery), &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (d *db) GetTemplates() ([]zoneTemplate, error) {
+	res := []zoneTemplate{}
+	err := d.Db.QueryStruct(onedb.NewSqlQuery(templateQuery), &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// changeListener waits for the triggers to report a change
+type changeListener interface {
+	WaitForChange(ctx context.Context) (int16, error)
+	Close() error
+}
+
+// pgListener holds its own connection since a listening connection can't be shared with queries
+type pgListener struct {
+	conn *pgx.Conn
+}
+
+func newListener(host string, dbPort string, user string, password string, database string) (*pgListener, error) {
+	port, err := strconv.Atoi(dbPort)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := pgx.Connect(pgx.ConnConfig{Host: host, Port: uint16(port), User: user, Password: password, Database: database})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Listen(changeChannel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &pgListener{conn}, nil
+}
+
+// WaitForChange returns the ID of the next domain that changed. A notification that doesn't hold a domain ID is
+// treated as a change to any domain
+func (l *pgListener) WaitForChange(ctx context.Context) (int16, error) {
+	notification, err := l.conn.WaitForNotification(ctx)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseInt(notification.Payload, 10, 16)
+	if err != nil {
+		return 0, nil
+	}
+	return int16(id), nil
+}
+
+func (l *pgListener) Close() error {
+	return l.conn.Close()
+}
+
+// dbTx runs statements in a transaction. None of them are kept unless Commit succeeds
+type dbTx interface {
+	Execute(query string, args ...interface{}) error
+	QueryID(query string, args ...interface{}) (int16, error) // errNoRows if the query returns nothing
+	Commit() error
+	Rollback() error
+}
+
+var errNoRows = errors.New("no rows in result set")
+
+// pgTx holds its own connection since onedb doesn't keep a transaction on one connection of its pool
+type pgTx struct {
+	conn *pgx.Conn
+	tx   *pgx.Tx
+}
+
+func beginTx(config pgx.ConnConfig) (*pgTx, error) {
+	conn, err := pgx.Connect(config)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &pgTx{conn, tx}, nil
+}
+
+func (t *pgTx) Execute(query string, args ...interface{}) error {
+	_, err := t.tx.Exec(query, args...)
+	return err
+}
+
+func (t *pgTx) QueryID(query string, args ...interface{}) (int16, error) {
+	var id int16
+	err := t.tx.QueryRow(query, args...).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return 0, errNoRows
+	}
+	return id, err
+}
+
+func (t *pgTx) Commit() error {
+	defer t.conn.Close()
+	return t.tx.Commit()
+}
+
+func (t *pgTx) Rollback() error {
+	defer t.conn.Close()
+	return t.tx.Rollback()
+}
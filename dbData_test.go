@@ -2,7 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/robarchibald/onedb"
 )
@@ -25,15 +29,37 @@ func TestCreateSchema(t *testing.T) {
 		t.Error("expected error due to row query error")
 	}
 
-	// schema exists
-	d = db{Db: onedb.NewMock(nil, nil, exists{"1"})}
+	// schema is up to date so nothing is executed
+	upgrades, _ := schemaUpgrades(schemaUpgradeSQL)
+	d = db{Db: onedb.NewMock(nil, errors.New("fail"), schemaState{"1", "1"}, schemaVersion{int16(len(upgrades))})}
 	err = d.CreateSchema()
 	if err != nil {
-		t.Error("expected success since schema already exists")
+		t.Error("expected success since schema is up to date", err)
+	}
+
+	// error reading version
+	d = db{Db: onedb.NewMock(nil, nil, schemaState{"1", "1"})}
+	err = d.CreateSchema()
+	if err == nil {
+		t.Error("expected error due to version query error")
+	}
+
+	// failed upgrade of existing schema
+	d = db{Db: onedb.NewMock(nil, errors.New("fail"), schemaState{"1", "1"}, schemaVersion{0})}
+	err = d.CreateSchema()
+	if err == nil {
+		t.Error("expected error due to failed upgrade")
+	}
+
+	// upgrade of schema without a version
+	d = db{Db: onedb.NewMock(nil, nil, schemaState{"1", ""})}
+	err = d.CreateSchema()
+	if err != nil {
+		t.Error("expected success upgrading schema", err)
 	}
 
 	// failed execute
-	reader := onedb.NewMock(nil, errors.New("fail"), exists{})
+	reader := onedb.NewMock(nil, errors.New("fail"), schemaState{})
 	d = db{Db: reader}
 	err = d.CreateSchema()
 	if err == nil {
@@ -41,20 +67,70 @@ func TestCreateSchema(t *testing.T) {
 	}
 
 	// successful create
-	d = db{Db: onedb.NewMock(nil, nil, exists{})}
+	d = db{Db: onedb.NewMock(nil, nil, schemaState{})}
 	err = d.CreateSchema()
 	if err != nil {
 		t.Error("expected success creating schema", err)
 	}
 }
 
+func TestSchemaUpgrades(t *testing.T) {
+	upgrades, err := schemaUpgrades(schemaUpgradeSQL)
+	if err != nil || len(upgrades) == 0 || !strings.Contains(upgrades[0], "CREATE TABLE IF NOT EXISTS SchemaVersion") {
+		t.Fatal("expected upgrades", err, upgrades)
+	}
+	if !strings.Contains(schemaSQL, fmt.Sprintf("INSERT INTO SchemaVersion (Version) VALUES (%d);", len(upgrades))) {
+		t.Error("expected schema.sql to be at the latest upgrade version", len(upgrades))
+	}
+
+	upgrades, err = schemaUpgrades("-- Version 1\nselect 1;\n-- Version 2\nselect 2;\n")
+	if err != nil || len(upgrades) != 2 || upgrades[0] != "\nselect 1;\n" || upgrades[1] != "\nselect 2;\n" {
+		t.Error("expected two versions", err, upgrades)
+	}
+	if _, err := schemaUpgrades("-- Version 1\nselect 1;\n-- Version 3\nselect 3;\n"); err == nil {
+		t.Error("expected error due to missing version")
+	}
+}
+
+func TestSchemaNotifyTriggers(t *testing.T) {
+	tables := regexp.MustCompile(`CREATE TABLE (\w+)`).FindAllStringSubmatch(schemaSQL, -1)
+	if len(tables) == 0 {
+		t.Fatal("expected tables in schema")
+	}
+	for _, table := range tables {
+		if table[1] == "SchemaVersion" {
+			continue
+		}
+		if !strings.Contains(schemaSQL, "CREATE TRIGGER "+table[1]+"_Notify ") ||
+			!strings.Contains(schemaUpgradeSQL, "'"+strings.ToLower(table[1])+"'") {
+			t.Error("expected notify trigger on", table[1])
+		}
+	}
+}
+
+func TestNewListener(t *testing.T) {
+	if _, err := newListener("localhost", "bogus", "test", "test", "test"); err == nil {
+		t.Error("expected invalid port error")
+	}
+	if testing.Short() {
+		t.SkipNow()
+	}
+	if _, err := newListener("localhost", "1111", "test", "test", "test"); err == nil {
+		t.Error("expected connection error")
+	}
+}
+
 func TestGetDomains(t *testing.T) {
 	domainRecords := []domainResult{
-		domainResult{Name: "domain", ID: 1,
-			A:     `[{"domainid":1,"name":"arecord","ipaddress":"","dynamicfqdn":""}]`,
+		domainResult{Name: "domain", ID: 1, TTL: 3600, Expire: 2419200, Hostmaster: "dns@domain", TemplateID: 2, PublishCDS: true,
+			DenialType: "NSEC3", Iterations: 5, Salt: "AB", OptOut: true,
+			A:     `[{"domainid":1,"name":"arecord","ipaddress":"","dynamicfqdn":"","ttl":300}]`,
 			MX:    `[{"domainid":1,"name":"mxrecord","value":"","priority":0}]`,
 			NS:    `[{"domainid":1,"name":"nsrecord","value":"","sortorder":0}]`,
 			CNAME: `[{"domainid":1,"name":"cname1","canonicalname":""}]`,
+			SRV:   `[{"domainid":1,"service":"xmpp-client","protocol":"tcp","priority":5,"weight":0,"port":50000,"target":"xmpp"}]`,
+			TXT:   `[{"domainid":1,"name":"","value":"google-site-verification=abc123"}]`,
+			CAA:   `[{"domainid":1,"name":"","flags":0,"tag":"issue","value":"letsencrypt.org"}]`,
 		},
 		domainResult{Name: "domain2", ID: 1,
 			A:     `[{"domainid":2,"name":"arecord2","ipaddress":"","dynamicfqdn":""}]`,
@@ -73,11 +149,17 @@ func TestGetDomains(t *testing.T) {
 	d = db{Db: onedb.NewMock(nil, nil, domainRecords)}
 	domains, err := d.GetDomains()
 	if len(domains) != 2 || domains[0].Name != "domain" || domains[1].Name != "domain2" ||
+		domains[0].DefaultTTL != time.Hour || domains[1].DefaultTTL != 0 ||
+		domains[0].SOA.Expire != 28*24*time.Hour || domains[0].SOA.Hostmaster != "dns@domain" || domains[0].SOA.Refresh != 0 || domains[0].TemplateID != 2 || domains[1].TemplateID != 0 || !domains[0].PublishCDS || domains[1].PublishCDS || domains[0].ARecords[0].TTL != 300 || domains[1].ARecords[0].TTL != 0 ||
 		len(domains[1].ARecords) != 1 || len(domains[0].ARecords) != 1 || domains[0].ARecords[0].Name != "arecord" || domains[1].ARecords[0].Name != "arecord2" ||
 		len(domains[1].MxRecords) != 1 || len(domains[0].MxRecords) != 1 || domains[0].MxRecords[0].Name != "mxrecord" || domains[1].MxRecords[0].Name != "mxrecord2" ||
 		len(domains[1].NsRecords) != 1 || len(domains[0].NsRecords) != 1 || domains[0].NsRecords[0].Name != "nsrecord" || domains[1].NsRecords[0].Name != "nsrecord2" ||
-		len(domains[1].CNameRecords) != 1 || len(domains[0].CNameRecords) != 1 || domains[0].CNameRecords[0].Name != "cname1" || domains[1].CNameRecords[0].Name != "cname2" {
-		t.Error("expected 2 domains with correct A, MX, NS and CName records", domains)
+		len(domains[1].CNameRecords) != 1 || len(domains[0].CNameRecords) != 1 || domains[0].CNameRecords[0].Name != "cname1" || domains[1].CNameRecords[0].Name != "cname2" ||
+		len(domains[0].SRVRecords) != 1 || len(domains[1].SRVRecords) != 0 || domains[0].SRVRecords[0].Service != "xmpp-client" || domains[0].SRVRecords[0].Port != 50000 ||
+		len(domains[0].TXTRecords) != 1 || domains[0].TXTRecords[0].Value != "google-site-verification=abc123" ||
+		len(domains[0].CAARecords) != 1 || domains[0].CAARecords[0].Tag != "issue" || len(domains[1].CAARecords) != 0 ||
+		domains[0].Denial != (denialSettings{Type: "NSEC3", Iterations: 5, Salt: "AB", OptOut: true}) || domains[1].Denial != (denialSettings{}) {
+		t.Error("expected 2 domains with correct A, MX, NS, CName, SRV, TXT and CAA records", domains)
 	}
 
 	_, err = d.GetDomains()
@@ -85,3 +167,31 @@ func TestGetDomains(t *testing.T) {
 		t.Error("expected error since there is no data left in the reader")
 	}
 }
+
+func TestGetPTRRecords(t *testing.T) {
+	d := db{Db: onedb.NewMock(nil, nil)}
+	_, err := d.GetPTRRecords()
+	if err == nil {
+		t.Error("expected error since there's no PTR records in the Mock reader")
+	}
+
+	d = db{Db: onedb.NewMock(nil, nil, []ptrRecord{ptrRecord{IPAddress: "10.1.0.6", Name: "mail.example.com."}})}
+	ptrs, err := d.GetPTRRecords()
+	if err != nil || len(ptrs) != 1 || ptrs[0].IPAddress != "10.1.0.6" || ptrs[0].Name != "mail.example.com." {
+		t.Error("expected PTR records", err, ptrs)
+	}
+}
+
+func TestGetTemplates(t *testing.T) {
+	d := db{Db: onedb.NewMock(nil, nil)}
+	_, err := d.GetTemplates()
+	if err == nil {
+		t.Error("expected error since there's no templates in the Mock reader")
+	}
+
+	d = db{Db: onedb.NewMock(nil, nil, []zoneTemplate{zoneTemplate{ID: 1, Name: "customer", NameServers: "ns1.example.net."}})}
+	templates, err := d.GetTemplates()
+	if err != nil || len(templates) != 1 || templates[0].Name != "customer" || templates[0].NameServers != "ns1.example.net." {
+		t.Error("expected templates", err, templates)
+	}
+}
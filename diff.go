@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// diffZones returns a record level unified diff between the current and proposed zone files. Records are grouped
+// by owner name and type so a changed record shows as a removal and an addition in the same group. Falls back to
+// a line diff if either zone can't be parsed. Returns an empty string if the zones hold the same records
+func diffZones(current string, proposed string, origin string) string {
+	filename := origin + ".txt"
+	oldRecords, err := parseZone(current, dns.Fqdn(origin), filename)
+	if err != nil {
+		return diffText(current, proposed, filename)
+	}
+	newRecords, err := parseZone(proposed, dns.Fqdn(origin), filename)
+	if err != nil {
+		return diffText(current, proposed, filename)
+	}
+
+	type group struct {
+		Name string
+		Type uint16
+	}
+	oldGroups := make(map[group][]string)
+	newGroups := make(map[group][]string)
+	groups := []group{}
+	add := func(groupMap map[group][]string, rr dns.RR) {
+		g := group{Name: dns.CanonicalName(rr.Header().Name), Type: rr.Header().Rrtype}
+		if _, ok := oldGroups[g]; !ok {
+			if _, ok := newGroups[g]; !ok {
+				groups = append(groups, g)
+			}
+		}
+		groupMap[g] = append(groupMap[g], rr.String())
+	}
+	for _, rr := range oldRecords {
+		add(oldGroups, rr)
+	}
+	for _, rr := range newRecords {
+		add(newGroups, rr)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if c := compareCanonical(groups[i].Name, groups[j].Name); c != 0 {
+			return c < 0
+		}
+		return groups[i].Type < groups[j].Type
+	})
+
+	var buffer bytes.Buffer
+	for _, g := range groups {
+		removed := missingFrom(oldGroups[g], newGroups[g])
+		added := missingFrom(newGroups[g], oldGroups[g])
+		if len(removed) == 0 && len(added) == 0 {
+			continue
+		}
+		buffer.WriteString("@@ " + g.Name + " " + dns.TypeToString[g.Type] + " @@\n")
+		for _, rr := range removed {
+			buffer.WriteString("-" + rr + "\n")
+		}
+		for _, rr := range added {
+			buffer.WriteString("+" + rr + "\n")
+		}
+	}
+	if buffer.Len() == 0 {
+		return ""
+	}
+	return diffHeader(filename) + buffer.String()
+}
+
+// missingFrom returns the records in a that aren't in b
+func missingFrom(a []string, b []string) []string {
+	found := make(map[string]bool)
+	for _, value := range b {
+		found[value] = true
+	}
+	missing := []string{}
+	for _, value := range a {
+		if !found[value] {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
+
+// diffText returns a line diff between two versions of a file or an empty string if they're the same
+func diffText(current string, proposed string, filename string) string {
+	if current == proposed {
+		return ""
+	}
+	a := strings.Split(current, "\n")
+	b := strings.Split(proposed, "\n")
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a = a[prefix : len(a)-suffix]
+	b = b[prefix : len(b)-suffix]
+
+	// longest common subsequence of the lines that differ
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(diffHeader(filename))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			buffer.WriteString(" " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			buffer.WriteString("-" + a[i] + "\n")
+			i++
+		default:
+			buffer.WriteString("+" + b[j] + "\n")
+			j++
+		}
+	}
+	return buffer.String()
+}
+
+func diffHeader(filename string) string {
+	return "--- a/" + filename + "\n+++ b/" + filename + "\n"
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffZones(t *testing.T) {
+	current := "$ORIGIN example.com.\n@ 1800 IN A 10.1.0.6\nwww 1800 IN CNAME @\nmail 1800 IN A 10.1.0.8\n"
+	proposed := "$ORIGIN example.com.\n@ 1800 IN A 10.1.0.7\nwww 1800 IN CNAME @\nftp 1800 IN A 10.1.0.9\n"
+	expected := "--- a/example.com.txt\n+++ b/example.com.txt\n" +
+		"@@ example.com. A @@\n-example.com.\t1800\tIN\tA\t10.1.0.6\n+example.com.\t1800\tIN\tA\t10.1.0.7\n" +
+		"@@ ftp.example.com. A @@\n+ftp.example.com.\t1800\tIN\tA\t10.1.0.9\n" +
+		"@@ mail.example.com. A @@\n-mail.example.com.\t1800\tIN\tA\t10.1.0.8\n"
+	if actual := diffZones(current, proposed, "example.com"); actual != expected {
+		t.Error("expected record level diff", actual)
+	}
+	if actual := diffZones(current, current+"; comment\n", "example.com"); actual != "" {
+		t.Error("expected no diff for same records", actual)
+	}
+
+	// unparseable zone falls back to a line diff
+	actual := diffZones("bogus\n", proposed, "example.com")
+	if !strings.HasPrefix(actual, "--- a/example.com.txt\n+++ b/example.com.txt\n-bogus\n") {
+		t.Error("expected line diff", actual)
+	}
+}
+
+func TestDiffText(t *testing.T) {
+	if diffText("a\nb\n", "a\nb\n", "zones.conf") != "" {
+		t.Error("expected no diff")
+	}
+	actual := diffText("a\nb\nc\nd\ne\n", "a\nc\nx\nd\ne\n", "zones.conf")
+	if actual != "--- a/zones.conf\n+++ b/zones.conf\n-b\n c\n+x\n" {
+		t.Error("expected only changed lines and the lines between them", actual)
+	}
+}
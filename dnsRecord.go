@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,10 +21,22 @@ func newARecord(name string, ipAddress string) *dnsRecord {
 	//z.AddSshfpRecords(name)
 }
 
+func newAAAARecord(name string, ipAddress string) *dnsRecord {
+	return newDNSRecord(name, "AAAA", ipAddress)
+}
+
 func newDNSRecord(name string, recordType string, data string) *dnsRecord {
 	return &dnsRecord{name, "", "IN", recordType, data}
 }
 
+// withTTL overrides the zone's default TTL for the record when ttl is set
+func (r *dnsRecord) withTTL(ttl int32) *dnsRecord {
+	if ttl > 0 {
+		r.TTL = strconv.Itoa(int(ttl))
+	}
+	return r
+}
+
 func newMxRecord(domain string, name string, value string, priority int16) *dnsRecord {
 	if name == "" {
 		name = domain + "."
@@ -35,12 +49,38 @@ func newMxRecord(domain string, name string, value string, priority int16) *dnsR
 	return newDNSRecord(name, "MX", fmt.Sprintf("%d %s.%s.", priority, value, domain))
 }
 
+func newSrvRecord(domain string, service string, protocol string, priority uint16, weight uint16, port uint16, target string) *dnsRecord {
+	name := fmt.Sprintf("_%s._%s.%s.", strings.TrimPrefix(service, "_"), strings.TrimPrefix(protocol, "_"), domain)
+	if strings.HasSuffix(target, ".") {
+		return newDNSRecord(name, "SRV", fmt.Sprintf("%d %d %d %s", priority, weight, port, target))
+	}
+	return newDNSRecord(name, "SRV", fmt.Sprintf("%d %d %d %s.%s.", priority, weight, port, target, domain))
+}
+
 func newSoaRecord(domain string, primaryNameServer string, hostmaster string, refresh time.Duration, retry time.Duration, expire time.Duration, negativeTTL time.Duration) *dnsRecord {
+	// could be pointing to another domain, so don't add domain
+	if !strings.HasSuffix(primaryNameServer, ".") {
+		primaryNameServer = primaryNameServer + "." + domain + "."
+	}
 	return newDNSRecord(domain+".", "SOA",
-		fmt.Sprintf("%s.%s. %s.%s. (SERIALNUMBER %d %d %d %d)", primaryNameServer, domain, hostmaster, domain,
+		fmt.Sprintf("%s %s (SERIALNUMBER %d %d %d %d)", primaryNameServer, hostmasterName(domain, hostmaster),
 			int(refresh.Seconds()), int(retry.Seconds()), int(expire.Seconds()), int(negativeTTL.Seconds())))
 }
 
+// hostmasterName converts the hostmaster mailbox to the domain name used in the SOA RNAME field.
+// hostmaster can be an email address (john.doe@example.com), a mailbox on the zone's own domain (hostmaster)
+// or a name that is already in SOA format (hostmaster.example.com.). Dots in the mailbox are escaped
+func hostmasterName(domain string, hostmaster string) string {
+	if strings.HasSuffix(hostmaster, ".") {
+		return hostmaster
+	}
+	mailbox, host := hostmaster, domain
+	if at := strings.LastIndex(hostmaster, "@"); at != -1 {
+		mailbox, host = hostmaster[:at], hostmaster[at+1:]
+	}
+	return strings.Replace(mailbox, ".", "\\.", -1) + "." + strings.TrimSuffix(host, ".") + "."
+}
+
 func newDkimRecord(name string, dkimValue string) *dnsRecord {
 	recordName := name + "._domainkey"
 	if name == "" {
@@ -93,12 +133,78 @@ func newSpfRecord(domain, name string, allow string) *dnsRecord {
 	return newDNSRecord(name, "TXT", fmt.Sprintf("\"v=spf1 %s -all\"", allow))
 }
 
-func newDmarcRecord(name string, policy string) *dnsRecord {
+func newTxtRecord(domain, name, value string) *dnsRecord {
+	if name == "" {
+		name = domain + "."
+	} else if !strings.HasSuffix(name, ".") {
+		name = name + "." + domain + "."
+	}
+	return newDNSRecord(name, "TXT", txtCharacterStrings(value))
+}
+
+// txtCharacterStrings splits value into RFC 1035 character-strings of at most 255 bytes,
+// quoting each one and escaping quotes, backslashes and non-printable bytes
+func txtCharacterStrings(value string) string {
+	const maxLength = 255
+	strs := []string{}
+	for len(value) > maxLength {
+		strs = append(strs, quoteCharacterString(value[:maxLength]))
+		value = value[maxLength:]
+	}
+	strs = append(strs, quoteCharacterString(value))
+	return strings.Join(strs, " ")
+}
+
+func quoteCharacterString(value string) string {
+	var buffer bytes.Buffer
+	buffer.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == '\\':
+			buffer.WriteByte('\\')
+			buffer.WriteByte(c)
+		case c < ' ' || c > '~':
+			buffer.WriteString(fmt.Sprintf("\\%03d", c))
+		default:
+			buffer.WriteByte(c)
+		}
+	}
+	buffer.WriteByte('"')
+	return buffer.String()
+}
+
+func newCaaRecord(domain, name string, flags int16, tag, value string) *dnsRecord {
+	if name == "" {
+		name = domain + "."
+	} else if !strings.HasSuffix(name, ".") {
+		name = name + "." + domain + "."
+	}
+	return newDNSRecord(name, "CAA", fmt.Sprintf("%d %s %s", flags, tag, quoteCharacterString(value)))
+}
+
+func newDmarcRecord(name string, policy string, reportAddress string) *dnsRecord {
 	recordName := "_dmarc"
 	if name != "" {
 		recordName += "." + name
 	}
-	return newDNSRecord(recordName, "TXT", "\"v=DMARC1; p="+policy+"; rua=mailto:dmarc-report@endfirst.com\"")
+	value := "v=DMARC1; p=" + policy
+	if reportAddress != "" {
+		value += "; rua=mailto:" + reportAddress
+	}
+	return newDNSRecord(recordName, "TXT", "\""+value+"\"")
+}
+
+func newPtrRecord(name, target string) *dnsRecord {
+	return newDNSRecord(name, "PTR", target)
+}
+
+func newCdsRecord(domain string, keyTag uint16, algorithm uint8, digestType uint8, digest string) *dnsRecord {
+	return newDNSRecord(domain+".", "CDS", fmt.Sprintf("%d %d %d %s", keyTag, algorithm, digestType, digest))
+}
+
+func newCdnskeyRecord(domain string, flags uint16, protocol uint8, algorithm uint8, publicKey string) *dnsRecord {
+	return newDNSRecord(domain+".", "CDNSKEY", fmt.Sprintf("%d %d %d %s", flags, protocol, algorithm, publicKey))
 }
 
 func newCNameRecord(name, canonicalName string) *dnsRecord {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,6 +20,25 @@ func TestNewARecord(t *testing.T) {
 	}
 }
 
+func TestNewAAAARecord(t *testing.T) {
+	actual := newAAAARecord("mail", "2001:db8::1")
+	if actual.Name != "mail" || actual.RecordType != "AAAA" || actual.Data != "2001:db8::1" {
+		t.Fatal("expected AAAA record", actual)
+	}
+}
+
+func TestWithTTL(t *testing.T) {
+	actual := newARecord("mail", "123.45.67.89").withTTL(300)
+	if actual.TTL != "300" || actual.toString() != "mail\t300\tIN\tA\t123.45.67.89\n" {
+		t.Fatal("expected record TTL", actual)
+	}
+
+	actual = newARecord("mail", "123.45.67.89").withTTL(0)
+	if actual.TTL != "" {
+		t.Fatal("expected default TTL", actual)
+	}
+}
+
 func TestNewMxRecord(t *testing.T) {
 	actual := newMxRecord("domain", "", "mail", 1)
 	if actual.Name != "domain." || actual.RecordType != "MX" || actual.Data != "1 mail.domain." {
@@ -33,11 +53,49 @@ func TestNewMxRecordAbsolute(t *testing.T) {
 	}
 }
 
+func TestNewSrvRecord(t *testing.T) {
+	actual := newSrvRecord("domain.com", "xmpp-client", "tcp", 5, 0, 5222, "xmpp")
+	if actual.Name != "_xmpp-client._tcp.domain.com." || actual.RecordType != "SRV" || actual.Data != "5 0 5222 xmpp.domain.com." {
+		t.Fatal("expected SRV record", actual)
+	}
+}
+
+func TestNewSrvRecordAbsolute(t *testing.T) {
+	actual := newSrvRecord("domain.com", "_sip", "_udp", 10, 20, 5060, "sip.example.com.")
+	if actual.Name != "_sip._udp.domain.com." || actual.RecordType != "SRV" || actual.Data != "10 20 5060 sip.example.com." {
+		t.Fatal("expected absolute SRV record", actual)
+	}
+}
+
+func TestNewSrvRecordHighPort(t *testing.T) {
+	actual := newSrvRecord("domain.com", "minecraft", "tcp", 40000, 65535, 50000, "game")
+	if actual.Data != "40000 65535 50000 game.domain.com." {
+		t.Fatal("expected SRV record with values above 32767", actual)
+	}
+}
+
 func TestNewSoaRecord(t *testing.T) {
 	actual := newSoaRecord("domain", "ns1", "hostmaster", time.Second*5, time.Second*10, time.Second*15, time.Second*20)
 	if actual.Name != "domain." || actual.RecordType != "SOA" || actual.Data != "ns1.domain. hostmaster.domain. (SERIALNUMBER 5 10 15 20)" {
 		t.Fatal("expected SOA record", actual)
 	}
+
+	actual = newSoaRecord("domain", "ns1.example.com.", "hostmaster", time.Second*5, time.Second*10, time.Second*15, time.Second*20)
+	if actual.Data != "ns1.example.com. hostmaster.domain. (SERIALNUMBER 5 10 15 20)" {
+		t.Fatal("expected SOA record with absolute name server", actual)
+	}
+}
+
+func TestHostmasterName(t *testing.T) {
+	if name := hostmasterName("domain.com", "hostmaster"); name != "hostmaster.domain.com." {
+		t.Error("expected mailbox on zone domain", name)
+	}
+	if name := hostmasterName("domain.com", "john.doe@example.com"); name != `john\.doe.example.com.` {
+		t.Error("expected escaped mailbox", name)
+	}
+	if name := hostmasterName("domain.com", "hostmaster.example.com."); name != "hostmaster.example.com." {
+		t.Error("expected name to be used as is", name)
+	}
 }
 
 func TestNewDkimRecord(t *testing.T) {
@@ -68,11 +126,78 @@ func TestNewSpfRecord(t *testing.T) {
 	}
 }
 
+func TestNewTxtRecord(t *testing.T) {
+	actual := newTxtRecord("domain", "", "google-site-verification=abc123")
+	if actual.Name != "domain." || actual.RecordType != "TXT" || actual.Data != "\"google-site-verification=abc123\"" {
+		t.Fatal("expected TXT record", actual)
+	}
+
+	actual = newTxtRecord("domain", "name", `say "hi" \ bye`)
+	if actual.Name != "name.domain." || actual.Data != `"say \"hi\" \\ bye"` {
+		t.Fatal("expected escaped TXT record", actual)
+	}
+}
+
+func TestTxtCharacterStrings(t *testing.T) {
+	long := strings.Repeat("a", 255) + strings.Repeat("b", 255) + "c"
+	actual := txtCharacterStrings(long)
+	expected := "\"" + strings.Repeat("a", 255) + "\" \"" + strings.Repeat("b", 255) + "\" \"c\""
+	if actual != expected {
+		t.Fatal("expected value to be split into 255 byte strings", actual)
+	}
+
+	if actual := txtCharacterStrings("tab\there"); actual != `"tab\009here"` {
+		t.Fatal("expected non-printable characters to be escaped", actual)
+	}
+
+	if actual := txtCharacterStrings(""); actual != `""` {
+		t.Fatal("expected empty string", actual)
+	}
+}
+
+func TestNewCaaRecord(t *testing.T) {
+	actual := newCaaRecord("domain", "", 0, "issue", "letsencrypt.org")
+	if actual.Name != "domain." || actual.RecordType != "CAA" || actual.Data != "0 issue \"letsencrypt.org\"" {
+		t.Fatal("expected CAA record", actual)
+	}
+
+	actual = newCaaRecord("domain", "name", 128, "iodef", "mailto:security@domain")
+	if actual.Name != "name.domain." || actual.Data != "128 iodef \"mailto:security@domain\"" {
+		t.Fatal("expected CAA iodef record", actual)
+	}
+}
+
 func TestNewDmarcRecord(t *testing.T) {
-	actual := newDmarcRecord("name", "policy")
-	if actual.Name != "_dmarc.name" || actual.RecordType != "TXT" || actual.Data != "\"v=DMARC1; p=policy; rua=mailto:dmarc-report@endfirst.com\"" {
+	actual := newDmarcRecord("name", "policy", "dmarc-report@example.com")
+	if actual.Name != "_dmarc.name" || actual.RecordType != "TXT" || actual.Data != "\"v=DMARC1; p=policy; rua=mailto:dmarc-report@example.com\"" {
 		t.Fatal("expected DMARC record", actual)
 	}
+
+	actual = newDmarcRecord("", "policy", "")
+	if actual.Name != "_dmarc" || actual.Data != "\"v=DMARC1; p=policy\"" {
+		t.Fatal("expected DMARC record without report address", actual)
+	}
+}
+
+func TestNewPtrRecord(t *testing.T) {
+	actual := newPtrRecord("89.67.45.123.in-addr.arpa.", "mail.domain.")
+	if actual.Name != "89.67.45.123.in-addr.arpa." || actual.RecordType != "PTR" || actual.Data != "mail.domain." {
+		t.Fatal("expected PTR record", actual)
+	}
+}
+
+func TestNewCdsRecord(t *testing.T) {
+	actual := newCdsRecord("domain", 12345, 8, 2, "ABCDEF")
+	if actual.Name != "domain." || actual.RecordType != "CDS" || actual.Data != "12345 8 2 ABCDEF" {
+		t.Fatal("expected CDS record", actual)
+	}
+}
+
+func TestNewCdnskeyRecord(t *testing.T) {
+	actual := newCdnskeyRecord("domain", 257, 3, 8, "AwEAAQ==")
+	if actual.Name != "domain." || actual.RecordType != "CDNSKEY" || actual.Data != "257 3 8 AwEAAQ==" {
+		t.Fatal("expected CDNSKEY record", actual)
+	}
 }
 
 func TestNewCNameRecord(t *testing.T) {
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/robarchibald/command"
 	"github.com/robarchibald/configReader"
 )
@@ -30,23 +37,43 @@ type dnsZoneWriter struct {
 	DNSMasterIP               string
 	DNSSlaveIPs               string
 	IsMaster                  bool
+	DryRun                    bool // print what would change instead of writing anything
+	Force                     bool // rebuild every zone even if its inputs haven't changed
 	DNSSecKeyDir              string
 	SigningAlgorithm          string
+	RSAKSKBits                string
+	RSAZSKBits                string
+	ZSKLifetimeDays           string
+	KSKLifetimeDays           string
+	KeyPropagationDelayHours  string
+	ParentDSResolver          string
+	SignatureValidityDays     string
+	SignatureRefreshDays      string
+	SignatureJitterHours      string
+	DaemonIntervalSeconds     string
+	DaemonDebounceSeconds     string
+	DynamicFQDNCacheSeconds   string
+	ZoneWorkers               string
+	ZoneHistoryCount          string
+	ZoneHistoryDays           string
+	DefaultNameServers        string
+	DefaultMailServers        string
+	DefaultSPF                string
+	DefaultDMARCPolicy        string
+	DMARCReportAddress        string
+	DefaultCAAIssuers         string
+	DefaultTLSAPorts          string
+	ReverseZonePrefixes       string
+	SOARefresh                string
+	SOARetry                  string
+	SOAExpire                 string
+	SOANegativeTTL            string
+	SOAHostmaster             string
+	output                    io.Writer
 }
 
 func main() {
-	w, err := newDNSZoneWriter("dnsZoneWriter.conf", &ipAddressHelper{})
-	if err != nil {
-		log.Fatal(err)
-	}
-	db, err := newDb(w.DbServer, w.DbPort, w.DbUser, w.DbPassword, w.DbDatabase)
-	if err != nil {
-		log.Fatal("Unable to connect to database " + err.Error())
-	}
-	if err := w.UpdateZoneData(db); err != nil {
-		log.Fatal(err)
-	}
-
+	os.Exit(newCLI().run(os.Args[1:]))
 }
 
 func newDNSZoneWriter(configPath string, addresser ipAddresser) (*dnsZoneWriter, error) {
@@ -63,9 +90,171 @@ func newDNSZoneWriter(configPath string, addresser ipAddresser) (*dnsZoneWriter,
 	if _, err := os.Stat(w.ZoneFileDirectory); os.IsNotExist(err) {
 		return nil, err
 	}
+	if _, err := w.GetSOADefaults(); err != nil {
+		return nil, err
+	}
+	if err := w.GetDefaultTemplate().validate(); err != nil {
+		return nil, err
+	}
+	if _, err := w.GetKeyPolicy(); err != nil {
+		return nil, err
+	}
+	if _, err := w.GetSignaturePolicy(); err != nil {
+		return nil, err
+	}
+	if _, err := w.GetDaemonPolicy(); err != nil {
+		return nil, err
+	}
+	if _, err := w.GetZoneWorkers(); err != nil {
+		return nil, err
+	}
+	if _, err := w.GetHistoryPolicy(); err != nil {
+		return nil, err
+	}
 	return w, nil
 }
 
+// GetDefaultTemplate returns the template configured in dnsZoneWriter.conf which is used for domains
+// without a template and for any setting a named template leaves empty
+func (w *dnsZoneWriter) GetDefaultTemplate() *zoneTemplate {
+	return &zoneTemplate{Name: "default", NameServers: w.DefaultNameServers, MailServers: w.DefaultMailServers,
+		SPF: w.DefaultSPF, DMARCPolicy: w.DefaultDMARCPolicy, DMARCReportAddress: w.DMARCReportAddress,
+		CAAIssuers: w.DefaultCAAIssuers, TLSAPorts: w.DefaultTLSAPorts}
+}
+
+// GetSOADefaults returns the SOA settings used for domains that don't override them. Timers
+// are configured in seconds and fall back to the built-in defaults when not set
+func (w *dnsZoneWriter) GetSOADefaults() (soaSettings, error) {
+	soa := getDefaultSOA()
+	if err := parseDuration(w.SOARefresh, "seconds", "SOA refresh", &soa.Refresh); err != nil {
+		return soa, err
+	}
+	if err := parseDuration(w.SOARetry, "seconds", "SOA retry", &soa.Retry); err != nil {
+		return soa, err
+	}
+	if err := parseDuration(w.SOAExpire, "seconds", "SOA expire", &soa.Expire); err != nil {
+		return soa, err
+	}
+	if err := parseDuration(w.SOANegativeTTL, "seconds", "SOA negative TTL", &soa.NegativeTTL); err != nil {
+		return soa, err
+	}
+	if w.SOAHostmaster != "" {
+		soa.Hostmaster = w.SOAHostmaster
+	}
+	return soa, soa.validate()
+}
+
+// GetKeyPolicy returns the DNSSEC key rollover settings, falling back to the built-in defaults when not set
+func (w *dnsZoneWriter) GetKeyPolicy() (keyPolicy, error) {
+	policy := keyPolicy{Algorithm: w.SigningAlgorithm, RSAKSKBits: rsaKSKBits, RSAZSKBits: rsaZSKBits,
+		ZSKLifetime: zskLifetime, PropagationDelay: keyPropagationDelay}
+	if err := parseNumber(w.RSAKSKBits, "bits", "RSA KSK size", &policy.RSAKSKBits); err != nil {
+		return policy, err
+	}
+	if err := parseNumber(w.RSAZSKBits, "bits", "RSA ZSK size", &policy.RSAZSKBits); err != nil {
+		return policy, err
+	}
+	if err := parseDuration(w.ZSKLifetimeDays, "days", "ZSK lifetime", &policy.ZSKLifetime); err != nil {
+		return policy, err
+	}
+	if err := parseDuration(w.KSKLifetimeDays, "days", "KSK lifetime", &policy.KSKLifetime); err != nil {
+		return policy, err
+	}
+	if err := parseDuration(w.KeyPropagationDelayHours, "hours", "key propagation delay", &policy.PropagationDelay); err != nil {
+		return policy, err
+	}
+	return policy, policy.validate()
+}
+
+// GetSignaturePolicy returns the signature validity settings, falling back to the built-in defaults when not set
+func (w *dnsZoneWriter) GetSignaturePolicy() (signaturePolicy, error) {
+	policy := signaturePolicy{Validity: signatureValidity, Refresh: signatureRefresh, Jitter: signatureJitter}
+	if err := parseDuration(w.SignatureValidityDays, "days", "signature validity", &policy.Validity); err != nil {
+		return policy, err
+	}
+	if err := parseDuration(w.SignatureRefreshDays, "days", "signature refresh", &policy.Refresh); err != nil {
+		return policy, err
+	}
+	if err := parseDuration(w.SignatureJitterHours, "hours", "signature jitter", &policy.Jitter); err != nil {
+		return policy, err
+	}
+	return policy, policy.validate()
+}
+
+// GetZoneWorkers returns how many zones are built, written and signed at the same time. Defaults to the number of CPUs
+func (w *dnsZoneWriter) GetZoneWorkers() (int, error) {
+	if w.ZoneWorkers == "" {
+		return runtime.NumCPU(), nil
+	}
+	workers, err := strconv.Atoi(w.ZoneWorkers)
+	if err != nil || workers < 1 {
+		return 0, errors.New("Invalid zone workers " + w.ZoneWorkers + ". Expected a number greater than zero")
+	}
+	return workers, nil
+}
+
+// GetHistoryPolicy returns how many snapshots of each zone are kept and for how long
+func (w *dnsZoneWriter) GetHistoryPolicy() (historyPolicy, error) {
+	policy := historyPolicy{Count: zoneHistoryCount, MaxAge: zoneHistoryAge}
+	if err := parseNumber(w.ZoneHistoryCount, "snapshots", "zone history count", &policy.Count); err != nil {
+		return policy, err
+	}
+	if err := parseDuration(w.ZoneHistoryDays, "days", "zone history age", &policy.MaxAge); err != nil {
+		return policy, err
+	}
+	return policy, policy.validate()
+}
+
+// GetDaemonPolicy returns the daemon timing settings, falling back to the built-in defaults when not set
+func (w *dnsZoneWriter) GetDaemonPolicy() (daemonPolicy, error) {
+	policy := daemonPolicy{Interval: daemonInterval, Debounce: daemonDebounce, NameCacheLifetime: dynamicFQDNCacheLifetime,
+		ListenRetry: listenRetry}
+	if err := parseDuration(w.DaemonIntervalSeconds, "seconds", "daemon interval", &policy.Interval); err != nil {
+		return policy, err
+	}
+	if err := parseDuration(w.DaemonDebounceSeconds, "seconds", "daemon debounce", &policy.Debounce); err != nil {
+		return policy, err
+	}
+	if err := parseDuration(w.DynamicFQDNCacheSeconds, "seconds", "dynamic FQDN cache lifetime", &policy.NameCacheLifetime); err != nil {
+		return policy, err
+	}
+	signatures, err := w.GetSignaturePolicy()
+	if err != nil {
+		return policy, err
+	}
+	return policy, policy.validate(signatures)
+}
+
+// durationUnits are the units duration settings are configured in
+var durationUnits = map[string]time.Duration{"seconds": time.Second, "hours": time.Hour, "days": 24 * time.Hour}
+
+// parseNumber sets setting to the number in value. An empty value leaves the setting at its default
+func parseNumber(value string, unit string, name string, setting *int) error {
+	if value == "" {
+		return nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("Invalid " + name + " " + value + ". Expected number of " + unit)
+	}
+	*setting = number
+	return nil
+}
+
+// parseDuration sets setting to the number of seconds, hours or days in value. An empty value leaves the
+// setting at its default
+func parseDuration(value string, unit string, name string, setting *time.Duration) error {
+	number := 0
+	if value == "" {
+		return nil
+	}
+	if err := parseNumber(value, unit, name, &number); err != nil {
+		return err
+	}
+	*setting = time.Duration(number) * durationUnits[unit]
+	return nil
+}
+
 func (w *dnsZoneWriter) CheckIfMaster(ips []string) bool {
 	for _, ipAddress := range ips {
 		if ipAddress == w.DNSMasterIP {
@@ -87,8 +276,10 @@ func (w *dnsZoneWriter) UpdateZoneData(db dnsBackend) error {
 }
 
 func (w *dnsZoneWriter) GetZones(db dnsBackend) ([]domain, error) {
-	if err := db.CreateSchema(); err != nil {
-		return nil, err
+	if !w.DryRun {
+		if err := db.CreateSchema(); err != nil {
+			return nil, err
+		}
 	}
 	domains, err := db.GetDomains()
 	if err != nil {
@@ -99,13 +290,121 @@ func (w *dnsZoneWriter) GetZones(db dnsBackend) ([]domain, error) {
 		return nil, errors.New("Unable to merge with virtual domains" + err.Error())
 	}
 
-	for i := range domains {
-		domains[i].BuildDNSRecords(path.Join(w.DKIMKeysPath, domains[i].Name, "mail.txt"), w.TLSPublicKeyPath)
+	defaultSOA, err := w.GetSOADefaults()
+	if err != nil {
+		return nil, err
+	}
+	defaultTemplate := w.GetDefaultTemplate()
+	if err := defaultTemplate.validate(); err != nil {
+		return nil, err
+	}
+	dbTemplates, err := db.GetTemplates()
+	if err != nil {
+		return nil, errors.New("Unable to retrieve templates from database " + err.Error())
+	}
+	templates, err := getTemplates(*defaultTemplate, dbTemplates)
+	if err != nil {
+		return nil, err
+	}
+	workers, err := w.GetZoneWorkers()
+	if err != nil {
+		return nil, err
+	}
+	// a domain that can't be built keeps its error so the other zones are still written
+	forEachZone(domains, workers, func(i int) error {
+		domains[i].err = w.prepareZone(&domains[i], defaultSOA, defaultTemplate, templates)
+		return nil
+	})
+
+	if w.ReverseZonePrefixes != "" {
+		overrides, err := db.GetPTRRecords()
+		if err != nil {
+			return nil, errors.New("Unable to retrieve PTR records from database " + err.Error())
+		}
+		reverseZones, err := buildReverseZones(w.ReverseZonePrefixes, domains, overrides, defaultSOA, defaultTemplate)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, reverseZones...)
 	}
 
 	return domains, nil
 }
 
+// zoneFailures returns zoneErrors listing the zones that couldn't be built or nil if there are none
+func zoneFailures(zones []domain) error {
+	failed := zoneErrors{}
+	for _, zone := range zones {
+		if zone.err != nil {
+			failed = append(failed, zoneError{Zone: zone.Name, Err: zone.err})
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// prepareZone applies the defaults and template to the domain and builds its records unless its inputs
+// haven't changed since the zone was last written
+func (w *dnsZoneWriter) prepareZone(d *domain, defaultSOA soaSettings, defaultTemplate *zoneTemplate, templates map[int16]*zoneTemplate) error {
+	d.SOA = d.SOA.withDefaults(defaultSOA)
+	if err := d.SOA.validate(); err != nil {
+		return errors.New("Invalid SOA settings. " + err.Error())
+	}
+	if err := d.Denial.validate(); err != nil {
+		return errors.New("Invalid DNSSEC settings. " + err.Error())
+	}
+	d.template = defaultTemplate
+	if d.TemplateID != 0 {
+		if d.template = templates[d.TemplateID]; d.template == nil {
+			return fmt.Errorf("Template %d not found", d.TemplateID)
+		}
+	}
+	d.sourceHash = w.inputHash(d, d.template)
+	if !d.hasDynamicRecords() {
+		d.inputHash = d.sourceHash
+		d.deferred = !w.Force && d.inputHash == d.savedInputHash(w.ZoneFileDirectory)
+	}
+	if d.deferred {
+		return nil // built later if the zone needs re-signing
+	}
+	return w.buildZone(d)
+}
+
+// buildZone builds the records of the zone from its data and template. The CDS and CDNSKEY records are added
+// by completeZone once the domain's keys are up to date
+func (w *dnsZoneWriter) buildZone(d *domain) error {
+	d.deferred = false
+	return d.BuildDNSRecords(path.Join(w.DKIMKeysPath, d.Name, "mail.txt"), w.TLSPublicKeyPath, d.template)
+}
+
+// completeZone builds the zone if it was deferred and adds the CDS and CDNSKEY records for the given keys
+func (w *dnsZoneWriter) completeZone(d *domain, keys *domainKeys) error {
+	if d.deferred {
+		if err := w.buildZone(d); err != nil {
+			return err
+		}
+	}
+	return addCDSRecords(d, keys)
+}
+
+// inputHash returns a hash of everything the zone is built from other than its keys and dynamic FQDN lookups
+func (w *dnsZoneWriter) inputHash(d *domain, template *zoneTemplate) string {
+	hash := sha256.New()
+	data, _ := json.Marshal(struct {
+		Domain   *domain
+		Template *zoneTemplate
+	}{d, template})
+	hash.Write(data)
+	for _, filename := range []string{path.Join(w.DKIMKeysPath, d.Name, "mail.txt"), w.TLSPublicKeyPath} {
+		contents, _ := ioutil.ReadFile(filename)
+		fmt.Fprintf(hash, "\n%s %d\n", filename, len(contents))
+		hash.Write(contents)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 func (w *dnsZoneWriter) IncludePostfixVirtualDomains(domains []domain) ([]domain, error) {
 	dMap := make(map[string]int)
 	for i := range domains {
@@ -132,40 +431,607 @@ func (w *dnsZoneWriter) IncludePostfixVirtualDomains(domains []domain) ([]domain
 	return domains, nil
 }
 
+// WriteAll writes and signs the zones and publishes them if any changed. Zones that fail don't stop the others
+// from being published. Returns zoneErrors listing every zone that failed
 func (w *dnsZoneWriter) WriteAll(zones []domain) error {
 	updated, err := w.WriteZones(zones)
-	if err != nil {
+	if _, partial := err.(zoneErrors); err != nil && !partial {
 		return err
 	}
 	if updated {
-		err := w.WriteZoneConfig(zones, w.ZonePassword)
-		if err != nil {
+		if err := w.publish(zones); err != nil {
 			return err
 		}
-		if w.IsMaster {
-			time.Sleep(time.Second) // wait 1 second so config files can finish closing
-			return reloadNsdServer()
+	}
+	return err
+}
+
+// publish writes zones.conf and reloads NSD. Zones that have never been signed are left out so a new zone
+// that failed doesn't stop NSD from loading. Zones that failed after being signed before keep their last good version.
+// Zone files and zones.conf are synced and renamed into place before they're referenced, so NSD never reads part of one
+func (w *dnsZoneWriter) publish(zones []domain) error {
+	published := []domain{}
+	for _, zone := range zones {
+		if _, err := os.Stat(filepath.Join(w.ZoneFileDirectory, zone.Name+".txt.signed")); err == nil || (w.DryRun && zone.err == nil) {
+			published = append(published, zone)
 		}
 	}
+	err := w.WriteZoneConfig(published, w.ZonePassword)
+	if err != nil {
+		return err
+	}
+	if w.IsMaster && w.DryRun {
+		fmt.Fprintln(w.stdout(), "Would reload NSD")
+	} else if w.IsMaster {
+		return reloadNsdServer()
+	}
 	return nil
 }
 
-func (w *dnsZoneWriter) WriteZones(zones []domain) (bool, error) {
-	zonesUpdated := false
+// UpdateDomains writes and signs the zones of the domains with the given IDs. Zones without an ID, the reverse
+// zones and Postfix virtual domains, are included since they can hold records of any domain. Domains that are
+// no longer in the database are dropped from zones.conf
+func (w *dnsZoneWriter) UpdateDomains(db dnsBackend, ids []int16) error {
+	zones, err := w.GetZones(db)
+	if err != nil {
+		return errors.New("Unable to get zones from database " + err.Error())
+	}
+	changed := make(map[int16]bool)
+	for _, id := range ids {
+		changed[id] = true
+	}
+	selected := []domain{}
 	for _, zone := range zones {
-		updated, err := zone.WriteZone(w.ZoneFileDirectory)
+		if zone.ID == 0 || changed[zone.ID] {
+			selected = append(selected, zone)
+			delete(changed, zone.ID)
+		}
+	}
+	updated, err := w.WriteZones(selected)
+	if _, partial := err.(zoneErrors); err != nil && !partial {
+		return err
+	}
+	if updated || len(changed) > 0 {
+		if err := w.publish(zones); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (w *dnsZoneWriter) WriteZones(zones []domain) (bool, error) {
+	policy, err := w.GetKeyPolicy()
+	if err != nil {
+		return false, err
+	}
+	signatures, err := w.GetSignaturePolicy()
+	if err != nil {
+		return false, err
+	}
+	var checker dsChecker
+	if w.ParentDSResolver != "" {
+		checker = &resolverDSChecker{Resolver: w.ParentDSResolver}
+	}
+	workers, err := w.GetZoneWorkers()
+	if err != nil {
+		return false, err
+	}
+	if w.DryRun {
+		workers = 1 // keep the diffs in zone order
+	}
+	updated := make([]bool, len(zones))
+	err = forEachZone(zones, workers, func(i int) error {
+		if zones[i].err != nil {
+			return zones[i].err
+		}
+		var err error
+		if w.DryRun {
+			updated[i], err = w.diffZone(zones[i], policy, signatures)
+		} else {
+			updated[i], err = w.writeZone(zones[i], policy, signatures, checker)
+		}
+		if err != nil {
+			zones[i].err = err
+		}
+		return err
+	})
+	for i := range updated {
+		if updated[i] {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+// writeZone moves the domain's key rollovers along and writes and signs the zone if it changed, the keys
+// changed or the signatures are due to be refreshed
+func (w *dnsZoneWriter) writeZone(zone domain, policy keyPolicy, signatures signaturePolicy, checker dsChecker) (bool, error) {
+	keys, err := w.loadKeys(zone.Name, policy)
+	if err != nil {
+		return false, err
+	}
+	keysChanged, err := keys.Update(policy, checker, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if err := keys.saveIfChanged(keysChanged); err != nil {
+		return false, err
+	}
+	resign := keysChanged || zone.NeedsResign(w.ZoneFileDirectory, signatures, time.Now())
+	if w.pinned(&zone) {
+		if !resign {
+			return false, nil
+		}
+		return w.resignPinnedZone(zone, keys, signatures.expiration(time.Now()))
+	}
+	if zone.deferred && !resign {
+		return false, nil // inputs unchanged since the zone was last written
+	}
+	if err := w.completeZone(&zone, keys); err != nil {
+		return false, err
+	}
+	updated, err := w.writeAndSignZone(zone, keys, resign, signatures.expiration(time.Now()))
+	if err != nil {
+		return false, err
+	}
+	return updated, zone.saveInputHash(w.ZoneFileDirectory)
+}
+
+// writeAndSignZone writes the zone file if it changed or force is set, signs it and keeps a snapshot of it. A zone
+// with lint errors isn't written so its last good version stays in place
+func (w *dnsZoneWriter) writeAndSignZone(zone domain, keys *domainKeys, force bool, expiration time.Time) (bool, error) {
+	warnings, err := zone.Lint()
+	if err != nil {
+		return false, err
+	}
+	filename := filepath.Join(w.ZoneFileDirectory, zone.Name+".txt")
+	previous, previousErr := ioutil.ReadFile(filename)
+	updated, err := zone.WriteZone(w.ZoneFileDirectory, force)
+	if err != nil || !updated {
+		return false, err
+	}
+	if err := w.signOrRestore(zone, keys, expiration, previous, previousErr); err != nil {
+		return false, err
+	}
+	w.warn(warnings)
+	w.snapshotZone(zone.Name)
+	return true, nil
+}
+
+// signOrRestore signs the zone file that was just written. If signing fails the previous zone file is put back
+// so the signed zone and the zone file match and the zone is retried on the next run
+func (w *dnsZoneWriter) signOrRestore(zone domain, keys *domainKeys, expiration time.Time, previous []byte, previousErr error) error {
+	err := w.signZone(zone, keys, expiration)
+	if err != nil {
+		filename := filepath.Join(w.ZoneFileDirectory, zone.Name+".txt")
+		if previousErr != nil {
+			os.Remove(filename)
+		} else {
+			writeFileAtomic(filename, previous, 0644)
+		}
+	}
+	return err
+}
+
+// snapshotZone adds the zone file to the zone's history. A zone that can't be added is still published
+func (w *dnsZoneWriter) snapshotZone(name string) {
+	policy, err := w.GetHistoryPolicy()
+	if err == nil {
+		err = snapshotZone(w.ZoneFileDirectory, name, policy, time.Now())
+	}
+	if err != nil {
+		fmt.Fprintln(w.stdout(), "Unable to save history of", name, err)
+	}
+}
+
+// ZoneHistory writes the snapshots of the zone with their serials and the changes between them
+func (w *dnsZoneWriter) ZoneHistory(out io.Writer, name string) error {
+	return writeHistory(out, w.ZoneFileDirectory, name)
+}
+
+// Rollback puts the zone back to the snapshot taken at timestamp with a new serial so secondaries pick it up,
+// signs it with the current keys and reloads NSD. The zone is pinned so that it is only re-signed, not rebuilt
+// from the database, until the domain changes in the database or it is written with force
+func (w *dnsZoneWriter) Rollback(db dnsBackend, name string, timestamp string) error {
+	zones, err := w.GetZones(db)
+	if err != nil {
+		return errors.New("Unable to get zones from database " + err.Error())
+	}
+	var zone *domain
+	for i := range zones {
+		if zones[i].Name == name {
+			zone = &zones[i]
+		}
+	}
+	if zone == nil {
+		return errors.New("Zone " + name + " not found")
+	}
+	snapshots, err := zoneSnapshots(w.ZoneFileDirectory, name)
+	if err != nil {
+		return err
+	}
+	var snapshot []byte
+	for _, s := range snapshots {
+		if s.Timestamp == timestamp {
+			if snapshot, err = ioutil.ReadFile(s.Filename); err != nil {
+				return err
+			}
+		}
+	}
+	if snapshot == nil {
+		return errors.New("No snapshot of " + name + " taken at " + timestamp + ". See history " + name)
+	}
+
+	policy, err := w.GetKeyPolicy()
+	if err != nil {
+		return err
+	}
+	signatures, err := w.GetSignaturePolicy()
+	if err != nil {
+		return err
+	}
+	if !domainKeysExist(w.DNSSecKeyDir, name, policy) {
+		return errors.New("No keys found for " + name)
+	}
+	keys, err := w.loadKeys(name, policy)
+	if err != nil {
+		return err
+	}
+
+	serial, err := w.restoreZone(*zone, keys, snapshot, signatures.expiration(time.Now()))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w.stdout(), "Rolled back", name, "to", timestamp, "with serial", serial)
+	w.snapshotZone(name)
+	if zone.sourceHash == "" {
+		fmt.Fprintln(w.stdout(), "The zone is rebuilt from the database on the next write")
+	} else {
+		if err := writeFileAtomic(w.pinPath(name), []byte(zone.sourceHash+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(w.stdout(), "The zone is kept until", name, "changes in the database or write --force rebuilds it")
+	}
+	if w.IsMaster {
+		return reloadNsdServer()
+	}
+	return nil
+}
+
+// restoreZone writes contents as the zone file with a new serial and signs it. The previous zone file is put back
+// if signing fails. Returns the new serial
+func (w *dnsZoneWriter) restoreZone(zone domain, keys *domainKeys, contents []byte, expiration time.Time) (string, error) {
+	filename := filepath.Join(w.ZoneFileDirectory, zone.Name+".txt")
+	previous, previousErr := ioutil.ReadFile(filename)
+	_, currentSerial := getFileMatch(filename, `SOA.*\((\d*)`)
+	serial := getSerialNumberRevision(currentSerial, time.Now().Format("2006010200"))
+	restored, err := setSerial(string(contents), serial)
+	if err != nil {
+		return "", errors.New("Invalid zone file for " + zone.Name + " " + err.Error())
+	}
+	if err := writeFileAtomic(filename, []byte(restored), 0644); err != nil {
+		return "", err
+	}
+	return serial, w.signOrRestore(zone, keys, expiration, previous, previousErr)
+}
+
+// pinned reports whether the zone was rolled back and hasn't changed in the database since. A pin that no
+// longer applies, or any pin when writing with force, is removed so the zone is rebuilt
+func (w *dnsZoneWriter) pinned(zone *domain) bool {
+	data, err := ioutil.ReadFile(w.pinPath(zone.Name))
+	if err != nil {
+		return false
+	}
+	if !w.Force && zone.sourceHash != "" && strings.TrimSpace(string(data)) == zone.sourceHash {
+		return true
+	}
+	if !w.DryRun {
+		os.Remove(w.pinPath(zone.Name))
+	}
+	return false
+}
+
+func (w *dnsZoneWriter) pinPath(name string) string {
+	return filepath.Join(w.ZoneFileDirectory, name+".txt.pinned")
+}
+
+// resignPinnedZone re-signs the rolled back zone file as it is with a new serial
+func (w *dnsZoneWriter) resignPinnedZone(zone domain, keys *domainKeys, expiration time.Time) (bool, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(w.ZoneFileDirectory, zone.Name+".txt"))
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.restoreZone(zone, keys, contents, expiration); err != nil {
+		return false, err
+	}
+	w.snapshotZone(zone.Name)
+	return true, nil
+}
+
+// SignZones re-signs the named zones, or every zone if none are given, with their current keys and publishes
+// them so that a zone signed for the first time is served
+func (w *dnsZoneWriter) SignZones(db dnsBackend, names []string) error {
+	zones, err := w.GetZones(db)
+	if err != nil {
+		return errors.New("Unable to get zones from database " + err.Error())
+	}
+	selected := zones
+	if len(names) > 0 {
+		selected = []domain{}
+		for _, name := range names {
+			found := false
+			for _, zone := range zones {
+				if zone.Name == name {
+					selected = append(selected, zone)
+					found = true
+				}
+			}
+			if !found {
+				return errors.New("Zone " + name + " not found")
+			}
+		}
+	}
+	policy, err := w.GetKeyPolicy()
+	if err != nil {
+		return err
+	}
+	signatures, err := w.GetSignaturePolicy()
+	if err != nil {
+		return err
+	}
+	workers, err := w.GetZoneWorkers()
+	if err != nil {
+		return err
+	}
+	err = forEachZone(selected, workers, func(i int) error {
+		zone := selected[i]
+		if zone.err != nil {
+			return zone.err
+		}
+		keys, err := w.loadKeys(zone.Name, policy)
 		if err != nil {
+			return err
+		}
+		if err := keys.saveIfChanged(false); err != nil {
+			return err
+		}
+		if w.pinned(&zone) {
+			_, err := w.resignPinnedZone(zone, keys, signatures.expiration(time.Now()))
+			return err
+		}
+		if err := w.completeZone(&zone, keys); err != nil {
+			return err
+		}
+		if _, err := w.writeAndSignZone(zone, keys, true, signatures.expiration(time.Now())); err != nil {
+			return err
+		}
+		return zone.saveInputHash(w.ZoneFileDirectory)
+	})
+	if failed, _ := err.(zoneErrors); len(failed) < len(selected) {
+		if err := w.publish(zones); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// ListKeys writes the state of each key of the named domains, or of every domain with a key state file if none are given
+func (w *dnsZoneWriter) ListKeys(out io.Writer, domains []string) error {
+	policy, err := w.GetKeyPolicy()
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		files, err := filepath.Glob(filepath.Join(w.DNSSecKeyDir, "*.keys.json"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			domains = append(domains, strings.TrimSuffix(filepath.Base(file), ".keys.json"))
+		}
+	}
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tTYPE\tALGORITHM\tTAG\tSTATUS\tCREATED\tFILE")
+	for _, domain := range domains {
+		if !domainKeysExist(w.DNSSecKeyDir, domain, policy) {
+			return errors.New("No keys found for " + domain)
+		}
+		keys, err := w.loadKeys(domain, policy)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys.Keys {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", domain, key.Type, key.Algorithm, key.KeyTag, key.status(),
+				key.Created.Format("2006-01-02 15:04"), key.Prefix)
+		}
+		if r := keys.AlgorithmRollover; r != nil {
+			fmt.Fprintf(tw, "%s\talgorithm rollover to %s at step %d since %s\n", domain, r.Algorithm, r.Step, r.Started.Format("2006-01-02 15:04"))
+		}
+		if keys.KSKRolloverRequested {
+			fmt.Fprintf(tw, "%s\tKSK rollover requested\n", domain)
+		}
+	}
+	return tw.Flush()
+}
+
+// diffZone prints the changes WriteZones would make to the zone. Key rollovers aren't moved along in a
+// dry run, so only record changes and signatures that are due to expire are reported. Returns the error that
+// would stop the zone from being written
+func (w *dnsZoneWriter) diffZone(zone domain, policy keyPolicy, signatures signaturePolicy) (bool, error) {
+	resign := zone.NeedsResign(w.ZoneFileDirectory, signatures, time.Now())
+	if w.pinned(&zone) {
+		if resign {
+			fmt.Fprintln(w.stdout(), "Would re-sign rolled back", zone.Name)
+		}
+		return resign, nil
+	}
+	if zone.deferred && !resign {
+		return false, nil
+	}
+	var keys *domainKeys // keys are created on the first real run
+	if domainKeysExist(w.DNSSecKeyDir, zone.Name, policy) {
+		var err error
+		if keys, err = w.loadKeys(zone.Name, policy); err != nil {
 			return false, err
 		}
-		if updated {
-			zonesUpdated = true
-			zone.SignZone(w.ZoneFileDirectory, w.DNSSecKeyDir, w.SigningAlgorithm)
+	}
+	if err := w.completeZone(&zone, keys); err != nil {
+		return false, err
+	}
+	currentZone, newZone := zone.PendingZone(w.ZoneFileDirectory, resign)
+	if newZone == "" {
+		return false, nil
+	}
+	warnings, err := zone.Lint()
+	w.warn(warnings)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprint(w.stdout(), diffZones(currentZone, newZone, zone.Name))
+	if resign {
+		fmt.Fprintln(w.stdout(), "Would re-sign", zone.Name)
+	}
+	return true, nil
+}
+
+// warn prints the lint warnings of a zone
+func (w *dnsZoneWriter) warn(warnings []lintProblem) {
+	for _, warning := range warnings {
+		fmt.Fprintln(w.stdout(), "Warning:", warning)
+	}
+}
+
+func (w *dnsZoneWriter) stdout() io.Writer {
+	if w.output == nil {
+		return os.Stdout
+	}
+	return w.output
+}
+
+// signZone signs the zone with the domain's current keys
+func (w *dnsZoneWriter) signZone(zone domain, keys *domainKeys, expiration time.Time) error {
+	signingKeys, err := keys.signingKeys()
+	if err != nil {
+		return err
+	}
+	return zone.SignZone(w.ZoneFileDirectory, signingKeys, expiration)
+}
+
+// SignatureReport writes the earliest signature expiry of every signed zone in the zone directory. Returns
+// the number of zones whose signatures have expired, are due to be re-signed or can't be read
+func (w *dnsZoneWriter) SignatureReport(out io.Writer, now time.Time) (int, error) {
+	policy, err := w.GetSignaturePolicy()
+	if err != nil {
+		return 0, err
+	}
+	files, err := filepath.Glob(filepath.Join(w.ZoneFileDirectory, "*.txt.signed"))
+	if err != nil {
+		return 0, err
+	}
+	problems := 0
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ZONE\tEXPIRES\tREMAINING\tRECORD\tSTATUS")
+	for _, file := range files {
+		zone := strings.TrimSuffix(filepath.Base(file), ".txt.signed")
+		sig, err := earliestSignature(file)
+		if err != nil {
+			problems++
+			fmt.Fprintf(tw, "%s\t-\t-\t-\tERROR %s\n", zone, err)
+			continue
+		}
+		expiry := signatureExpiry(sig)
+		status := "OK"
+		if !expiry.After(now) {
+			status = "EXPIRED"
+			problems++
+		} else if policy.needsRefresh(expiry, now) {
+			status = "RESIGN DUE"
+			problems++
 		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1fd\t%s %s\t%s\n", zone, expiry.UTC().Format("2006-01-02 15:04:05"),
+			expiry.Sub(now).Hours()/24, sig.Hdr.Name, dns.TypeToString[sig.TypeCovered], status)
+	}
+	return problems, tw.Flush()
+}
+
+// loadKeys loads the domain's keys with their instructions for the operator going to the writer's output
+func (w *dnsZoneWriter) loadKeys(domain string, policy keyPolicy) (*domainKeys, error) {
+	keys, err := loadDomainKeys(w.DNSSecKeyDir, domain, policy)
+	if err != nil {
+		return nil, err
+	}
+	keys.output = w.stdout()
+	return keys, nil
+}
+
+// addCDSRecords adds the CDS and CDNSKEY records for the KSK of keys the parent DS should point to. keys is
+// nil in a dry run of a domain whose keys haven't been created yet
+func addCDSRecords(d *domain, keys *domainKeys) error {
+	if !d.PublishCDS && !d.DNSSECDelete {
+		return nil
+	}
+	if d.DNSSECDelete {
+		return d.AddCDSRecords("")
+	}
+	if keys == nil {
+		return nil
+	}
+	prefix, err := keys.cdsKeyPrefix()
+	if err != nil {
+		return err
+	}
+	return d.AddCDSRecords(prefix)
+}
+
+// RollKSK starts a KSK rollover for the domain on the next run
+func (w *dnsZoneWriter) RollKSK(domain string) error {
+	policy, err := w.GetKeyPolicy()
+	if err != nil {
+		return err
+	}
+	if !domainKeysExist(w.DNSSecKeyDir, domain, policy) {
+		return errors.New("No keys found for " + domain)
+	}
+	keys, err := w.loadKeys(domain, policy)
+	if err != nil {
+		return err
 	}
-	return zonesUpdated, nil
+	keys.KSKRolloverRequested = true
+	return keys.save()
+}
+
+// ConfirmDS records that the parent zone publishes the DS record of the domain's new KSK
+// so that the old KSK can be retired
+func (w *dnsZoneWriter) ConfirmDS(domain string) error {
+	policy, err := w.GetKeyPolicy()
+	if err != nil {
+		return err
+	}
+	if !domainKeysExist(w.DNSSecKeyDir, domain, policy) {
+		return errors.New("No keys found for " + domain)
+	}
+	keys, err := w.loadKeys(domain, policy)
+	if err != nil {
+		return err
+	}
+	if err := keys.ConfirmDS(time.Now()); err != nil {
+		return err
+	}
+	return keys.save()
 }
 
 func (w *dnsZoneWriter) WriteZoneConfig(zones []domain, password string) error {
+	filename := filepath.Join(w.NsdDir, "zones.conf")
+	config := w.zoneConfig(zones, password)
+	if w.DryRun {
+		current, _ := ioutil.ReadFile(filename)
+		fmt.Fprint(w.stdout(), diffText(string(current), config, "zones.conf"))
+		return nil
+	}
+	return writeFileAtomic(filename, []byte(config), 0640)
+}
+
+func (w *dnsZoneWriter) zoneConfig(zones []domain, password string) string {
 	config := fmt.Sprintf("key:\n  name: \"sec_key\"\n  algorithm: hmac-sha256\n  secret: \"%s\"", password)
 
 	for _, zone := range zones {
@@ -176,7 +1042,7 @@ func (w *dnsZoneWriter) WriteZoneConfig(zones []domain, password string) error {
 			config += fmt.Sprintf("  allow-notify: %s sec_key\n  request-xfr: AXFR %s@53 sec_key", w.DNSMasterIP, w.DNSMasterIP)
 		}
 	}
-	return ioutil.WriteFile(filepath.Join(w.NsdDir, "zones.conf"), []byte(config), 0640)
+	return config
 }
 
 func reloadNsdServer() error {
@@ -187,19 +1053,19 @@ func reloadNsdServer() error {
 	return nil
 }
 
-func getSigningKeyPrefixes(domain string, signingAlgorithm string, keyDir string) (kskPrefix string, zskPrefix string, err error) {
-	prefix := filepath.Join(keyDir, domain+"."+signingAlgorithm)
+func getSigningKeyPrefixes(domain string, keyDir string, policy keyPolicy) (kskPrefix string, zskPrefix string, err error) {
+	prefix := filepath.Join(keyDir, domain+"."+policy.Algorithm)
 	ksk := prefix + ".KSK"
 	zsk := prefix + ".ZSK"
 	// (re)create keys if any of the private, ds or key files aren't present
 	if !keysExist(ksk) {
-		if err := createSigningKeys(keyDir, domain, signingAlgorithm, "KSK"); err != nil {
+		if err := createSigningKeys(keyDir, domain, "KSK", policy); err != nil {
 			return "", "", err
 		}
 	}
 
 	if !keysExist(zsk) {
-		if err := createSigningKeys(keyDir, domain, signingAlgorithm, "ZSK"); err != nil {
+		if err := createSigningKeys(keyDir, domain, "ZSK", policy); err != nil {
 			return "", "", err
 		}
 	}
@@ -218,33 +1084,10 @@ func keysExist(filePrefix string) bool {
 	return true
 }
 
-func createSigningKeys(keyDir string, domain string, signingAlgorithm string, keyType string) error {
-	var cmd command.Cmder
-	if keyType == "KSK" {
-		cmd = command.Command("/usr/bin/ldns-keygen", "-a", signingAlgorithm, "-b", "2048", "-k", domain)
-	} else {
-		cmd = command.Command("/usr/bin/ldns-keygen", "-a", signingAlgorithm, "-b", "1024", domain)
-	}
-	cmd.SetWorkingDir(keyDir)
-
-	output, err := cmd.Output()
-	if err != nil {
+func createSigningKeys(keyDir string, domain string, keyType string, policy keyPolicy) error {
+	prefix := filepath.Join(keyDir, domain+"."+policy.Algorithm+"."+keyType)
+	if err := writeSigningKey(prefix, domain, policy.Algorithm, keyType == "KSK", policy.rsaBits(keyType)); err != nil {
 		return errors.New("Unable to create signing files " + err.Error())
 	}
-	return renameKeyFiles(keyDir, strings.TrimSpace(string(output)), domain, signingAlgorithm, keyType)
-}
-
-func renameKeyFiles(keyDir string, signingPrefix string, domain string, signingAlgorithm string, keyType string) error {
-	oldPrefix := filepath.Join(keyDir, signingPrefix)
-	newPrefix := filepath.Join(keyDir, domain+"."+signingAlgorithm+"."+keyType)
-	if err := os.Rename(oldPrefix+".private", newPrefix+".private"); err != nil {
-		return errors.New("Rename failed: " + err.Error())
-	}
-	if err := os.Rename(oldPrefix+".ds", newPrefix+".ds"); err != nil {
-		return errors.New("Rename failed: " + err.Error())
-	}
-	if err := os.Rename(oldPrefix+".key", newPrefix+".key"); err != nil {
-		return errors.New("Rename failed: " + err.Error())
-	}
 	return nil
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/robarchibald/command"
 )
@@ -47,8 +51,11 @@ func TestUpdateZoneDate(t *testing.T) {
 		t.Error("expected error from db fetch")
 	}
 
-	db = &mockBackend{domains: []domain{domain{Name: "example1.com", NsRecords: []nsRecord{nsRecord{Value: "ns1"}}}}}
-	w = &dnsZoneWriter{ZoneFileDirectory: "testData", NsdDir: "testData", DKIMKeysPath: "testData"}
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	db = &mockBackend{domains: []domain{domain{Name: "example1.com", NsRecords: []nsRecord{nsRecord{Value: "ns1"}},
+		ARecords: []aRecord{aRecord{Name: "ns1", IPAddress: "10.1.0.6"}}}}}
+	w = &dnsZoneWriter{ZoneFileDirectory: "testData", NsdDir: "testData", DKIMKeysPath: "testData", DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256"}
 	err = w.UpdateZoneData(db)
 	if err != nil {
 		t.Error("expected success", err)
@@ -56,6 +63,9 @@ func TestUpdateZoneDate(t *testing.T) {
 	if _, err := os.Stat("testData/example1.com.txt"); os.IsNotExist(err) {
 		t.Error("expected example1.com.txt to be created")
 	}
+	if _, err := os.Stat("testData/example1.com.txt.signed"); os.IsNotExist(err) {
+		t.Error("expected example1.com.txt.signed to be created")
+	}
 
 	db = &mockBackend{domains: []domain{domain{Name: "&?\\/#@*^%bogus", NsRecords: []nsRecord{nsRecord{Value: "ns1"}}}}}
 	err = w.UpdateZoneData(db)
@@ -94,12 +104,636 @@ func TestGetZones(t *testing.T) {
 	db = &mockBackend{domains: domains}
 	actual, err = w.GetZones(db)
 
-	// success with merged domains
+	// fail due to merged domain without name servers
 	w.PostfixVirtualDomainsPath = "testData/virtual-mailbox-domains.txt"
 	actual, err = w.GetZones(db)
+	if err != nil || zoneFailures(actual) == nil {
+		t.Error("expected zone error", err)
+	}
+
+	// success with merged domains
+	w.DefaultNameServers = "ns1.example.net."
+	actual, err = w.GetZones(db)
 	if err != nil || len(actual) != 2 || actual[0].Name != "example.com" || actual[1].Name != "test1.com" {
 		t.Error("expected success", err, actual)
 	}
+
+	// fail getting PTR records
+	w = &dnsZoneWriter{ReverseZonePrefixes: "10.1.0.0/24"}
+	db = &mockBackend{domains: domains, getPTRRecordsErr: errors.New("fail")}
+	_, err = w.GetZones(db)
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	// fail due to bad prefix
+	w = &dnsZoneWriter{ReverseZonePrefixes: "bogus"}
+	db = &mockBackend{domains: domains}
+	_, err = w.GetZones(db)
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	// fail due to invalid SOA settings for domain
+	w = &dnsZoneWriter{}
+	db = &mockBackend{domains: []domain{domain{Name: "example.com", SOA: soaSettings{Retry: 3 * time.Hour}}}}
+	actual, err = w.GetZones(db)
+	if err != nil || zoneFailures(actual) == nil {
+		t.Error("expected zone error", err)
+	}
+
+	// fail due to invalid DNSSEC settings for domain
+	db = &mockBackend{domains: []domain{domain{Name: "example.com", Denial: denialSettings{Type: "NSEC5"}}}}
+	actual, err = w.GetZones(db)
+	if err != nil || zoneFailures(actual) == nil {
+		t.Error("expected zone error", err)
+	}
+
+	// fail due to invalid default SOA settings
+	w = &dnsZoneWriter{SOARefresh: "bogus"}
+	db = &mockBackend{domains: domains}
+	_, err = w.GetZones(db)
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	// fail getting templates
+	w = &dnsZoneWriter{}
+	db = &mockBackend{domains: domains, getTemplatesErr: errors.New("fail")}
+	_, err = w.GetZones(db)
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	// fail due to invalid template
+	db = &mockBackend{domains: domains, templates: []zoneTemplate{zoneTemplate{ID: 1, TLSAPorts: "bogus"}}}
+	_, err = w.GetZones(db)
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	// fail due to invalid default template
+	w = &dnsZoneWriter{DefaultMailServers: "bogus"}
+	db = &mockBackend{domains: domains}
+	_, err = w.GetZones(db)
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	// fail due to missing template
+	w = &dnsZoneWriter{}
+	db = &mockBackend{domains: []domain{domain{Name: "example.com", TemplateID: 2}}, templates: []zoneTemplate{zoneTemplate{ID: 1}}}
+	actual, err = w.GetZones(db)
+	if err != nil || zoneFailures(actual) == nil {
+		t.Error("expected zone error", err)
+	}
+
+	// success with template
+	db = &mockBackend{domains: []domain{domain{Name: "example.com", TemplateID: 1}}, templates: []zoneTemplate{zoneTemplate{ID: 1, NameServers: "ns1.example.org."}}}
+	actual, err = w.GetZones(db)
+	if err != nil || len(actual) != 1 || actual[0].NsRecords[0].Value != "ns1.example.org." {
+		t.Error("expected success with template", err, actual)
+	}
+
+	// success with reverse zones
+	w = &dnsZoneWriter{ReverseZonePrefixes: "10.1.0.0/24", DefaultNameServers: "ns1.example.net."}
+	domains = []domain{domain{Name: "example.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}}}
+	db = &mockBackend{domains: domains, ptrRecords: []ptrRecord{ptrRecord{IPAddress: "10.1.0.7", Name: "mail.example.com."}}}
+	actual, err = w.GetZones(db)
+	if err != nil || len(actual) != 2 || actual[1].Name != "0.1.10.in-addr.arpa" || len(actual[1].DNSRecords) != 4 {
+		t.Error("expected success with reverse zone", err, actual)
+	}
+}
+
+func TestGetSOADefaults(t *testing.T) {
+	w := &dnsZoneWriter{}
+	soa, err := w.GetSOADefaults()
+	if err != nil || soa != getDefaultSOA() {
+		t.Error("expected built-in defaults", err, soa)
+	}
+
+	w = &dnsZoneWriter{SOARefresh: "3600", SOARetry: "600", SOAExpire: "2419200", SOANegativeTTL: "300", SOAHostmaster: "dns@example.com"}
+	soa, err = w.GetSOADefaults()
+	if err != nil || soa.Refresh != time.Hour || soa.Retry != 10*time.Minute || soa.Expire != 28*24*time.Hour || soa.NegativeTTL != 5*time.Minute || soa.Hostmaster != "dns@example.com" {
+		t.Error("expected configured defaults", err, soa)
+	}
+
+	for _, w := range []*dnsZoneWriter{&dnsZoneWriter{SOARefresh: "bogus"}, &dnsZoneWriter{SOARetry: "bogus"}, &dnsZoneWriter{SOAExpire: "bogus"},
+		&dnsZoneWriter{SOANegativeTTL: "bogus"}, &dnsZoneWriter{SOARetry: "7200"}} {
+		if _, err := w.GetSOADefaults(); err == nil {
+			t.Error("expected error", w)
+		}
+	}
+}
+
+func TestGetKeyPolicy(t *testing.T) {
+	w := &dnsZoneWriter{}
+	policy, err := w.GetKeyPolicy()
+	if err != nil || policy.ZSKLifetime != zskLifetime || policy.PropagationDelay != keyPropagationDelay {
+		t.Error("expected built-in defaults", err, policy)
+	}
+
+	w = &dnsZoneWriter{ZSKLifetimeDays: "30", KSKLifetimeDays: "365", KeyPropagationDelayHours: "12"}
+	policy, err = w.GetKeyPolicy()
+	if err != nil || policy.ZSKLifetime != 30*24*time.Hour || policy.KSKLifetime != 365*24*time.Hour || policy.PropagationDelay != 12*time.Hour {
+		t.Error("expected configured policy", err, policy)
+	}
+
+	w = &dnsZoneWriter{SigningAlgorithm: "RSASHA256", RSAKSKBits: "4096", RSAZSKBits: "2048"}
+	policy, err = w.GetKeyPolicy()
+	if err != nil || policy.Algorithm != "RSASHA256" || policy.RSAKSKBits != 4096 || policy.RSAZSKBits != 2048 {
+		t.Error("expected configured RSA key sizes", err, policy)
+	}
+
+	for _, w := range []*dnsZoneWriter{&dnsZoneWriter{ZSKLifetimeDays: "bogus"}, &dnsZoneWriter{KeyPropagationDelayHours: "bogus"},
+		&dnsZoneWriter{KSKLifetimeDays: "bogus"}, &dnsZoneWriter{RSAKSKBits: "bogus"}, &dnsZoneWriter{RSAZSKBits: "bogus"},
+		&dnsZoneWriter{SigningAlgorithm: "RSASHA256", RSAZSKBits: "512"}, &dnsZoneWriter{SigningAlgorithm: "DSA"},
+		&dnsZoneWriter{ZSKLifetimeDays: "1", KeyPropagationDelayHours: "48"}} {
+		if _, err := w.GetKeyPolicy(); err == nil {
+			t.Error("expected error", w)
+		}
+	}
+}
+
+func TestWriteAllDryRun(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
+	var out bytes.Buffer
+	w := &dnsZoneWriter{IsMaster: true, DryRun: true, ZoneFileDirectory: zoneDir, NsdDir: zoneDir, DNSSecKeyDir: keyDir,
+		SigningAlgorithm: "RSASHA256", output: &out}
+	zones := []domain{newSignableDomain("example.com")}
+	zones[0].PublishCDS = true // skipped since there are no keys yet
+	if err := w.WriteAll(zones); err != nil {
+		t.Fatal("expected success", err)
+	}
+	files, _ := ioutil.ReadDir(zoneDir)
+	keyFiles, _ := ioutil.ReadDir(keyDir)
+	if len(files) != 0 || len(keyFiles) != 0 {
+		t.Error("expected nothing to be written", files, keyFiles)
+	}
+	if !strings.Contains(out.String(), "+++ b/example.com.txt") || !strings.Contains(out.String(), "+example.com.\t1800\tIN\tA\t10.1.0.6") ||
+		!strings.Contains(out.String(), "+++ b/zones.conf") || !strings.Contains(out.String(), "Would re-sign example.com") ||
+		!strings.Contains(out.String(), "Would reload NSD") {
+		t.Error("expected diff of new zone", out.String())
+	}
+
+	// existing zone with a changed record
+	w.DryRun = false
+	w.IsMaster = false
+	if err := w.WriteAll(zones); err != nil {
+		t.Fatal("expected success", err)
+	}
+	w.DryRun = true
+	out.Reset()
+	zones[0] = domain{Name: "example.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.7"}}}
+	zones[0].BuildDNSRecords("bogus", "bogus", &zoneTemplate{NameServers: "ns1.example.net."})
+	if err := w.WriteAll(zones); err != nil {
+		t.Fatal("expected success", err)
+	}
+	if !strings.Contains(out.String(), "-example.com.\t1800\tIN\tA\t10.1.0.6\n+example.com.\t1800\tIN\tA\t10.1.0.7") ||
+		strings.Contains(out.String(), "zones.conf") || strings.Contains(out.String(), "Would re-sign") {
+		t.Error("expected diff of changed record", out.String())
+	}
+}
+
+func TestGetSignaturePolicy(t *testing.T) {
+	w := &dnsZoneWriter{}
+	policy, err := w.GetSignaturePolicy()
+	if err != nil || policy.Validity != signatureValidity || policy.Refresh != signatureRefresh || policy.Jitter != signatureJitter {
+		t.Error("expected built-in defaults", err, policy)
+	}
+
+	w = &dnsZoneWriter{SignatureValidityDays: "14", SignatureRefreshDays: "5", SignatureJitterHours: "0"}
+	policy, err = w.GetSignaturePolicy()
+	if err != nil || policy.Validity != 14*24*time.Hour || policy.Refresh != 5*24*time.Hour || policy.Jitter != 0 {
+		t.Error("expected configured policy", err, policy)
+	}
+
+	for _, w := range []*dnsZoneWriter{&dnsZoneWriter{SignatureValidityDays: "bogus"}, &dnsZoneWriter{SignatureRefreshDays: "bogus"},
+		&dnsZoneWriter{SignatureJitterHours: "bogus"}, &dnsZoneWriter{SignatureValidityDays: "3"}} {
+		if _, err := w.GetSignaturePolicy(); err == nil {
+			t.Error("expected error", w)
+		}
+	}
+}
+
+func TestIncrementalZones(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir, NsdDir: zoneDir, DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256",
+		DefaultNameServers: "ns1.example.net."}
+	backend := newMockBackend([]domain{domain{ID: 1, Name: "a.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}},
+		domain{ID: 2, Name: "b.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.7", DynamicFQDN: "dynamic.example.com"}}}})
+	nameToIP["dynamic.example.com"] = []string{"10.1.0.8"}
+	defer delete(nameToIP, "dynamic.example.com")
+	if err := w.UpdateZoneData(backend); err != nil {
+		t.Fatal("expected success", err)
+	}
+	if !fileExists(filepath.Join(zoneDir, "a.com.txt.sha256")) || fileExists(filepath.Join(zoneDir, "b.com.txt.sha256")) {
+		t.Fatal("expected input hash saved only for the domain without dynamic FQDNs")
+	}
+
+	zones, err := w.GetZones(backend)
+	if err != nil || !zones[0].deferred || len(zones[0].DNSRecords) != 0 || zones[1].deferred || len(zones[1].DNSRecords) == 0 {
+		t.Fatal("expected unchanged domain not to be built", err, zones)
+	}
+	if updated, err := w.WriteZones(zones); err != nil || updated {
+		t.Error("expected nothing to be written", updated, err)
+	}
+
+	// signatures due to expire
+	os.Remove(filepath.Join(zoneDir, "a.com.txt.signed"))
+	if updated, err := w.WriteZones(zones); err != nil || !updated || !fileExists(filepath.Join(zoneDir, "a.com.txt.signed")) {
+		t.Error("expected deferred zone to be built and re-signed", updated, err)
+	}
+
+	w.Force = true
+	if zones, err = w.GetZones(backend); err != nil || zones[0].deferred {
+		t.Error("expected forced build", err)
+	}
+	w.Force = false
+	backend.domains[0].ARecords = []aRecord{aRecord{IPAddress: "10.1.0.9"}}
+	if zones, err = w.GetZones(backend); err != nil || zones[0].deferred {
+		t.Error("expected changed domain to be built", err)
+	}
+	os.Remove(filepath.Join(zoneDir, "a.com.txt"))
+	backend.domains[0].ARecords = []aRecord{aRecord{IPAddress: "10.1.0.6"}}
+	if zones, err = w.GetZones(backend); err != nil || zones[0].deferred {
+		t.Error("expected domain with a missing zone file to be built", err)
+	}
+}
+
+func TestWriteZonesCDS(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir, NsdDir: zoneDir, DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256",
+		DefaultNameServers: "ns1.example.net."}
+	backend := newMockBackend([]domain{domain{ID: 1, Name: "a.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}, PublishCDS: true}})
+	if err := w.UpdateZoneData(backend); err != nil {
+		t.Fatal("expected success", err)
+	}
+	keys, _ := loadDomainKeys(keyDir, "a.com", testKeyPolicy())
+	zone, _ := ioutil.ReadFile(filepath.Join(zoneDir, "a.com.txt"))
+	if !strings.Contains(string(zone), fmt.Sprintf("CDS\t%d ", keys.Keys[0].KeyTag)) || !strings.Contains(string(zone), "CDNSKEY\t257 ") {
+		t.Fatal("expected CDS of the KSK", string(zone))
+	}
+
+	// the deferred zone is rebuilt with the new KSK while the CDS stays on the old one
+	if err := w.RollKSK("a.com"); err != nil {
+		t.Fatal("expected success", err)
+	}
+	zones, err := w.GetZones(backend)
+	if err != nil || !zones[0].deferred {
+		t.Fatal("expected unchanged domain to be deferred", err)
+	}
+	if updated, err := w.WriteZones(zones); err != nil || !updated {
+		t.Fatal("expected zone to be rebuilt", updated, err)
+	}
+	keys, _ = loadDomainKeys(keyDir, "a.com", testKeyPolicy())
+	zone, _ = ioutil.ReadFile(filepath.Join(zoneDir, "a.com.txt"))
+	if len(keys.Keys) != 3 || !strings.Contains(string(zone), fmt.Sprintf("CDS\t%d ", keys.Keys[0].KeyTag)) {
+		t.Fatal("expected CDS of the old KSK until the new one has propagated", string(zone))
+	}
+
+	// the CDS moves to the new KSK and its DS is announced once it has propagated
+	var out bytes.Buffer
+	w.output = &out
+	keys.Keys[2].Published = keys.Keys[2].Published.Add(-keyPropagationDelay)
+	keys.save()
+	zones, _ = w.GetZones(backend)
+	if updated, err := w.WriteZones(zones); err != nil || !updated {
+		t.Fatal("expected zone to be rebuilt", updated, err)
+	}
+	zone, _ = ioutil.ReadFile(filepath.Join(zoneDir, "a.com.txt"))
+	if !strings.Contains(string(zone), fmt.Sprintf("CDS\t%d ", keys.Keys[2].KeyTag)) {
+		t.Error("expected CDS of the new KSK", string(zone))
+	}
+	if !strings.Contains(out.String(), "Submit new DS record to the parent of a.com:") {
+		t.Error("expected DS to be announced on the writer's output", out.String())
+	}
+
+	// no keys for a domain being taken unsigned
+	d := domain{Name: "b.com", DNSSECDelete: true}
+	if err := addCDSRecords(&d, nil); err != nil || len(d.DNSRecords) != 2 {
+		t.Error("expected delete signal", err, d.DNSRecords)
+	}
+}
+
+func TestInputHash(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "a.com"), 0755)
+	w := &dnsZoneWriter{DKIMKeysPath: dir, TLSPublicKeyPath: filepath.Join(dir, "cert.pem")}
+	d := &domain{Name: "a.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}}
+	template := &zoneTemplate{NameServers: "ns1.example.net."}
+	hash := w.inputHash(d, template)
+	if hash != w.inputHash(d, template) || len(hash) != 64 {
+		t.Fatal("expected the same hash for the same inputs", hash)
+	}
+	if hash == w.inputHash(d, &zoneTemplate{NameServers: "ns2.example.net."}) {
+		t.Error("expected template change to change the hash")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "a.com", "mail.txt"), []byte("key"), 0644)
+	dkim := w.inputHash(d, template)
+	if dkim == hash {
+		t.Error("expected DKIM key change to change the hash")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte("cert"), 0644)
+	if w.inputHash(d, template) == dkim {
+		t.Error("expected certificate change to change the hash")
+	}
+}
+
+func TestUpdateDomains(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir, NsdDir: zoneDir, DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256",
+		DefaultNameServers: "ns1.example.net."}
+	backend := newMockBackend([]domain{domain{ID: 1, Name: "a.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}},
+		domain{ID: 2, Name: "b.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.7"}}}})
+	if err := w.UpdateZoneData(backend); err != nil {
+		t.Fatal("expected success", err)
+	}
+	os.Remove(filepath.Join(zoneDir, "a.com.txt"))
+	os.Remove(filepath.Join(zoneDir, "b.com.txt"))
+	os.Remove(filepath.Join(zoneDir, "zones.conf"))
+	if err := w.UpdateDomains(backend, []int16{1}); err != nil {
+		t.Fatal("expected success", err)
+	}
+	config, _ := ioutil.ReadFile(filepath.Join(zoneDir, "zones.conf"))
+	if !fileExists(filepath.Join(zoneDir, "a.com.txt")) || fileExists(filepath.Join(zoneDir, "b.com.txt")) ||
+		!strings.Contains(string(config), "name: a.com") || !strings.Contains(string(config), "name: b.com") {
+		t.Fatal("expected only the changed domain to be written and every domain in zones.conf", string(config))
+	}
+
+	os.Remove(filepath.Join(zoneDir, "zones.conf"))
+	if err := w.UpdateDomains(backend, []int16{1}); err != nil || fileExists(filepath.Join(zoneDir, "zones.conf")) {
+		t.Error("expected nothing to be written when the domain is unchanged", err)
+	}
+	if err := w.UpdateDomains(backend, []int16{3}); err != nil || !fileExists(filepath.Join(zoneDir, "zones.conf")) {
+		t.Error("expected zones.conf to be written when a domain was removed", err)
+	}
+
+	backend.getDomainsErr = errors.New("failed")
+	if err := w.UpdateDomains(backend, []int16{1}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestWriteZonesErrors(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir, NsdDir: zoneDir, DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256", ZoneWorkers: "2"}
+	zones := []domain{newSignableDomain("&?\\/#@*^%bogus"), newSignableDomain("a.com"), newSignableDomain("b.com")}
+	updated, err := w.WriteZones(zones)
+	failed, ok := err.(zoneErrors)
+	if !updated || !ok || len(failed) != 1 || failed[0].Zone != "&?\\/#@*^%bogus" {
+		t.Fatal("expected only the bogus zone to fail", updated, err)
+	}
+	if !fileExists(filepath.Join(zoneDir, "a.com.txt.signed")) || !fileExists(filepath.Join(zoneDir, "b.com.txt.signed")) {
+		t.Error("expected the other zones to be written and signed")
+	}
+}
+
+func TestWriteAllPartial(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir, NsdDir: zoneDir, DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256"}
+	if err := w.WriteAll([]domain{newSignableDomain("old.com")}); err != nil {
+		t.Fatal("expected success", err)
+	}
+	signed, _ := ioutil.ReadFile(filepath.Join(zoneDir, "old.com.txt.signed"))
+
+	old := newSignableDomain("old.com")
+	old.err = errors.New("Invalid SOA settings")
+	zones := []domain{old, newSignableDomain("&?\\/#@*^%bogus"), newSignableDomain("a.com")}
+	err := w.WriteAll(zones)
+	failed, ok := err.(zoneErrors)
+	if !ok || len(failed) != 2 || failed[0].Zone != "old.com" || failed[0].Err.Error() != "Invalid SOA settings" ||
+		failed[1].Zone != "&?\\/#@*^%bogus" {
+		t.Fatal("expected both failed zones to be reported", err)
+	}
+	config, _ := ioutil.ReadFile(filepath.Join(zoneDir, "zones.conf"))
+	if !strings.Contains(string(config), "name: a.com") || !strings.Contains(string(config), "name: old.com") || strings.Contains(string(config), "bogus") {
+		t.Error("expected zones.conf to hold the signed zones", string(config))
+	}
+	if current, _ := ioutil.ReadFile(filepath.Join(zoneDir, "old.com.txt.signed")); string(current) != string(signed) {
+		t.Error("expected the last good signed zone to be kept")
+	}
+}
+
+func TestWriteAndSignZone(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir}
+	filename := filepath.Join(zoneDir, "a.com.txt")
+	ioutil.WriteFile(filename, []byte("previous"), 0644)
+	if updated, err := w.writeAndSignZone(newSignableDomain("a.com"), &domainKeys{Domain: "a.com"}, false, time.Now()); err == nil || updated {
+		t.Fatal("expected signing to fail without keys", updated, err)
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != "previous" {
+		t.Error("expected the previous zone file to be put back", string(data))
+	}
+
+	os.Remove(filename)
+	if _, err := w.writeAndSignZone(newSignableDomain("a.com"), &domainKeys{Domain: "a.com"}, false, time.Now()); err == nil || fileExists(filename) {
+		t.Error("expected new zone file to be removed", err)
+	}
+
+	// zones with lint errors aren't written
+	zone := newSignableDomain("a.com")
+	zone.Add(newCNameRecord("a.com.", "b.com."))
+	if updated, err := w.writeAndSignZone(zone, &domainKeys{Domain: "a.com"}, true, time.Now()); err == nil || updated ||
+		!strings.Contains(err.Error(), "CNAME can't share its name") || fileExists(filename) {
+		t.Error("expected zone to be refused", updated, err)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir}
+	zone := &domain{Name: "a.com", sourceHash: "abc"}
+	if w.pinned(zone) {
+		t.Error("expected zone without a pin not to be pinned")
+	}
+	ioutil.WriteFile(w.pinPath("a.com"), []byte("abc\n"), 0644)
+	if !w.pinned(zone) {
+		t.Error("expected unchanged zone to be pinned")
+	}
+	w.DryRun, w.Force = true, true
+	if w.pinned(zone) || !fileExists(w.pinPath("a.com")) {
+		t.Error("expected pin to be ignored but kept in a forced dry run")
+	}
+	w.DryRun = false
+	if w.pinned(zone) || fileExists(w.pinPath("a.com")) {
+		t.Error("expected pin to be removed when forced")
+	}
+	ioutil.WriteFile(w.pinPath("a.com"), []byte("abc\n"), 0644)
+	w.Force = false
+	if w.pinned(&domain{Name: "a.com", sourceHash: "def"}) || fileExists(w.pinPath("a.com")) {
+		t.Error("expected pin to be removed once the zone changed")
+	}
+}
+
+func TestSignZones(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir, NsdDir: zoneDir, DNSSecKeyDir: zoneDir, SigningAlgorithm: "RSASHA256",
+		DefaultNameServers: "ns1.example.net."}
+	backend := newMockBackend([]domain{domain{ID: 1, Name: "a.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}}})
+	if err := w.SignZones(backend, []string{"b.com"}); err == nil {
+		t.Error("expected error due to unknown zone")
+	}
+	if err := w.SignZones(backend, []string{"a.com"}); err != nil {
+		t.Fatal("expected success", err)
+	}
+	config, _ := ioutil.ReadFile(filepath.Join(zoneDir, "zones.conf"))
+	if !fileExists(filepath.Join(zoneDir, "a.com.txt.signed")) || !strings.Contains(string(config), "name: a.com\n") {
+		t.Error("expected zone signed for the first time to be published", string(config))
+	}
+}
+
+func TestWriteZoneFailureKeepsKeys(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir, DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256"}
+	keys, _ := loadDomainKeys(keyDir, "a.com", testKeyPolicy())
+	keys.KSKRolloverRequested = true
+	keys.save()
+	zone := newSignableDomain("a.com")
+	zone.Add(newCNameRecord("a.com.", "b.com.")) // lint error
+	for i := 0; i < 2; i++ {
+		if _, err := w.writeZone(zone, testKeyPolicy(), signaturePolicy{Validity: signatureValidity}, nil); err == nil {
+			t.Fatal("expected lint error")
+		}
+	}
+	keys, _ = loadDomainKeys(keyDir, "a.com", testKeyPolicy())
+	files, _ := filepath.Glob(filepath.Join(keyDir, "*.private"))
+	if len(keys.Keys) != 3 || keys.KSKRolloverRequested || len(files) != 3 {
+		t.Error("expected the new KSK to be saved and reused", keys.Keys, files)
+	}
+}
+
+func TestGetZoneWorkers(t *testing.T) {
+	w := &dnsZoneWriter{}
+	if workers, err := w.GetZoneWorkers(); err != nil || workers != runtime.NumCPU() {
+		t.Error("expected a worker per CPU by default", workers, err)
+	}
+	w.ZoneWorkers = "4"
+	if workers, err := w.GetZoneWorkers(); err != nil || workers != 4 {
+		t.Error("expected configured workers", workers, err)
+	}
+	for _, value := range []string{"bogus", "0", "-1"} {
+		w.ZoneWorkers = value
+		if _, err := w.GetZoneWorkers(); err == nil {
+			t.Error("expected error", value)
+		}
+	}
+}
+
+func TestGetHistoryPolicy(t *testing.T) {
+	w := &dnsZoneWriter{}
+	if policy, err := w.GetHistoryPolicy(); err != nil || policy.Count != zoneHistoryCount || policy.MaxAge != zoneHistoryAge {
+		t.Error("expected built-in defaults", policy, err)
+	}
+	w = &dnsZoneWriter{ZoneHistoryCount: "10", ZoneHistoryDays: "30"}
+	if policy, err := w.GetHistoryPolicy(); err != nil || policy.Count != 10 || policy.MaxAge != 30*24*time.Hour {
+		t.Error("expected configured policy", policy, err)
+	}
+	for _, w := range []*dnsZoneWriter{&dnsZoneWriter{ZoneHistoryCount: "bogus"}, &dnsZoneWriter{ZoneHistoryDays: "bogus"},
+		&dnsZoneWriter{ZoneHistoryCount: "0"}, &dnsZoneWriter{ZoneHistoryDays: "0"}} {
+		if _, err := w.GetHistoryPolicy(); err == nil {
+			t.Error("expected error", w)
+		}
+	}
+}
+
+func TestGetDaemonPolicy(t *testing.T) {
+	w := &dnsZoneWriter{}
+	policy, err := w.GetDaemonPolicy()
+	if err != nil || policy.Interval != daemonInterval || policy.Debounce != daemonDebounce || policy.NameCacheLifetime != dynamicFQDNCacheLifetime {
+		t.Error("expected built-in defaults", err, policy)
+	}
+
+	w = &dnsZoneWriter{DaemonIntervalSeconds: "60", DaemonDebounceSeconds: "5", DynamicFQDNCacheSeconds: "0"}
+	policy, err = w.GetDaemonPolicy()
+	if err != nil || policy.Interval != time.Minute || policy.Debounce != 5*time.Second || policy.NameCacheLifetime != 0 {
+		t.Error("expected configured policy", err, policy)
+	}
+
+	for _, w := range []*dnsZoneWriter{&dnsZoneWriter{DaemonIntervalSeconds: "bogus"}, &dnsZoneWriter{DaemonDebounceSeconds: "bogus"},
+		&dnsZoneWriter{DynamicFQDNCacheSeconds: "bogus"}, &dnsZoneWriter{DaemonIntervalSeconds: "5"},
+		&dnsZoneWriter{SignatureRefreshDays: "bogus"}} {
+		if _, err := w.GetDaemonPolicy(); err == nil {
+			t.Error("expected error", w)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	setting := time.Minute
+	if err := parseDuration("", "days", "test", &setting); err != nil || setting != time.Minute {
+		t.Error("expected default to be kept", setting, err)
+	}
+	if err := parseDuration("2", "days", "test", &setting); err != nil || setting != 48*time.Hour {
+		t.Error("expected days", setting, err)
+	}
+	if err := parseDuration("3", "hours", "test", &setting); err != nil || setting != 3*time.Hour {
+		t.Error("expected hours", setting, err)
+	}
+	if err := parseDuration("bogus", "seconds", "test", &setting); err == nil || err.Error() != "Invalid test bogus. Expected number of seconds" || setting != 3*time.Hour {
+		t.Error("expected error and setting unchanged", setting, err)
+	}
+}
+
+func TestSignatureReport(t *testing.T) {
+	zoneDir := tempDir()
+	defer os.RemoveAll(zoneDir)
+	now := time.Now()
+	for domain, expiration := range map[string]time.Time{"a.com": now.Add(20 * 24 * time.Hour), "b.com": now.Add(24 * time.Hour), "c.com": now.Add(-time.Hour)} {
+		data := domain + `. 1800 IN RRSIG SOA 8 2 1800 ` + expiration.UTC().Format("20060102150405") + ` 20160921090003 27633 ` + domain + `. AAAA`
+		ioutil.WriteFile(filepath.Join(zoneDir, domain+".txt.signed"), []byte(data), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(zoneDir, "d.com.txt.signed"), []byte("bogus"), 0644)
+
+	w := &dnsZoneWriter{ZoneFileDirectory: zoneDir}
+	var out bytes.Buffer
+	problems, err := w.SignatureReport(&out, now)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if err != nil || problems != 3 || len(lines) != 5 || !strings.Contains(lines[1], "a.com") || !strings.HasSuffix(lines[1], "OK") ||
+		!strings.HasSuffix(lines[2], "RESIGN DUE") || !strings.HasSuffix(lines[3], "EXPIRED") || !strings.Contains(lines[4], "ERROR") {
+		t.Error("expected report of each zone", err, problems, out.String())
+	}
+
+	w = &dnsZoneWriter{SignatureValidityDays: "bogus"}
+	if _, err := w.SignatureReport(&out, now); err == nil {
+		t.Error("expected error due to invalid signature policy")
+	}
 }
 
 func TestIncludePostfixVirtualDomains(t *testing.T) {
@@ -122,10 +756,13 @@ func TestIncludePostfixVirtualDomains(t *testing.T) {
 }
 
 func TestWriteAll(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
 	// isMaster=true so restart
 	clean("testData/example2.com.txt*")
-	zones := []domain{domain{Name: "example2.com"}}
-	w := &dnsZoneWriter{IsMaster: true, ZoneFileDirectory: "testData", NsdDir: "testData"}
+	zones := []domain{newSignableDomain("example2.com")}
+	w := &dnsZoneWriter{IsMaster: true, ZoneFileDirectory: "testData", NsdDir: "testData", DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256"}
 	err := w.WriteAll(zones)
 	if err == nil {
 		t.Error("expected failure due to NSD restart")
@@ -133,8 +770,8 @@ func TestWriteAll(t *testing.T) {
 
 	// success - not master
 	clean("testData/example3.com.txt*")
-	zones = []domain{domain{Name: "example3.com"}}
-	w = &dnsZoneWriter{ZoneFileDirectory: "testData", NsdDir: "testData"}
+	zones = []domain{newSignableDomain("example3.com")}
+	w = &dnsZoneWriter{ZoneFileDirectory: "testData", NsdDir: "testData", DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256"}
 	err = w.WriteAll(zones)
 	if err != nil {
 		t.Error("expected success", err)
@@ -150,16 +787,72 @@ func TestWriteAll(t *testing.T) {
 		t.Error("expected error", err)
 	}
 
-	// bad zone directory
+	// signing fails
 	clean("testData/example4.com.txt*")
 	zones = []domain{domain{Name: "example4.com"}}
-	w = &dnsZoneWriter{NsdDir: "&?\\/#@*^%bogus", ZoneFileDirectory: "testData"}
+	err = w.WriteAll(zones)
+	if err == nil {
+		t.Error("expected error due to zone without SOA record", err)
+	}
+
+	// bad zone directory
+	clean("testData/example4.com.txt*")
+	zones = []domain{newSignableDomain("example4.com")}
+	w = &dnsZoneWriter{NsdDir: "&?\\/#@*^%bogus", ZoneFileDirectory: "testData", DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256"}
 	err = w.WriteAll(zones)
 	if err == nil {
 		t.Error("expected error", err)
 	}
 }
 
+func TestRollKSK(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	w := &dnsZoneWriter{DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256"}
+	if err := w.RollKSK("example.com"); err == nil || !strings.Contains(err.Error(), "No keys found") {
+		t.Error("expected error since the domain has no keys", err)
+	}
+	if err := w.ConfirmDS("example.com"); err == nil || !strings.Contains(err.Error(), "No keys found") {
+		t.Error("expected error since the domain has no keys", err)
+	}
+	if files, _ := ioutil.ReadDir(keyDir); len(files) != 0 {
+		t.Fatal("expected no keys to be created", files)
+	}
+
+	keys, _ := loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	keys.save()
+	if err := w.ConfirmDS("example.com"); err == nil {
+		t.Error("expected error since no rollover is in progress")
+	}
+	if err := w.RollKSK("example.com"); err != nil {
+		t.Fatal("expected success", err)
+	}
+	keys, _ = loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	if !keys.KSKRolloverRequested {
+		t.Error("expected rollover to be requested")
+	}
+
+	policy, _ := w.GetKeyPolicy()
+	keys.Update(policy, nil, time.Now())
+	keys.Update(policy, nil, time.Now().Add(policy.PropagationDelay)) // DS announced
+	keys.save()
+	if err := w.ConfirmDS("example.com"); err != nil {
+		t.Error("expected success", err)
+	}
+	keys, _ = loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	if len(keys.Keys) != 3 || keys.Keys[2].DSSeen.IsZero() {
+		t.Error("expected DS to be confirmed", keys.Keys)
+	}
+
+	w = &dnsZoneWriter{DNSSecKeyDir: keyDir, SigningAlgorithm: "RSASHA256", KeyPropagationDelayHours: "bogus"}
+	if err := w.RollKSK("example.com"); err == nil {
+		t.Error("expected error due to invalid key policy")
+	}
+	if err := w.ConfirmDS("example.com"); err == nil {
+		t.Error("expected error due to invalid key policy")
+	}
+}
+
 func TestReloadNsdServer(t *testing.T) {
 	command.SetMock(&command.MockShellCmd{})
 	err := reloadNsdServer()
@@ -170,17 +863,17 @@ func TestReloadNsdServer(t *testing.T) {
 
 func TestGetSigningKeyPrefixes(t *testing.T) {
 	command.SetMock(&command.MockShellCmd{OutputVal: []byte("keygenOutput")})
-	ksk, zsk, err := getSigningKeyPrefixes("example.com", "ALG", "testData")
+	ksk, zsk, err := getSigningKeyPrefixes("example.com", "testData", keyPolicy{Algorithm: "ALG"})
 	if err != nil || !strings.HasSuffix(zsk, "example.com.ALG.ZSK") || !strings.HasSuffix(ksk, "example.com.ALG.KSK") {
 		t.Error("expected success", err, ksk, zsk)
 	}
 
-	ksk, zsk, err = getSigningKeyPrefixes("example1.com", "ALG", "testData")
+	ksk, zsk, err = getSigningKeyPrefixes("example1.com", "testData", keyPolicy{Algorithm: "ALG"})
 	if err == nil {
 		t.Error("expected failure on create of ZSK files")
 	}
 
-	_, _, err = getSigningKeyPrefixes("example.com", "RSA", ".")
+	_, _, err = getSigningKeyPrefixes("example.com", ".", keyPolicy{Algorithm: "RSA"})
 	if err == nil {
 		t.Error("expected failure")
 	}
@@ -200,26 +893,19 @@ func TestKeysExist(t *testing.T) {
 	}
 }
 
-func TestRenameKeyFiles(t *testing.T) {
-	ioutil.WriteFile("testData/generated12345.ds", []byte{}, 0644)
-	ioutil.WriteFile("testData/generated12345.key", []byte{}, 0644)
-	ioutil.WriteFile("testData/generated12345.private", []byte{}, 0644)
-	os.Remove("testData/example4.com.ALG.KSK.ds")
-	os.Remove("testData/example4.com.ALG.KSK.key")
-	os.Remove("testData/example4.com.ALG.KSK.private")
-	err := renameKeyFiles("testData", "generated12345", "example4.com", "ALG", "KSK")
-	if err != nil {
-		t.Error("expected success", err)
+func TestCreateSigningKeys(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	if err := createSigningKeys(keyDir, "example.com", "ZSK", testKeyPolicy()); err != nil {
+		t.Fatal("expected success", err)
 	}
-
-	err = renameKeyFiles("testData", "example3.com.ALG.KSK", "example3.com", "ALG", "KSK")
-	if err == nil {
-		t.Error("expected error due to example3.com.ALG.KSK.ds being missing")
+	key, err := readSigningKey(filepath.Join(keyDir, "example.com.RSASHA256.ZSK"))
+	if err != nil || key.DNSKEY.Flags != 256 || !keysExist(filepath.Join(keyDir, "example.com.RSASHA256.ZSK")) {
+		t.Error("expected ZSK to be created", err, key)
 	}
 
-	err = renameKeyFiles("testData", "example2.com.ALG.KSK", "example2.com", "ALG", "KSK")
-	if err == nil {
-		t.Error("expected error due to example2.com.ALG.KSK.key being missing")
+	if err := createSigningKeys(keyDir, "example.com", "KSK", keyPolicy{Algorithm: "ALG"}); err == nil {
+		t.Error("expected error due to unknown algorithm")
 	}
 }
 
@@ -233,6 +919,22 @@ func clean(searchglob string) {
 	}
 }
 
+func tempDir() string {
+	dir, _ := ioutil.TempDir("", "dnsZoneWriter")
+	return dir
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func newSignableDomain(name string) domain {
+	d := domain{Name: name, ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}}}
+	d.BuildDNSRecords("bogus", "bogus", &zoneTemplate{NameServers: "ns1.example.net."})
+	return d
+}
+
 /********************** MOCKS ***********************/
 func newMockIPAddresser(ipAddress string, err error) *mockIPAddresser {
 	return &mockIPAddresser{Addresses: []string{ipAddress}, Err: err}
@@ -249,9 +951,16 @@ func (a *mockIPAddresser) GetIPAddresses() ([]string, error) {
 }
 
 type mockBackend struct {
-	domains         []domain
-	getDomainsErr   error
-	createSchemaErr error
+	domains          []domain
+	ptrRecords       []ptrRecord
+	templates        []zoneTemplate
+	getDomainsErr    error
+	getPTRRecordsErr error
+	getTemplatesErr  error
+	createSchemaErr  error
+	imported         *backupData
+	importErr        error
+	closed           bool
 }
 
 func newMockBackend(domains []domain) *mockBackend {
@@ -263,5 +972,23 @@ func (b *mockBackend) CreateSchema() error {
 }
 
 func (b *mockBackend) GetDomains() ([]domain, error) {
-	return b.domains, b.getDomainsErr
+	return append([]domain{}, b.domains...), b.getDomainsErr
+}
+
+func (b *mockBackend) GetPTRRecords() ([]ptrRecord, error) {
+	return b.ptrRecords, b.getPTRRecordsErr
+}
+
+func (b *mockBackend) GetTemplates() ([]zoneTemplate, error) {
+	return b.templates, b.getTemplatesErr
+}
+
+func (b *mockBackend) Import(data *backupData) error {
+	b.imported = data
+	return b.importErr
+}
+
+func (b *mockBackend) Close() error {
+	b.closed = true
+	return nil
 }
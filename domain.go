@@ -4,16 +4,18 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/robarchibald/command"
 )
 
@@ -24,12 +26,24 @@ const expire time.Duration = 24 * 7 * 2 * time.Hour // 2 weeks
 const negativeTTL time.Duration = 30 * time.Minute
 const hostmaster string = "hostmaster"
 
-var nameToIP = make(map[string]string)
+// dynamic FQDN lookups shared by every zone. Guarded by nameCacheLock since zones are built in parallel
+var nameToIP = make(map[string][]string)
+var nameResolved = make(map[string]time.Time)
+var nameCacheLock sync.Mutex
+
+type soaSettings struct {
+	Refresh     time.Duration
+	Retry       time.Duration
+	Expire      time.Duration
+	NegativeTTL time.Duration
+	Hostmaster  string
+}
 
 type domain struct {
 	ID           int16
 	Name         string
 	DefaultTTL   time.Duration
+	SOA          soaSettings
 	DNSRecords   []dnsRecord
 	ARecords     []aRecord
 	CNameRecords []cnameRecord
@@ -40,42 +54,69 @@ type domain struct {
 	SPFRecords   []spfRecord
 	SRVRecords   []srvRecord
 	TXTRecords   []txtRecord
+	CAARecords   []caaRecord
+	TemplateID   int16
+	PublishCDS   bool // publish CDS and CDNSKEY records for the active KSK
+	DNSSECDelete bool // publish the CDS and CDNSKEY delete signal so the parent removes the DS
+	Denial       denialSettings
 	hasDMARC     map[string]bool
 	hasSPF       map[string]bool
+	dmarcReport  string
+	template     *zoneTemplate
+	inputHash    string // hash of the inputs the zone is built from. Empty if it's rebuilt on every run
+	sourceHash   string // hash of the inputs even if the zone is rebuilt on every run. Tells whether a rolled back zone changed
+	deferred     bool   // records not built yet since the inputs haven't changed
+	err          error  // why the zone couldn't be built or written. Its last good zone file is kept
 }
 
-func (d *domain) BuildDNSRecords(dkimKeyFilePath string, sslCertificatePath string) {
+func (d *domain) BuildDNSRecords(dkimKeyFilePath string, sslCertificatePath string, template *zoneTemplate) error {
 	d.hasDMARC = make(map[string]bool)
 	d.hasSPF = make(map[string]bool)
-	d.DefaultTTL = defaultTTL
+	d.dmarcReport = template.DMARCReportAddress
+	if d.DefaultTTL == 0 {
+		d.DefaultTTL = defaultTTL
+	}
+	d.SOA = d.SOA.withDefaults(getDefaultSOA())
+	if err := d.getDefaults(template); err != nil {
+		return err
+	}
+	if len(d.NsRecords) == 0 {
+		return errors.New("No name servers found for " + d.Name)
+	}
+	tlsaPorts, err := template.getTLSAPorts()
+	if err != nil {
+		return err
+	}
 	dkimValue := getDkimValue(dkimKeyFilePath)
-	tlsaKey := getTlsaKey(sslCertificatePath)
 
-	d.getDefaults()
-	d.Add(newSoaRecord(d.Name, d.NsRecords[0].Value, hostmaster, refresh, retry, expire, negativeTTL))
-	d.Add(newTlsaRecord(25, tlsaKey))
-	d.Add(newTlsaRecord(443, tlsaKey))
+	d.Add(newSoaRecord(d.Name, d.NsRecords[0].Value, d.SOA.Hostmaster, d.SOA.Refresh, d.SOA.Retry, d.SOA.Expire, d.SOA.NegativeTTL))
+	if len(tlsaPorts) > 0 {
+		tlsaKey := getTlsaKey(sslCertificatePath)
+		for _, port := range tlsaPorts {
+			d.Add(newTlsaRecord(port, tlsaKey))
+		}
+	}
 	d.Add(newDkimRecord("", dkimValue))
 
 	for _, nameServer := range d.NsRecords {
-		d.Add(newNsRecord(d.Name, nameServer.Name, nameServer.Value))
+		d.Add(newNsRecord(d.Name, nameServer.Name, nameServer.Value).withTTL(nameServer.TTL))
 	}
 	for _, mailServer := range d.MxRecords {
-		d.Add(newMxRecord(d.Name, mailServer.Name, mailServer.Value, mailServer.Priority))
+		d.Add(newMxRecord(d.Name, mailServer.Name, mailServer.Value, mailServer.Priority).withTTL(mailServer.TTL))
 	}
 	for _, spf := range d.SPFRecords {
-		d.AddSPFRecord(spf.Name, spf.Value)
+		d.AddSPFRecord(spf.Name, spf.Value, spf.TTL)
 	}
 	for _, mailServer := range d.MxRecords {
 		if strings.HasSuffix(mailServer.Value, d.Name+".") || !strings.HasSuffix(mailServer.Value, ".") {
-			d.AddSPFRecord(mailServer.Value, "a") // add default policy for my mail servers if not explicitly specified
+			d.AddSPFRecord(mailServer.Value, "a", 0) // add default policy for my mail servers if not explicitly specified
 		}
 	}
 	for _, dkim := range d.DKIMRecords {
-		d.Add(newDkimRecord(dkim.Name, dkim.Value))
+		d.Add(newDkimRecord(dkim.Name, dkim.Value).withTTL(dkim.TTL))
 	}
 	for _, dmarc := range d.DMARCRecords {
-		d.AddDMARCRecord(dmarc.Name, dmarc.Value)
+		d.AddDMARCRecord(dmarc.Name, dmarc.Value, dmarc.TTL)
 	}
 
 	for _, server := range d.ARecords {
@@ -83,87 +124,202 @@ func (d *domain) BuildDNSRecords(dkimKeyFilePath string, sslCertificatePath stri
 		if server.Name == "" {
 			name = d.Name + "."
 		}
-		d.AddARecord(name, server.IPAddress, server.DynamicFQDN)
-		d.AddDMARCRecord(name, "reject") // reject if not specified earlier
-		d.AddSPFRecord(server.Name, "")  // reject all mail
+		d.AddARecord(name, server.IPAddress, server.DynamicFQDN, server.TTL)
+		d.AddDMARCRecord(name, "reject", 0) // reject if not specified earlier
+		d.AddSPFRecord(server.Name, "", 0)  // reject all mail
 	}
 	for _, cname := range d.CNameRecords {
-		d.Add(newCNameRecord(cname.Name, cname.CanonicalName))
+		d.Add(newCNameRecord(cname.Name, cname.CanonicalName).withTTL(cname.TTL))
 	}
+	for _, srv := range d.SRVRecords {
+		d.Add(newSrvRecord(d.Name, srv.Service, srv.Protocol, srv.Priority, srv.Weight, srv.Port, srv.Target).withTTL(srv.TTL))
+	}
+	for _, txt := range d.TXTRecords {
+		d.Add(newTxtRecord(d.Name, txt.Name, txt.Value).withTTL(txt.TTL))
+	}
+	for _, caa := range d.CAARecords {
+		d.Add(newCaaRecord(d.Name, caa.Name, caa.Flags, caa.Tag, caa.Value).withTTL(caa.TTL))
+	}
+	return nil
 }
 
-func (d *domain) getDefaults() {
-	if len(d.NsRecords) == 0 {
-		d.NsRecords = getDefaultNs()
+// AddCDSRecords adds the CDS and CDNSKEY records (RFC 7344) for the KSK with the given key file prefix
+// or the delete signal (RFC 8078) if the domain is being taken unsigned
+func (d *domain) AddCDSRecords(kskPrefix string) error {
+	if d.DNSSECDelete {
+		d.Add(newCdsRecord(d.Name, 0, 0, 0, "00"))
+		d.Add(newCdnskeyRecord(d.Name, 0, 3, 0, "AA=="))
+		return nil
 	}
-	if len(d.MxRecords) == 0 {
-		d.MxRecords = getDefaultMx()
+	dnskey, err := readDNSKEY(kskPrefix)
+	if err != nil {
+		return err
 	}
-	if len(d.SPFRecords) == 0 {
-		d.SPFRecords = getDefaultSPF()
+	data, err := ioutil.ReadFile(kskPrefix + ".ds")
+	if err != nil {
+		return err
 	}
-	if len(d.DMARCRecords) == 0 {
-		d.DMARCRecords = getDefaultDMARC(d.Name)
+	rr, err := dns.NewRR(string(data))
+	if err != nil {
+		return errors.New("Unable to parse DS file " + kskPrefix + ".ds " + err.Error())
+	}
+	ds, ok := rr.(*dns.DS)
+	if !ok {
+		return errors.New("DS file " + kskPrefix + ".ds doesn't contain a DS record")
+	}
+	d.Add(newCdsRecord(d.Name, ds.KeyTag, ds.Algorithm, ds.DigestType, ds.Digest))
+	d.Add(newCdnskeyRecord(d.Name, dnskey.Flags, dnskey.Protocol, dnskey.Algorithm, dnskey.PublicKey))
+	return nil
+}
+
+// withDefaults fills any SOA setting that isn't set for the domain from defaults
+func (s soaSettings) withDefaults(defaults soaSettings) soaSettings {
+	if s.Refresh == 0 {
+		s.Refresh = defaults.Refresh
+	}
+	if s.Retry == 0 {
+		s.Retry = defaults.Retry
+	}
+	if s.Expire == 0 {
+		s.Expire = defaults.Expire
 	}
+	if s.NegativeTTL == 0 {
+		s.NegativeTTL = defaults.NegativeTTL
+	}
+	if s.Hostmaster == "" {
+		s.Hostmaster = defaults.Hostmaster
+	}
+	return s
 }
 
-func getDefaultMx() []mxRecord {
-	return []mxRecord{mxRecord{Name: "", Value: "mail1.endfirst.com.", Priority: 10}, mxRecord{Name: "", Value: "mail2.endfirst.com.", Priority: 20}}
+// validate checks that the SOA timers make sense together
+func (s soaSettings) validate() error {
+	if s.Refresh <= 0 || s.Retry <= 0 || s.Expire <= 0 || s.NegativeTTL <= 0 {
+		return errors.New("SOA refresh, retry, expire and negative TTL must all be greater than zero")
+	}
+	if s.Retry >= s.Refresh {
+		return fmt.Errorf("SOA retry (%v) must be less than refresh (%v)", s.Retry, s.Refresh)
+	}
+	if s.Expire <= s.Refresh {
+		return fmt.Errorf("SOA expire (%v) must be greater than refresh (%v)", s.Expire, s.Refresh)
+	}
+	if s.Hostmaster == "" {
+		return errors.New("SOA hostmaster must be set")
+	}
+	return nil
 }
 
-func getDefaultNs() []nsRecord {
-	return []nsRecord{nsRecord{Name: "", Value: "ns1.endfirst.com.", SortOrder: 1}, nsRecord{Name: "", Value: "ns2.endfirst.com.", SortOrder: 1}}
+func getDefaultSOA() soaSettings {
+	return soaSettings{Refresh: refresh, Retry: retry, Expire: expire, NegativeTTL: negativeTTL, Hostmaster: hostmaster}
 }
 
-func getDefaultSPF() []spfRecord {
-	return []spfRecord{spfRecord{Name: "", Value: "include:_spf.endfirst.com"}}
+func (d *domain) getDefaults(template *zoneTemplate) error {
+	if len(d.NsRecords) == 0 {
+		d.NsRecords = template.getNsRecords()
+	}
+	if len(d.MxRecords) == 0 {
+		mx, err := template.getMxRecords()
+		if err != nil {
+			return err
+		}
+		d.MxRecords = mx
+	}
+	if len(d.SPFRecords) == 0 {
+		d.SPFRecords = template.getSPFRecords()
+	}
+	if len(d.DMARCRecords) == 0 {
+		d.DMARCRecords = template.getDMARCRecords(d.Name)
+	}
+	if len(d.CAARecords) == 0 {
+		d.CAARecords = template.getCAARecords()
+	}
+	return nil
 }
 
-func getDefaultDMARC(domain string) []dmarcRecord {
-	return []dmarcRecord{dmarcRecord{Name: domain + ".", Value: "quarantine"}}
+// getDefaultCAA allows the space separated list of CAs to issue certificates for the domain.
+// Let's Encrypt is used if no issuers are configured
+func getDefaultCAA(issuers string) []caaRecord {
+	caa := []caaRecord{}
+	for _, issuer := range strings.Fields(issuers) {
+		caa = append(caa, caaRecord{Name: "", Flags: 0, Tag: "issue", Value: issuer})
+	}
+	if len(caa) == 0 {
+		caa = append(caa, caaRecord{Name: "", Flags: 0, Tag: "issue", Value: "letsencrypt.org"})
+	}
+	return caa
 }
 
 func (d *domain) Add(record *dnsRecord) {
 	d.DNSRecords = append(d.DNSRecords, *record)
 }
 
-func (d *domain) AddARecord(name, ipAddress, dynamicFqdn string) {
-	ip := getIP(ipAddress, dynamicFqdn)
-	if ip != "" {
-		d.Add(newARecord(name, ip))
+func (d *domain) AddARecord(name, ipAddress, dynamicFqdn string, ttl int32) {
+	for _, ip := range getIPs(ipAddress, dynamicFqdn) {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			fmt.Println("Skipping invalid IP address: ", name, ip)
+		} else if parsed.To4() != nil {
+			d.Add(newARecord(name, parsed.String()).withTTL(ttl))
+		} else {
+			d.Add(newAAAARecord(name, parsed.String()).withTTL(ttl))
+		}
 	}
 }
 
-func (d *domain) AddSPFRecord(name, allow string) {
+func (d *domain) AddSPFRecord(name, allow string, ttl int32) {
 	if !d.hasSPF[name] {
-		d.Add(newSpfRecord(d.Name, name, allow))
+		d.Add(newSpfRecord(d.Name, name, allow).withTTL(ttl))
 		d.hasSPF[name] = true
 	}
 }
 
-func (d *domain) AddDMARCRecord(name, policy string) {
+func (d *domain) AddDMARCRecord(name, policy string, ttl int32) {
 	if !d.hasDMARC[name] {
-		d.Add(newDmarcRecord(name, policy))
+		d.Add(newDmarcRecord(name, policy, d.dmarcReport).withTTL(ttl))
 		d.hasDMARC[name] = true
 	}
 }
 
-func getIP(ipAddress, dynamicFqdn string) string {
+// getIPs returns the static IP address if there is one, otherwise every IPv4 and IPv6
+// address the dynamic FQDN resolves to, sorted so that zone output is stable between runs
+func getIPs(ipAddress, dynamicFqdn string) []string {
 	if ipAddress != "" {
-		return ipAddress
+		return []string{ipAddress}
 	}
 
-	savedIP := nameToIP[dynamicFqdn]
-	if savedIP != "" {
-		return savedIP
+	nameCacheLock.Lock()
+	savedIPs := nameToIP[dynamicFqdn]
+	nameCacheLock.Unlock()
+	if len(savedIPs) != 0 {
+		return savedIPs
 	}
 
-	resolvedIP, _ := net.LookupIP(dynamicFqdn)
-	if len(resolvedIP) == 0 {
-		return ""
+	resolvedIPs, _ := net.LookupIP(dynamicFqdn)
+	if len(resolvedIPs) == 0 {
+		return nil
+	}
+	ips := make([]string, len(resolvedIPs))
+	for i := range resolvedIPs {
+		ips[i] = resolvedIPs[i].String()
+	}
+	sort.Strings(ips)
+	nameCacheLock.Lock()
+	nameToIP[dynamicFqdn] = ips
+	nameResolved[dynamicFqdn] = time.Now()
+	nameCacheLock.Unlock()
+	return ips
+}
+
+// expireNameCache forgets dynamic FQDN lookups older than lifetime so address changes are picked up
+func expireNameCache(now time.Time, lifetime time.Duration) {
+	nameCacheLock.Lock()
+	defer nameCacheLock.Unlock()
+	for name, resolved := range nameResolved {
+		if now.Sub(resolved) >= lifetime {
+			delete(nameToIP, name)
+			delete(nameResolved, name)
+		}
 	}
-	nameToIP[dynamicFqdn] = resolvedIP[0].String()
-	return nameToIP[dynamicFqdn]
 }
 
 func getTlsaKey(filePath string) string {
@@ -197,75 +353,68 @@ func (d *domain) String(serialNumber string) string {
 	return strings.Replace(buffer.String(), "SERIALNUMBER", serialNumber, 1)
 }
 
-func (d *domain) WriteZone(folder string) (bool, error) {
+// WriteZone writes the zone with a new serial number if it changed or force is set (e.g. because
+// the signing keys changed or the signatures are about to expire)
+func (d *domain) WriteZone(folder string, force bool) (bool, error) {
 	filename := filepath.Join(folder, d.Name+".txt")
-	currentZone, currentSerialNumber := getFileMatch(filename, `SOA.*\((\d*)`)
-
-	_, expiration := getFileMatch(filename+".signed", `\sRRSIG\s+SOA\s+\d+\s+\d+\s\d+\s+(\d{14})`)
-	expireDate, err := time.Parse("20060102000000", expiration)
-	if err != nil {
-		expireDate = time.Now()
-	}
-
-	newSerialNumber := time.Now().Format("2006010200")
-	if currentZone == "" || currentZone != d.String(currentSerialNumber) || expireDate.AddDate(0, 0, -3).Before(time.Now()) {
-		newSerialNumber = getSerialNumberRevision(currentSerialNumber, newSerialNumber)
-
-		err := ioutil.WriteFile(filename, []byte(d.String(newSerialNumber)), 0644)
+	if _, newZone := d.PendingZone(folder, force); newZone != "" {
+		err := writeFileAtomic(filename, []byte(newZone), 0644)
 		if err != nil {
 			return false, err
 		}
-		copyTo := fmt.Sprintf("%s_%s", filename, time.Now().Format("20060102-150405"))
-		err = copyFileContents(filename, copyTo)
-		fmt.Println("Updated: ", filename, err)
-		cleanup(filename+"_*", 336) // 2 weeks
+		fmt.Println("Updated: ", filename)
 		return true, nil
 	}
 	return false, nil
 }
 
-func cleanup(searchglob string, hoursToKeep int) {
-	matches, _ := filepath.Glob(searchglob)
-	now := time.Now()
-	for _, file := range matches {
-		info, err := os.Stat(file)
-		if err == nil && now.Sub(info.ModTime()) > time.Hour*time.Duration(hoursToKeep) {
-			os.Remove(file)
-		}
+// PendingZone returns the current zone file and the zone that WriteZone would write. The new zone
+// is empty if the zone is unchanged and not forced
+func (d *domain) PendingZone(folder string, force bool) (currentZone string, newZone string) {
+	currentZone, currentSerialNumber := getFileMatch(filepath.Join(folder, d.Name+".txt"), `SOA.*\((\d*)`)
+	if force || currentZone == "" || currentZone != d.String(currentSerialNumber) {
+		newSerialNumber := getSerialNumberRevision(currentSerialNumber, time.Now().Format("2006010200"))
+		return currentZone, d.String(newSerialNumber)
 	}
+	return currentZone, ""
 }
 
-func copyFileContents(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
+func (d *domain) hasDynamicRecords() bool {
+	for _, server := range d.ARecords {
+		if server.DynamicFQDN != "" {
+			return true
+		}
 	}
-	defer in.Close()
-	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0400)
-	if err != nil {
-		return err
+	return false
+}
+
+// savedInputHash returns the input hash saved when the zone was last written and signed or an empty
+// string if the zone file is missing
+func (d *domain) savedInputHash(folder string) string {
+	if _, err := os.Stat(filepath.Join(folder, d.Name+".txt")); err != nil {
+		return ""
 	}
-	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
-		}
-	}()
-	io.Copy(out, in)
-	err = out.Sync()
-	return err
+	data, _ := ioutil.ReadFile(filepath.Join(folder, d.Name+".txt.sha256"))
+	return strings.TrimSpace(string(data))
 }
 
-func (d *domain) SignZone(zoneDir string, keyDir string, signingAlgorithm string) error {
-	date := time.Now().Add(time.Hour * 24 * 30).Format("20060102") // add 30 days to current time
-	kskFile, zskFile, err := getSigningKeyPrefixes(d.Name, signingAlgorithm, keyDir)
-	if err != nil {
-		return err
+func (d *domain) saveInputHash(folder string) error {
+	if d.inputHash == "" {
+		return nil
 	}
-	cmd := command.Command("/usr/bin/ldns-signzone", "-e", date, "-n", filepath.Join(zoneDir, d.Name+".txt"), kskFile, zskFile)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return errors.New("Error signing zone: " + err.Error() + " " + string(output))
+	return writeFileAtomic(filepath.Join(folder, d.Name+".txt.sha256"), []byte(d.inputHash+"\n"), 0644)
+}
+
+// NeedsResign reports whether the earliest signature in the signed zone expires within the refresh
+// window. A missing or unreadable signed zone always needs signing
+func (d *domain) NeedsResign(folder string, policy signaturePolicy, now time.Time) bool {
+	sig, err := earliestSignature(filepath.Join(folder, d.Name+".txt.signed"))
+	return err != nil || policy.needsRefresh(signatureExpiry(sig), now)
+}
+
+func (d *domain) SignZone(zoneDir string, keys *zoneKeys, expiration time.Time) error {
+	if err := signZoneFile(filepath.Join(zoneDir, d.Name+".txt"), d.Name, keys, d.Denial, expiration); err != nil {
+		return errors.New("Error signing zone: " + err.Error())
 	}
 	return nil
 }
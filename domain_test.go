@@ -1,9 +1,10 @@
 package main
 
 import (
-	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,17 +17,158 @@ func TestBuildDnsRecords(t *testing.T) {
 		NsRecords:    []nsRecord{nsRecord{Name: "ns1"}},
 		MxRecords:    []mxRecord{mxRecord{Name: "mail1", Priority: 10}},
 		ARecords:     []aRecord{aRecord{Name: "", IPAddress: ipAddress}, aRecord{Name: "server", IPAddress: ipAddress}},
-		CNameRecords: []cnameRecord{cnameRecord{Name: "cname", CanonicalName: "cname.example.com"}}}
-	d.BuildDNSRecords("mail.txt", "ssl_certificate.pem")
-	if len(d.DNSRecords) != 13 || d.DNSRecords[0].RecordType != "SOA" || d.DNSRecords[1].RecordType != "TLSA" || d.DNSRecords[2].RecordType != "TLSA" ||
+		CNameRecords: []cnameRecord{cnameRecord{Name: "cname", CanonicalName: "cname.example.com"}},
+		SRVRecords:   []srvRecord{srvRecord{Service: "xmpp-client", Protocol: "tcp", Priority: 5, Port: 5222, Target: "xmpp"}},
+		TXTRecords:   []txtRecord{txtRecord{Name: "", Value: "google-site-verification=abc123"}}}
+	d.BuildDNSRecords("mail.txt", "ssl_certificate.pem", newTestTemplate())
+	if len(d.DNSRecords) != 16 || d.DNSRecords[0].RecordType != "SOA" || d.DNSRecords[1].RecordType != "TLSA" || d.DNSRecords[2].RecordType != "TLSA" ||
 		d.DNSRecords[3].Name != "mail._domainkey" || d.DNSRecords[4].RecordType != "NS" || d.DNSRecords[5].RecordType != "MX" ||
-		d.DNSRecords[6].Data != "\"v=spf1 include:_spf.endfirst.com -all\"" || d.DNSRecords[7].Name != "_dmarc.example.com." ||
+		d.DNSRecords[6].Data != "\"v=spf1 include:_spf.example.net -all\"" || d.DNSRecords[7].Name != "_dmarc.example.com." ||
 		d.DNSRecords[8].RecordType != "A" || d.DNSRecords[9].RecordType != "A" ||
-		d.DNSRecords[10].Name != "_dmarc.server" || d.DNSRecords[11].Data != "\"v=spf1  -all\"" || d.DNSRecords[12].RecordType != "CNAME" {
+		d.DNSRecords[10].Name != "_dmarc.server" || d.DNSRecords[11].Data != "\"v=spf1  -all\"" || d.DNSRecords[12].RecordType != "CNAME" ||
+		d.DNSRecords[13].Name != "_xmpp-client._tcp.example.com." || d.DNSRecords[13].Data != "5 0 5222 xmpp.example.com." ||
+		d.DNSRecords[14].Name != "example.com." || d.DNSRecords[14].Data != "\"google-site-verification=abc123\"" ||
+		d.DNSRecords[15].RecordType != "CAA" || d.DNSRecords[15].Data != "0 issue \"letsencrypt.org\"" {
 		for _, record := range d.DNSRecords {
 			t.Log(record.RecordType, record.Name, record.Data)
 		}
-		t.Fatalf("expected 13 dns records with specific values. Actually have %d", len(d.DNSRecords))
+		t.Fatalf("expected 16 dns records with specific values. Actually have %d", len(d.DNSRecords))
+	}
+}
+
+func TestBuildDnsRecordsTTL(t *testing.T) {
+	d := &domain{Name: "example.com", DefaultTTL: time.Hour,
+		NsRecords: []nsRecord{nsRecord{Value: "ns1", TTL: 86400}},
+		MxRecords: []mxRecord{mxRecord{Value: "mail1", Priority: 10, TTL: 3600}},
+		ARecords:  []aRecord{aRecord{Name: "server", IPAddress: "123.45.67.89", TTL: 60}}}
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
+	if d.DefaultTTL != time.Hour || d.DNSRecords[0].TTL != "" || d.DNSRecords[4].RecordType != "NS" || d.DNSRecords[4].TTL != "86400" ||
+		d.DNSRecords[5].RecordType != "MX" || d.DNSRecords[5].TTL != "3600" || d.DNSRecords[9].RecordType != "A" || d.DNSRecords[9].TTL != "60" {
+		for _, record := range d.DNSRecords {
+			t.Log(record.RecordType, record.Name, record.TTL)
+		}
+		t.Fatal("expected record TTLs to be carried through")
+	}
+
+	d = &domain{Name: "example.com"}
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
+	if d.DefaultTTL != defaultTTL {
+		t.Error("expected default TTL", d.DefaultTTL)
+	}
+}
+
+func TestSOASettings(t *testing.T) {
+	defaults := getDefaultSOA()
+	soa := soaSettings{Expire: 4 * 7 * 24 * time.Hour, Hostmaster: "dns@example.com"}.withDefaults(defaults)
+	if soa.Refresh != refresh || soa.Retry != retry || soa.Expire != 4*7*24*time.Hour || soa.NegativeTTL != negativeTTL || soa.Hostmaster != "dns@example.com" {
+		t.Error("expected domain settings merged with defaults", soa)
+	}
+	if err := soa.validate(); err != nil {
+		t.Error("expected valid settings", err)
+	}
+
+	if err := (soaSettings{Refresh: time.Hour, Retry: time.Hour, Expire: 2 * time.Hour, NegativeTTL: time.Hour, Hostmaster: "h"}).validate(); err == nil {
+		t.Error("expected error since retry isn't less than refresh")
+	}
+	if err := (soaSettings{Refresh: time.Hour, Retry: time.Minute, Expire: time.Hour, NegativeTTL: time.Hour, Hostmaster: "h"}).validate(); err == nil {
+		t.Error("expected error since expire isn't greater than refresh")
+	}
+	if err := (soaSettings{Refresh: time.Hour, Retry: time.Minute, Expire: 2 * time.Hour, Hostmaster: "h"}).validate(); err == nil {
+		t.Error("expected error since negative TTL is missing")
+	}
+	if err := (soaSettings{Refresh: time.Hour, Retry: time.Minute, Expire: 2 * time.Hour, NegativeTTL: time.Hour}).validate(); err == nil {
+		t.Error("expected error since hostmaster is missing")
+	}
+}
+
+func TestBuildDnsRecordsSOA(t *testing.T) {
+	d := &domain{Name: "example.com", SOA: soaSettings{Expire: 28 * 24 * time.Hour, Hostmaster: "dns.admin@example.net"}}
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
+	if d.DNSRecords[0].Data != `ns1.example.net. dns\.admin.example.net. (SERIALNUMBER 7200 1800 2419200 1800)` {
+		t.Error("expected per domain SOA settings", d.DNSRecords[0].Data)
+	}
+}
+
+func TestBuildDnsRecordsTemplate(t *testing.T) {
+	template := &zoneTemplate{NameServers: "ns1.example.org.", TLSAPorts: "443"}
+	d := &domain{Name: "example.com"}
+	err := d.BuildDNSRecords("bogus", "bogus", template)
+	if err != nil || len(d.DNSRecords) != 5 || d.DNSRecords[0].Data != "ns1.example.org. hostmaster.example.com. (SERIALNUMBER 7200 1800 1209600 1800)" ||
+		d.DNSRecords[1].Name != "_443._tcp" || d.DNSRecords[2].Name != "mail._domainkey" || d.DNSRecords[3].RecordType != "NS" || d.DNSRecords[4].RecordType != "CAA" {
+		for _, record := range d.DNSRecords {
+			t.Log(record.RecordType, record.Name, record.Data)
+		}
+		t.Fatal("expected only the records in the template", err)
+	}
+
+	d = &domain{Name: "example.com"}
+	if err := d.BuildDNSRecords("bogus", "bogus", &zoneTemplate{}); err == nil {
+		t.Error("expected error due to missing name servers")
+	}
+
+	d = &domain{Name: "example.com"}
+	if err := d.BuildDNSRecords("bogus", "bogus", &zoneTemplate{NameServers: "ns1", MailServers: "bogus"}); err == nil {
+		t.Error("expected error due to invalid mail servers")
+	}
+
+	d = &domain{Name: "example.com"}
+	if err := d.BuildDNSRecords("bogus", "bogus", &zoneTemplate{NameServers: "ns1", TLSAPorts: "bogus"}); err == nil {
+		t.Error("expected error due to invalid TLSA ports")
+	}
+}
+
+func TestAddCDSRecords(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	newTestSigningKeys(t, keyDir)
+	prefix := filepath.Join(keyDir, "example.com.RSASHA256.KSK")
+	d := &domain{Name: "example.com", PublishCDS: true}
+	if err := d.AddCDSRecords(prefix); err != nil || len(d.DNSRecords) != 2 ||
+		d.DNSRecords[0].RecordType != "CDS" || !strings.HasPrefix(d.DNSRecords[1].Data, "257 3 8 ") {
+		t.Error("expected CDS and CDNSKEY records", err, d.DNSRecords)
+	}
+
+	d = &domain{Name: "example.com", PublishCDS: true, DNSSECDelete: true}
+	if err := d.AddCDSRecords(""); err != nil || len(d.DNSRecords) != 2 || d.DNSRecords[0].Data != "0 0 0 00" || d.DNSRecords[1].Data != "0 3 0 AA==" {
+		t.Error("expected delete signal", err, d.DNSRecords)
+	}
+
+	d = &domain{Name: "example.com", PublishCDS: true}
+	if err := d.AddCDSRecords(filepath.Join(keyDir, "bogus")); err == nil {
+		t.Error("expected error due to missing key file")
+	}
+	os.Remove(prefix + ".ds")
+	if err := d.AddCDSRecords(prefix); err == nil {
+		t.Error("expected error due to missing DS file")
+	}
+	ioutil.WriteFile(prefix+".ds", []byte("bogus"), 0644)
+	if err := d.AddCDSRecords(prefix); err == nil {
+		t.Error("expected error due to invalid DS file")
+	}
+	ioutil.WriteFile(prefix+".ds", []byte("example.com. IN A 10.1.0.6"), 0644)
+	if err := d.AddCDSRecords(prefix); err == nil {
+		t.Error("expected error due to DS file without DS record")
+	}
+}
+
+func TestGetDefaultCAA(t *testing.T) {
+	caa := getDefaultCAA("")
+	if len(caa) != 1 || caa[0].Tag != "issue" || caa[0].Value != "letsencrypt.org" {
+		t.Error("expected Let's Encrypt by default", caa)
+	}
+
+	caa = getDefaultCAA("letsencrypt.org  pki.goog")
+	if len(caa) != 2 || caa[0].Value != "letsencrypt.org" || caa[1].Value != "pki.goog" {
+		t.Error("expected configured issuers", caa)
+	}
+}
+
+func TestBuildDnsRecordsExplicitCAA(t *testing.T) {
+	d := &domain{Name: "example.com", CAARecords: []caaRecord{caaRecord{Tag: "issue", Value: "pki.goog"}}}
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
+	caa := d.DNSRecords[len(d.DNSRecords)-1]
+	if caa.RecordType != "CAA" || caa.Data != "0 issue \"pki.goog\"" || len(d.CAARecords) != 1 {
+		t.Error("expected explicit CAA record to replace the default", d.DNSRecords)
 	}
 }
 
@@ -39,30 +181,77 @@ func TestAdd(t *testing.T) {
 	}
 }
 
-func TestGetIp(t *testing.T) {
+func TestAddARecord(t *testing.T) {
+	d := &domain{}
+	d.AddARecord("server", "123.45.67.89", "", 0)
+	d.AddARecord("server", "2001:DB8::1", "", 300)
+	d.AddARecord("server", "bogus", "", 0)
+	if len(d.DNSRecords) != 2 || d.DNSRecords[0].RecordType != "A" || d.DNSRecords[0].Data != "123.45.67.89" ||
+		d.DNSRecords[1].RecordType != "AAAA" || d.DNSRecords[1].Data != "2001:db8::1" || d.DNSRecords[0].TTL != "" || d.DNSRecords[1].TTL != "300" {
+		t.Fatal("expected A and AAAA records and invalid address skipped", d.DNSRecords)
+	}
+
+	d = &domain{}
+	nameToIP["dualstack.example.com"] = []string{"123.45.67.89", "2001:db8::1"}
+	d.AddARecord("dynamic", "", "dualstack.example.com", 0)
+	if len(d.DNSRecords) != 2 || d.DNSRecords[0].RecordType != "A" || d.DNSRecords[1].RecordType != "AAAA" {
+		t.Fatal("expected A and AAAA records for dual stack dynamic FQDN", d.DNSRecords)
+	}
+}
+
+func TestExpireNameCache(t *testing.T) {
+	now := time.Now()
+	nameToIP["old.example.com"] = []string{"10.1.0.1"}
+	nameResolved["old.example.com"] = now.Add(-10 * time.Minute)
+	nameToIP["new.example.com"] = []string{"10.1.0.2"}
+	nameResolved["new.example.com"] = now.Add(-time.Minute)
+	expireNameCache(now, 5*time.Minute)
+	if _, ok := nameToIP["old.example.com"]; ok || len(nameToIP["new.example.com"]) != 1 {
+		t.Error("expected only the old lookup to be forgotten", nameToIP)
+	}
+	if _, ok := nameResolved["old.example.com"]; ok {
+		t.Error("expected resolved time to be forgotten")
+	}
+	delete(nameToIP, "new.example.com")
+	delete(nameResolved, "new.example.com")
+}
+
+func TestGetIps(t *testing.T) {
 	bogus := "bogus.domain"
 	fqdn := "google-public-dns-a.google.com"
-	nameToIP["google-public-dns-a.google.com"] = "" // ensure not filled yet
-	ipResolve := getIP("", fqdn)                    // should do a name resolution this time
-	ipMap := getIP("", fqdn)                        // should pull from map this time
-	if ipResolve != "8.8.8.8" || ipMap != "8.8.8.8" || nameToIP["google-public-dns-a.google.com"] != "8.8.8.8" {
-		t.Error("expected IP address to equal 8.8.8.8.  Has DNS changed?", ipResolve, ipMap)
+	delete(nameToIP, fqdn)        // ensure not filled yet
+	ipResolve := getIPs("", fqdn) // should do a name resolution this time
+	ipMap := getIPs("", fqdn)     // should pull from map this time
+	if !containsString(ipResolve, "8.8.8.8") || !containsString(ipMap, "8.8.8.8") || !containsString(nameToIP[fqdn], "8.8.8.8") {
+		t.Error("expected IP addresses to include 8.8.8.8.  Has DNS changed?", ipResolve, ipMap)
 	}
-	if getIP("", bogus) != "" {
+	if len(getIPs("", bogus)) != 0 {
 		t.Error("expected no IP address returned for bogus address")
 	}
+	if ips := getIPs("2001:db8::1", fqdn); len(ips) != 1 || ips[0] != "2001:db8::1" {
+		t.Error("expected static IP address to be used", ips)
+	}
 }
 
-func TestGetIpBogusName(t *testing.T) {
+func TestGetIpsBogusName(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
 	}
-	ip := getIP("", "12345")
-	if ip != "" {
-		t.Fatal("expected empty ip", ip)
+	ips := getIPs("", "12345")
+	if len(ips) != 0 {
+		t.Fatal("expected no ips", ips)
 	}
 }
 
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func TestGetTlsaKey(t *testing.T) {
 	command.SetExec()
 	key := getTlsaKey("testData/ssl_certificate.pem")
@@ -98,7 +287,7 @@ func TestGetDkimValueNotFound(t *testing.T) {
 
 func TestDomainToString(t *testing.T) {
 	d := &domain{Name: "example.com", ARecords: []aRecord{aRecord{Name: "", IPAddress: "123.45.67.89"}}, NsRecords: []nsRecord{nsRecord{Name: "", Value: "ns1"}}}
-	d.BuildDNSRecords("bogus", "bogus")
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
 	expected := `
 $ORIGIN example.com.
 $TTL 1800
@@ -108,11 +297,12 @@ _25._tcp		IN	TLSA	3 0 1 TLSA_KEY_FILE_NOT_FOUND_AT_bogus
 _443._tcp		IN	TLSA	3 0 1 TLSA_KEY_FILE_NOT_FOUND_AT_bogus
 mail._domainkey		IN	TXT	"DKIM_KEY_NOT_FOUND_AT_bogus"
 example.com.		IN	NS	ns1.example.com.
-example.com.		IN	MX	10 mail1.endfirst.com.
-example.com.		IN	MX	20 mail2.endfirst.com.
-example.com.		IN	TXT	"v=spf1 include:_spf.endfirst.com -all"
-_dmarc.example.com.		IN	TXT	"v=DMARC1; p=quarantine; rua=mailto:dmarc-report@endfirst.com"
+example.com.		IN	MX	10 mail1.example.net.
+example.com.		IN	MX	20 mail2.example.net.
+example.com.		IN	TXT	"v=spf1 include:_spf.example.net -all"
+_dmarc.example.com.		IN	TXT	"v=DMARC1; p=quarantine; rua=mailto:dmarc-report@example.net"
 example.com.		IN	A	123.45.67.89
+example.com.		IN	CAA	0 issue "letsencrypt.org"
 `
 	actual := d.String("1234567")
 	if expected != actual {
@@ -122,44 +312,78 @@ example.com.		IN	A	123.45.67.89
 
 func TestWriteZone(t *testing.T) {
 	d := &domain{Name: "example.com", ARecords: []aRecord{aRecord{Name: "", IPAddress: "123.45.67.89"}}, NsRecords: []nsRecord{nsRecord{Value: "ns1"}}}
-	d.BuildDNSRecords("bogus", "bogus")
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
 
 	clean("testData/example.com.txt*")
 	os.Remove("testData/example.com.txt.signed")
 
-	d.WriteZone("testData") // create file. not signed
+	d.WriteZone("testData", false) // create file. not signed
 	text, sn := getFileMatch("testData/example.com.txt", `SOA.*\((\d*)`)
 	if sn != time.Now().Format("2006010200") {
 		t.Error("expected serial number expiration date to match current time", sn, text, time.Now().Format("2006010200"))
 	}
 
-	writeSigned("example.com", time.Now().AddDate(0, 1, 0).Format("20060102000000"))
-	d.WriteZone("testData") // no update
+	writeSigned("example.com", time.Now().AddDate(0, 0, 1).Format("20060102000000"))
+	d.WriteZone("testData", false) // no update. Expiring signatures are handled by the caller
 	_, sn1 := getFileMatch("testData/example.com.txt", `SOA.*\((\d*)`)
 	if sn != sn1 {
 		t.Error("expected serial number to stay the same")
 	}
 
-	writeSigned("example.com", time.Now().AddDate(0, 0, 1).Format("20060102000000"))
-	d.WriteZone("testData") // signature is old, so write
+	d.ARecords[0].IPAddress = "123.45.67.90"
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
+	d.WriteZone("testData", false) // zone changed, so write
 	_, sn2 := getFileMatch("testData/example.com.txt", `SOA.*\((\d*)`)
 	if sn2 != getSerialNumberRevision(sn1, sn1) {
-		t.Error("expected new revision to be created due to expiration")
+		t.Error("expected new revision to be created due to change")
+	}
+
+	updated, _ := d.WriteZone("testData", true) // forced, so write
+	_, sn3 := getFileMatch("testData/example.com.txt", `SOA.*\((\d*)`)
+	if !updated || sn3 != getSerialNumberRevision(sn2, sn2) {
+		t.Error("expected new revision to be created when forced")
 	}
 }
 
+func TestNeedsResign(t *testing.T) {
+	d := &domain{Name: "example.com"}
+	policy := signaturePolicy{Validity: 30 * 24 * time.Hour, Refresh: 3 * 24 * time.Hour}
+	os.Remove("testData/example.com.txt.signed")
+	if !d.NeedsResign("testData", policy, time.Now()) {
+		t.Error("expected unsigned zone to need signing")
+	}
+	writeSigned("example.com", time.Now().AddDate(0, 1, 0).Format("20060102000000"))
+	if d.NeedsResign("testData", policy, time.Now()) {
+		t.Error("expected signatures to still be valid")
+	}
+	writeSigned("example.com", time.Now().AddDate(0, 0, 2).Format("20060102000000"))
+	if !d.NeedsResign("testData", policy, time.Now()) {
+		t.Error("expected signatures within refresh window to need re-signing")
+	}
+	os.Remove("testData/example.com.txt.signed")
+}
+
 func TestSignZone(t *testing.T) {
-	command.SetMock(&command.MockShellCmd{})
-	d := &domain{Name: "example.com", NsRecords: []nsRecord{nsRecord{Name: "ns1"}}}
-	err := d.SignZone("testData", "testData", "ALG")
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	keys := newTestSigningKeys(t, keyDir)
+	clean("testData/example.com.txt*")
+	d := newSignableDomain("example.com")
+	d.WriteZone("testData", false)
+	expiration := time.Now().Add(10 * 24 * time.Hour)
+	err := d.SignZone("testData", keys, expiration)
 	if err != nil {
-		t.Error("expected success", err)
+		t.Fatal("expected success", err)
+	}
+	text, _ := ioutil.ReadFile("testData/example.com.txt.signed")
+	sig, err := earliestSignature("testData/example.com.txt.signed")
+	if !strings.Contains(string(text), "NSEC3PARAM") || err != nil || signatureExpiry(sig).Unix() != expiration.Unix() {
+		t.Error("expected signed zone with the given expiration", err, sig)
 	}
 
-	command.SetMock(&command.MockShellCmd{CombinedOutputErr: fmt.Errorf("fail")})
-	err = d.SignZone("testData", "testData", "ALG")
+	err = d.SignZone("bogus", keys, expiration)
 	if err == nil {
-		t.Error("expected failure")
+		t.Error("expected failure due to missing zone file")
 	}
 }
 
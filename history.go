@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotTimeFormat = "20060102-150405"
+const zoneHistoryCount = 50
+const zoneHistoryAge time.Duration = 14 * 24 * time.Hour
+
+// historyPolicy controls how many snapshots of each zone are kept. Snapshots beyond the newest Count or older
+// than MaxAge are removed, except for the newest one
+type historyPolicy struct {
+	Count  int
+	MaxAge time.Duration
+}
+
+func (p historyPolicy) validate() error {
+	if p.Count < 1 || p.MaxAge <= 0 {
+		return errors.New("Zone history count and age must be greater than zero")
+	}
+	return nil
+}
+
+// zoneSnapshot is a copy of a zone file taken each time the zone was written and signed
+type zoneSnapshot struct {
+	Timestamp string // as used in the file name and by rollback
+	Created   time.Time
+	Serial    string
+	Filename  string
+}
+
+// snapshotZone keeps a copy of the current zone file in <zone>.txt_<timestamp> and removes the snapshots
+// the policy no longer keeps
+func snapshotZone(folder string, name string, policy historyPolicy, now time.Time) error {
+	filename := filepath.Join(folder, name+".txt")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filename+"_"+now.Format(snapshotTimeFormat), data, 0400); err != nil {
+		return err
+	}
+	return pruneSnapshots(folder, name, policy, now)
+}
+
+// zoneSnapshots returns the snapshots of the zone from oldest to newest
+func zoneSnapshots(folder string, name string) ([]zoneSnapshot, error) {
+	prefix := filepath.Join(folder, name+".txt_")
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []zoneSnapshot{}
+	for _, match := range matches {
+		timestamp := strings.TrimPrefix(match, prefix)
+		created, err := time.ParseInLocation(snapshotTimeFormat, timestamp, time.Local)
+		if err != nil {
+			continue // not a snapshot of this zone
+		}
+		_, serial := getFileMatch(match, `SOA.*\((\d*)`)
+		snapshots = append(snapshots, zoneSnapshot{Timestamp: timestamp, Created: created, Serial: serial, Filename: match})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+func pruneSnapshots(folder string, name string, policy historyPolicy, now time.Time) error {
+	snapshots, err := zoneSnapshots(folder, name)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(snapshots)-1; i++ {
+		if i < len(snapshots)-policy.Count || now.Sub(snapshots[i].Created) > policy.MaxAge {
+			if err := os.Remove(snapshots[i].Filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeHistory writes each snapshot of the zone with its serial and the records that changed since the one before
+func writeHistory(out io.Writer, folder string, name string) error {
+	snapshots, err := zoneSnapshots(folder, name)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return errors.New("No history found for " + name)
+	}
+	previous := ""
+	for _, snapshot := range snapshots {
+		data, err := ioutil.ReadFile(snapshot.Filename)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s  serial %s\n", snapshot.Timestamp, snapshot.Serial)
+		if previous != "" {
+			fmt.Fprint(out, diffZones(previous, string(data), name))
+		}
+		previous = string(data)
+	}
+	return nil
+}
+
+// setSerial replaces the serial number of the SOA record in the zone
+func setSerial(zone string, serial string) (string, error) {
+	match := regexp.MustCompile(`SOA.*\((\d*)`).FindStringSubmatchIndex(zone)
+	if match == nil {
+		return "", errors.New("SOA record not found")
+	}
+	return zone[:match[2]] + serial + zone[match[3]:], nil
+}
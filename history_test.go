@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSnapshot = "$ORIGIN a.com.\n@ 1800 IN SOA ns1.a.com. hostmaster.a.com. (%s 7200 1800 1209600 1800)\n@ 1800 IN A %s\n"
+
+func writeSnapshot(dir string, created time.Time, serial string, ip string) {
+	zone := strings.Replace(strings.Replace(testSnapshot, "%s", serial, 1), "%s", ip, 1)
+	ioutil.WriteFile(filepath.Join(dir, "a.com.txt_"+created.Format(snapshotTimeFormat)), []byte(zone), 0400)
+}
+
+func TestSnapshotZone(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	policy := historyPolicy{Count: 2, MaxAge: 24 * time.Hour}
+	writeSnapshot(dir, now.Add(-48*time.Hour), "2026010100", "10.1.0.1") // too old
+	writeSnapshot(dir, now.Add(-3*time.Hour), "2026010101", "10.1.0.2")  // beyond count
+	writeSnapshot(dir, now.Add(-2*time.Hour), "2026010102", "10.1.0.3")
+	ioutil.WriteFile(filepath.Join(dir, "a.com.txt_bogus"), []byte("bogus"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a.com.txt"), []byte("current"), 0644)
+
+	if err := snapshotZone(dir, "a.com", policy, now); err != nil {
+		t.Fatal("expected success", err)
+	}
+	snapshots, _ := zoneSnapshots(dir, "a.com")
+	if len(snapshots) != 2 || snapshots[0].Serial != "2026010102" || snapshots[1].Timestamp != now.Format(snapshotTimeFormat) ||
+		!fileExists(filepath.Join(dir, "a.com.txt_bogus")) {
+		t.Error("expected the newest snapshots to be kept", snapshots)
+	}
+
+	// the newest snapshot is kept however old it is
+	if err := pruneSnapshots(dir, "a.com", policy, now.Add(30*24*time.Hour)); err != nil {
+		t.Fatal("expected success", err)
+	}
+	if snapshots, _ := zoneSnapshots(dir, "a.com"); len(snapshots) != 1 || snapshots[0].Timestamp != now.Format(snapshotTimeFormat) {
+		t.Error("expected newest snapshot to be kept", snapshots)
+	}
+
+	if err := snapshotZone(dir, "missing.com", policy, now); err == nil {
+		t.Error("expected error due to missing zone file")
+	}
+}
+
+func TestWriteHistory(t *testing.T) {
+	dir := tempDir()
+	defer os.RemoveAll(dir)
+	out := &bytes.Buffer{}
+	if err := writeHistory(out, dir, "a.com"); err == nil {
+		t.Error("expected error without snapshots")
+	}
+
+	created := time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)
+	writeSnapshot(dir, created, "2026010100", "10.1.0.1")
+	writeSnapshot(dir, created.Add(time.Hour), "2026010101", "10.1.0.2")
+	if err := writeHistory(out, dir, "a.com"); err != nil {
+		t.Fatal("expected success", err)
+	}
+	actual := out.String()
+	if !strings.HasPrefix(actual, "20260101-120000  serial 2026010100\n20260101-130000  serial 2026010101\n--- a/a.com.txt") ||
+		!strings.Contains(actual, "-a.com.\t1800\tIN\tA\t10.1.0.1\n+a.com.\t1800\tIN\tA\t10.1.0.2\n") {
+		t.Error("expected snapshots with the changes between them", actual)
+	}
+}
+
+func TestSetSerial(t *testing.T) {
+	zone := strings.Replace(strings.Replace(testSnapshot, "%s", "2026010100", 1), "%s", "10.1.0.1", 1)
+	actual, err := setSerial(zone, "2026101601")
+	if err != nil || !strings.Contains(actual, "(2026101601 7200") {
+		t.Error("expected serial to be replaced", actual, err)
+	}
+	if _, err := setSerial("bogus", "2026101601"); err == nil {
+		t.Error("expected error without SOA record")
+	}
+}
+
+func TestHistoryPolicyValidate(t *testing.T) {
+	if err := (historyPolicy{Count: 1, MaxAge: time.Hour}).validate(); err != nil {
+		t.Error("expected valid policy", err)
+	}
+	for _, policy := range []historyPolicy{historyPolicy{Count: 0, MaxAge: time.Hour}, historyPolicy{Count: 1}} {
+		if err := policy.validate(); err == nil {
+			t.Error("expected error", policy)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const zskLifetime time.Duration = 90 * 24 * time.Hour
+const keyPropagationDelay time.Duration = 48 * time.Hour
+const rsaKSKBits int = 2048
+const rsaZSKBits int = 1024
+
+// keyPolicy controls which keys are created and when they are rolled. The propagation delay is how long a
+// change to the DNSKEY RRset, signatures or parent DS takes to reach every server and expire from resolver caches
+type keyPolicy struct {
+	Algorithm        string
+	RSAKSKBits       int // only used for RSA algorithms. Other algorithms have a fixed key size
+	RSAZSKBits       int
+	ZSKLifetime      time.Duration
+	KSKLifetime      time.Duration // 0 to only roll the KSK when requested
+	PropagationDelay time.Duration
+}
+
+// dsChecker reports whether the parent zone publishes a DS record for the key
+type dsChecker interface {
+	HasDS(domain string, key *dns.DNSKEY) (bool, error)
+}
+
+// keyState tracks the lifecycle of one key. A key is published once it is in the DNSKEY RRset,
+// active while it signs the zone, retired once it stops signing and removed once it leaves the DNSKEY RRset
+type keyState struct {
+	Prefix      string // key file prefix within the key directory
+	Type        string // KSK or ZSK
+	Algorithm   string
+	KeyTag      uint16
+	Created     time.Time
+	Published   time.Time
+	Active      time.Time
+	Retired     time.Time
+	Removed     time.Time
+	DSAnnounced time.Time // KSK only. When its DS was handed out for submission to the parent
+	DSSeen      time.Time // KSK only. When the parent DS was confirmed during a rollover
+}
+
+// domainKeys is the key state of one domain, persisted as <domain>.keys.json in the key directory
+type domainKeys struct {
+	Domain               string
+	Algorithm            string
+	Keys                 []*keyState
+	KSKRolloverRequested bool
+	AlgorithmRollover    *algorithmRollover
+	keyDir               string
+	saved                bool      // the state file matches the keys
+	output               io.Writer // where instructions for the operator are printed. Stdout if nil
+}
+
+// algorithmRollover tracks a change of signing algorithm. It follows the conservative approach of
+// RFC 6781 4.1.4 so that validators never see a DNSKEY algorithm without matching signatures
+type algorithmRollover struct {
+	Algorithm string    // algorithm being rolled to
+	Step      int       // one of the algorithmStep constants
+	Started   time.Time // when the current step started
+}
+
+const (
+	algorithmStepSignatures = iota + 1 // new keys sign the zone but aren't published yet
+	algorithmStepPublished             // new keys are in the DNSKEY RRset
+	algorithmStepDS                    // waiting for the parent to publish the DS of the new KSK
+	algorithmStepRemoved               // old keys are out of the DNSKEY RRset but still sign the zone
+)
+
+func (k *keyState) isPublished() bool {
+	return !k.Published.IsZero() && k.Removed.IsZero()
+}
+
+// status describes where the key is in its lifecycle
+func (k *keyState) status() string {
+	switch {
+	case !k.Removed.IsZero():
+		return "removed"
+	case !k.Retired.IsZero():
+		return "retired"
+	case k.isActive() && k.isPublished():
+		return "active"
+	case k.isActive():
+		return "signing"
+	case k.isPublished():
+		return "published"
+	}
+	return "created"
+}
+
+func (k *keyState) isActive() bool {
+	return !k.Active.IsZero() && k.Retired.IsZero()
+}
+
+func (p keyPolicy) rsaBits(keyType string) int {
+	if keyType == "KSK" {
+		return p.RSAKSKBits
+	}
+	return p.RSAZSKBits
+}
+
+func (p keyPolicy) validate() error {
+	if p.Algorithm != "" {
+		algorithm, ok := dns.StringToAlgorithm[strings.ToUpper(p.Algorithm)]
+		if !ok {
+			return errors.New("Unknown signing algorithm " + p.Algorithm)
+		}
+		if _, err := keyBits(algorithm, p.RSAKSKBits); err != nil {
+			return err
+		}
+		if _, err := keyBits(algorithm, p.RSAZSKBits); err != nil {
+			return err
+		}
+	}
+	if p.PropagationDelay <= 0 {
+		return errors.New("Key propagation delay must be greater than zero")
+	}
+	if p.ZSKLifetime <= p.PropagationDelay {
+		return fmt.Errorf("ZSK lifetime (%v) must be greater than the key propagation delay (%v)", p.ZSKLifetime, p.PropagationDelay)
+	}
+	if p.KSKLifetime < 0 || (p.KSKLifetime != 0 && p.KSKLifetime <= p.PropagationDelay) {
+		return fmt.Errorf("KSK lifetime (%v) must be greater than the key propagation delay (%v)", p.KSKLifetime, p.PropagationDelay)
+	}
+	return nil
+}
+
+// loadDomainKeys reads the key state for the domain. Without a state file the existing
+// <domain>.<algorithm>.KSK and ZSK files are adopted (and created if missing) as the active keys.
+// Existing keys of another algorithm are adopted as they are so that Update rolls them to the policy algorithm
+func loadDomainKeys(keyDir string, domain string, policy keyPolicy) (*domainKeys, error) {
+	k := &domainKeys{Domain: domain, Algorithm: policy.Algorithm, keyDir: keyDir}
+	data, err := ioutil.ReadFile(k.statePath())
+	if err == nil {
+		if err := json.Unmarshal(data, k); err != nil {
+			return nil, errors.New("Unable to read key state " + k.statePath() + " " + err.Error())
+		}
+		for _, key := range k.Keys {
+			if key.Algorithm == "" {
+				key.Algorithm = k.Algorithm
+			}
+		}
+		k.saved = true
+		return k, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if algorithm := existingKeyAlgorithm(keyDir, domain, policy); algorithm != "" {
+		k.Algorithm = algorithm
+		policy.Algorithm = algorithm
+	}
+	kskPrefix, zskPrefix, err := getSigningKeyPrefixes(domain, keyDir, policy)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.adoptKey(kskPrefix, "KSK"); err != nil {
+		return nil, err
+	}
+	if err := k.adoptKey(zskPrefix, "ZSK"); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *domainKeys) adoptKey(prefix string, keyType string) error {
+	key, err := readSigningKey(prefix)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(prefix + ".key")
+	if err != nil {
+		return err
+	}
+	created := info.ModTime()
+	k.Keys = append(k.Keys, &keyState{Prefix: filepath.Base(prefix), Type: keyType, Algorithm: k.Algorithm,
+		KeyTag: key.DNSKEY.KeyTag(), Created: created, Published: created, Active: created})
+	return nil
+}
+
+// domainKeysExist reports whether loadDomainKeys can load the domain's keys without creating any
+func domainKeysExist(keyDir string, domain string, policy keyPolicy) bool {
+	k := &domainKeys{Domain: domain, keyDir: keyDir}
+	if _, err := os.Stat(k.statePath()); err == nil {
+		return true
+	}
+	algorithm := existingKeyAlgorithm(keyDir, domain, policy)
+	prefix := filepath.Join(keyDir, domain+"."+algorithm)
+	return algorithm != "" && keysExist(prefix+".ZSK")
+}
+
+// existingKeyAlgorithm returns the algorithm of the domain's <domain>.<algorithm>.KSK files, preferring the
+// policy algorithm, or "" if there are none
+func existingKeyAlgorithm(keyDir string, domain string, policy keyPolicy) string {
+	if keysExist(filepath.Join(keyDir, domain+"."+policy.Algorithm+".KSK")) {
+		return policy.Algorithm
+	}
+	files, _ := filepath.Glob(filepath.Join(keyDir, domain+".*.KSK.private"))
+	for _, file := range files {
+		algorithm := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), domain+"."), ".KSK.private")
+		if _, ok := dns.StringToAlgorithm[strings.ToUpper(algorithm)]; ok && keysExist(strings.TrimSuffix(file, ".private")) {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+func (k *domainKeys) stdout() io.Writer {
+	if k.output == nil {
+		return os.Stdout
+	}
+	return k.output
+}
+
+func (k *domainKeys) statePath() string {
+	return filepath.Join(k.keyDir, k.Domain+".keys.json")
+}
+
+func (k *domainKeys) save() error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(k.statePath(), data, 0600); err != nil {
+		return err
+	}
+	k.saved = true
+	return nil
+}
+
+// saveIfChanged saves the key state if it changed or has never been saved. Keys are saved before the zone
+// is signed with them so that a zone that fails is retried with the same keys instead of new ones
+func (k *domainKeys) saveIfChanged(changed bool) error {
+	if !changed && k.saved {
+		return nil
+	}
+	return k.save()
+}
+
+// Update moves any algorithm, KSK and ZSK rollover along. An algorithm rollover starts when the policy
+// algorithm differs from the one the domain is signed with. checker can be nil in which case the parent
+// DS must be confirmed with ConfirmDS. Returns true if the zone needs to be re-signed
+func (k *domainKeys) Update(policy keyPolicy, checker dsChecker, now time.Time) (bool, error) {
+	if k.AlgorithmRollover != nil || (policy.Algorithm != "" && !strings.EqualFold(policy.Algorithm, k.Algorithm) &&
+		len(k.findKeys("KSK", (*keyState).isActive)) == 1) {
+		return k.updateAlgorithm(policy, checker, now)
+	}
+	kskChanged, err := k.updateKSK(policy, checker, now)
+	if err != nil {
+		return false, err
+	}
+	zskChanged, err := k.updateZSK(policy, now)
+	if err != nil {
+		return false, err
+	}
+	return kskChanged || zskChanged, nil
+}
+
+// updateKSK rolls the KSK using double signatures. The new KSK is published and signs the DNSKEY RRset
+// alongside the old one. Its DS is announced and the CDS records point to it once the new DNSKEY RRset has
+// reached every resolver. The old KSK is removed a propagation delay after the parent publishes the DS
+func (k *domainKeys) updateKSK(policy keyPolicy, checker dsChecker, now time.Time) (bool, error) {
+	active := k.findKeys("KSK", (*keyState).isActive)
+	if len(active) == 0 {
+		return false, errors.New("No active KSK found for " + k.Domain)
+	}
+	if len(active) == 1 {
+		if !k.KSKRolloverRequested && (policy.KSKLifetime == 0 || now.Before(active[0].Active.Add(policy.KSKLifetime))) {
+			return false, nil
+		}
+		successor, err := k.newKey("KSK", k.Algorithm, now, policy)
+		if err != nil {
+			return false, err
+		}
+		successor.Active = now
+		k.KSKRolloverRequested = false
+		return true, nil
+	}
+
+	successor := active[len(active)-1]
+	if now.Before(successor.Published.Add(policy.PropagationDelay)) {
+		return false, nil // resolvers may still cache the DNSKEY RRset without the new KSK
+	}
+	announced := false
+	if successor.DSAnnounced.IsZero() {
+		k.announceDS(successor, now)
+		announced = true // the CDS records move to the new KSK
+	}
+	changed, err := k.checkDS(successor, checker, now)
+	if err != nil {
+		return false, err
+	}
+	changed = changed || announced
+	if !successor.DSSeen.IsZero() && !now.Before(successor.DSSeen.Add(policy.PropagationDelay)) {
+		for _, key := range active[:len(active)-1] {
+			key.Retired = now
+			key.Removed = now
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// checkDS looks up whether the parent publishes the DS of the KSK being rolled in
+func (k *domainKeys) checkDS(ksk *keyState, checker dsChecker, now time.Time) (bool, error) {
+	if !ksk.DSSeen.IsZero() || checker == nil {
+		return false, nil
+	}
+	dnskey, err := readDNSKEY(filepath.Join(k.keyDir, ksk.Prefix))
+	if err != nil {
+		return false, err
+	}
+	found, err := checker.HasDS(k.Domain, dnskey)
+	if err != nil {
+		fmt.Fprintln(k.stdout(), "Unable to check parent DS for", k.Domain, err)
+		return false, nil
+	}
+	if found {
+		ksk.DSSeen = now
+	}
+	return found, nil
+}
+
+// announceDS prints the DS of the new KSK for submission to the parent
+func (k *domainKeys) announceDS(ksk *keyState, now time.Time) {
+	ds, _ := ioutil.ReadFile(filepath.Join(k.keyDir, ksk.Prefix+".ds"))
+	fmt.Fprintln(k.stdout(), "Submit new DS record to the parent of", k.Domain+":", strings.TrimSpace(string(ds)))
+	ksk.DSAnnounced = now
+}
+
+// updateAlgorithm moves the algorithm rollover along one step each time the propagation delay has passed.
+// The new keys first sign the zone alongside the old ones, then join the DNSKEY RRset. Once the parent
+// publishes the new DS the old keys leave the DNSKEY RRset and finally stop signing
+func (k *domainKeys) updateAlgorithm(policy keyPolicy, checker dsChecker, now time.Time) (bool, error) {
+	r := k.AlgorithmRollover
+	if r == nil {
+		if _, ok := dns.StringToAlgorithm[strings.ToUpper(policy.Algorithm)]; !ok {
+			return false, errors.New("Unknown signing algorithm " + policy.Algorithm)
+		}
+		for _, keyType := range []string{"KSK", "ZSK"} {
+			key, err := k.newKey(keyType, policy.Algorithm, now, policy)
+			if err != nil {
+				return false, err
+			}
+			key.Published = time.Time{}
+			key.Active = now
+		}
+		k.AlgorithmRollover = &algorithmRollover{Algorithm: policy.Algorithm, Step: algorithmStepSignatures, Started: now}
+		fmt.Fprintln(k.stdout(), "Algorithm rollover for", k.Domain, "from", k.Algorithm, "to", policy.Algorithm, "started. The zone is signed with both algorithms")
+		return true, nil
+	}
+	if !strings.EqualFold(policy.Algorithm, r.Algorithm) {
+		return false, errors.New("Algorithm rollover for " + k.Domain + " to " + r.Algorithm + " is in progress. Finish it before changing the signing algorithm")
+	}
+
+	newKSK := k.keysWithAlgorithm(r.Algorithm, "KSK", (*keyState).isActive)
+	if len(newKSK) == 0 {
+		return false, errors.New("No active " + r.Algorithm + " KSK found for " + k.Domain)
+	}
+	if r.Step == algorithmStepDS {
+		changed, err := k.checkDS(newKSK[0], checker, now)
+		if err != nil {
+			return false, err
+		}
+		if newKSK[0].DSSeen.IsZero() || now.Before(newKSK[0].DSSeen.Add(policy.PropagationDelay)) {
+			return changed, nil
+		}
+	} else if now.Before(r.Started.Add(policy.PropagationDelay)) {
+		return false, nil
+	}
+
+	oldKeys := append(k.findKeys("KSK", (*keyState).isActive), k.findKeys("ZSK", (*keyState).isActive)...)
+	switch r.Step {
+	case algorithmStepSignatures:
+		for _, key := range k.keysWithAlgorithm(r.Algorithm, "KSK", (*keyState).isActive) {
+			key.Published = now
+		}
+		for _, key := range k.keysWithAlgorithm(r.Algorithm, "ZSK", (*keyState).isActive) {
+			key.Published = now
+		}
+		fmt.Fprintln(k.stdout(), "Algorithm rollover for", k.Domain+": the", r.Algorithm, "keys are now published")
+	case algorithmStepPublished:
+		k.announceDS(newKSK[0], now)
+		fmt.Fprintln(k.stdout(), "Algorithm rollover for", k.Domain+": remove the", k.Algorithm, "DS records from the parent once the new DS is published")
+	case algorithmStepDS:
+		for _, key := range oldKeys {
+			key.Removed = now
+		}
+		fmt.Fprintln(k.stdout(), "Algorithm rollover for", k.Domain+": the", k.Algorithm, "keys are removed from the DNSKEY RRset")
+	case algorithmStepRemoved:
+		for _, key := range oldKeys {
+			key.Retired = now
+		}
+		fmt.Fprintln(k.stdout(), "Algorithm rollover for", k.Domain, "to", r.Algorithm, "is complete")
+		k.Algorithm = r.Algorithm
+		k.AlgorithmRollover = nil
+		return true, nil
+	}
+	r.Step++
+	r.Started = now
+	return true, nil
+}
+
+// ConfirmDS records that the parent publishes the DS record of the KSK being rolled in
+func (k *domainKeys) ConfirmDS(now time.Time) error {
+	if r := k.AlgorithmRollover; r != nil {
+		newKSK := k.keysWithAlgorithm(r.Algorithm, "KSK", (*keyState).isActive)
+		if r.Step != algorithmStepDS || len(newKSK) == 0 {
+			return errors.New("Algorithm rollover for " + k.Domain + " isn't waiting for the parent DS")
+		}
+		newKSK[0].DSSeen = now
+		return nil
+	}
+	active := k.findKeys("KSK", (*keyState).isActive)
+	if len(active) < 2 {
+		return errors.New("No KSK rollover in progress for " + k.Domain)
+	}
+	if active[len(active)-1].DSAnnounced.IsZero() {
+		return errors.New("The DS of the new KSK for " + k.Domain + " hasn't been announced yet. Wait for the key propagation delay")
+	}
+	active[len(active)-1].DSSeen = now
+	return nil
+}
+
+// updateZSK rolls the ZSK using pre-publication. A successor ZSK is pre-published a propagation delay before
+// the active ZSK reaches the end of its lifetime, takes over signing once its lifetime is over and the old key
+// is removed from the DNSKEY RRset after another propagation delay
+func (k *domainKeys) updateZSK(policy keyPolicy, now time.Time) (bool, error) {
+	changed := false
+	active := k.findKeys("ZSK", (*keyState).isActive)
+	if len(active) == 0 {
+		return false, errors.New("No active ZSK found for " + k.Domain)
+	}
+	current := active[0]
+	successors := k.findKeys("ZSK", func(key *keyState) bool { return key.isPublished() && key.Active.IsZero() })
+	if len(successors) == 0 && !now.Before(current.Active.Add(policy.ZSKLifetime-policy.PropagationDelay)) {
+		successor, err := k.newKey("ZSK", k.Algorithm, now, policy)
+		if err != nil {
+			return false, err
+		}
+		successors = append(successors, successor)
+		changed = true
+	}
+	if len(successors) != 0 && !now.Before(successors[0].Published.Add(policy.PropagationDelay)) &&
+		!now.Before(current.Active.Add(policy.ZSKLifetime)) {
+		successors[0].Active = now
+		current.Retired = now
+		changed = true
+	}
+	for _, key := range k.findKeys("ZSK", func(key *keyState) bool { return key.isPublished() && !key.Retired.IsZero() }) {
+		if !now.Before(key.Retired.Add(policy.PropagationDelay)) {
+			key.Removed = now
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func (k *domainKeys) newKey(keyType string, algorithm string, now time.Time, policy keyPolicy) (*keyState, error) {
+	name := fmt.Sprintf("%s.%s.%s.%s", k.Domain, algorithm, keyType, now.Format("20060102150405"))
+	if err := writeSigningKey(filepath.Join(k.keyDir, name), k.Domain, algorithm, keyType == "KSK", policy.rsaBits(keyType)); err != nil {
+		return nil, errors.New("Unable to create signing files " + err.Error())
+	}
+	dnskey, err := readDNSKEY(filepath.Join(k.keyDir, name))
+	if err != nil {
+		return nil, err
+	}
+	key := &keyState{Prefix: name, Type: keyType, Algorithm: algorithm, KeyTag: dnskey.KeyTag(), Created: now, Published: now}
+	k.Keys = append(k.Keys, key)
+	return key, nil
+}
+
+// findKeys returns the keys of the given type that use the domain's current algorithm
+func (k *domainKeys) findKeys(keyType string, match func(*keyState) bool) []*keyState {
+	return k.keysWithAlgorithm(k.Algorithm, keyType, match)
+}
+
+func (k *domainKeys) keysWithAlgorithm(algorithm string, keyType string, match func(*keyState) bool) []*keyState {
+	keys := []*keyState{}
+	for _, key := range k.Keys {
+		if key.Type == keyType && strings.EqualFold(key.Algorithm, algorithm) && match(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// cdsKeyPrefix returns the key file prefix of the KSK the parent DS should point to. During a
+// rollover this is the new KSK once its DS has been announced
+func (k *domainKeys) cdsKeyPrefix() (string, error) {
+	active := k.findKeys("KSK", (*keyState).isActive)
+	if r := k.AlgorithmRollover; r != nil && r.Step >= algorithmStepDS {
+		active = k.keysWithAlgorithm(r.Algorithm, "KSK", (*keyState).isActive)
+	}
+	if len(active) == 0 {
+		return "", errors.New("No active KSK found for " + k.Domain)
+	}
+	ksk := active[0]
+	for _, key := range active[1:] {
+		if !key.DSAnnounced.IsZero() {
+			ksk = key
+		}
+	}
+	return filepath.Join(k.keyDir, ksk.Prefix), nil
+}
+
+// signingKeys returns the keys to publish in the DNSKEY RRset and the keys to sign with
+func (k *domainKeys) signingKeys() (*zoneKeys, error) {
+	keys := &zoneKeys{}
+	for _, state := range k.Keys {
+		if !state.isPublished() && !state.isActive() {
+			continue
+		}
+		key, err := readSigningKey(filepath.Join(k.keyDir, state.Prefix))
+		if err != nil {
+			return nil, err
+		}
+		if state.isPublished() {
+			keys.Published = append(keys.Published, key)
+		}
+		if state.isActive() && state.Type == "KSK" {
+			keys.KSKs = append(keys.KSKs, key)
+		} else if state.isActive() {
+			keys.ZSKs = append(keys.ZSKs, key)
+		}
+	}
+	if len(keys.KSKs) == 0 || len(keys.ZSKs) == 0 {
+		return nil, errors.New("No active signing keys found for " + k.Domain)
+	}
+	return keys, nil
+}
+
+// resolverDSChecker looks up the parent DS records through a recursive resolver
+type resolverDSChecker struct {
+	Resolver string // host:port
+}
+
+func (c *resolverDSChecker) HasDS(domain string, key *dns.DNSKEY) (bool, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeDS)
+	r, err := dns.Exchange(m, c.Resolver)
+	if err != nil {
+		return false, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return false, errors.New("DS lookup for " + domain + " failed with " + dns.RcodeToString[r.Rcode])
+	}
+	return hasDS(r.Answer, key), nil
+}
+
+func hasDS(records []dns.RR, key *dns.DNSKEY) bool {
+	for _, rr := range records {
+		ds, ok := rr.(*dns.DS)
+		if !ok || ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		if expected := key.ToDS(ds.DigestType); expected != nil && strings.EqualFold(expected.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
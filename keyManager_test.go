@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoadDomainKeys(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+
+	// adopt existing keys
+	newTestSigningKeys(t, keyDir)
+	keys, err := loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	if err != nil || len(keys.Keys) != 2 || keys.Keys[0].Type != "KSK" || keys.Keys[1].Type != "ZSK" ||
+		!keys.Keys[1].isActive() || keys.Keys[1].Prefix != "example.com.RSASHA256.ZSK" {
+		t.Fatal("expected existing keys to be adopted", err, keys)
+	}
+
+	// read saved state
+	keys.Keys[1].Retired = time.Now()
+	if err := keys.save(); err != nil {
+		t.Fatal("expected save to succeed", err)
+	}
+	keys, err = loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	if err != nil || len(keys.Keys) != 2 || keys.Keys[1].isActive() {
+		t.Error("expected saved state to be read", err, keys)
+	}
+
+	// create missing keys
+	keys, err = loadDomainKeys(keyDir, "example.org", testKeyPolicy())
+	if err != nil || len(keys.Keys) != 2 || !keysExist(filepath.Join(keyDir, "example.org.RSASHA256.ZSK")) {
+		t.Error("expected keys to be created", err, keys)
+	}
+
+	// adopt existing keys of another algorithm and roll them to the policy algorithm
+	os.Remove(filepath.Join(keyDir, "example.com.keys.json"))
+	policy := testKeyPolicy()
+	policy.Algorithm = "ECDSAP256SHA256"
+	if !domainKeysExist(keyDir, "example.com", policy) {
+		t.Error("expected keys of another algorithm to be found")
+	}
+	keys, err = loadDomainKeys(keyDir, "example.com", policy)
+	if err != nil || keys.Algorithm != "RSASHA256" || len(keys.Keys) != 2 || keys.Keys[0].Algorithm != "RSASHA256" ||
+		keysExist(filepath.Join(keyDir, "example.com.ECDSAP256SHA256.KSK")) {
+		t.Fatal("expected RSA keys to be adopted", err, keys)
+	}
+	if changed, err := keys.Update(policy, nil, time.Now()); !changed || err != nil || keys.AlgorithmRollover == nil {
+		t.Error("expected algorithm rollover to start", err)
+	}
+	if domainKeysExist(keyDir, "example.edu", policy) {
+		t.Error("expected no keys")
+	}
+
+	ioutil.WriteFile(filepath.Join(keyDir, "example.net.keys.json"), []byte("bogus"), 0600)
+	if _, err := loadDomainKeys(keyDir, "example.net", testKeyPolicy()); err == nil {
+		t.Error("expected error due to invalid state file")
+	}
+
+	if _, err := loadDomainKeys(keyDir, "example.info", keyPolicy{Algorithm: "ALG"}); err == nil {
+		t.Error("expected error due to unknown algorithm")
+	}
+}
+
+func TestUpdateZSKRollover(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	newTestSigningKeys(t, keyDir)
+	keys, _ := loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	policy := testKeyPolicy()
+	policy.ZSKLifetime = 30 * 24 * time.Hour
+	start := keys.Keys[1].Active
+
+	// nothing to do yet
+	if changed, err := keys.Update(policy, nil, start.Add(28*24*time.Hour)); changed || err != nil {
+		t.Error("expected no change", err)
+	}
+
+	// pre-publish successor
+	changed, err := keys.Update(policy, nil, start.Add(29*24*time.Hour))
+	signing, _ := keys.signingKeys()
+	if !changed || err != nil || len(keys.Keys) != 3 || len(signing.Published) != 3 || len(signing.ZSKs) != 1 ||
+		signing.ZSKs[0].DNSKEY.KeyTag() != keys.Keys[1].KeyTag {
+		t.Fatal("expected successor to be published but not used for signing", err, keys.Keys)
+	}
+
+	// switch to successor
+	changed, err = keys.Update(policy, nil, start.Add(30*24*time.Hour))
+	signing, _ = keys.signingKeys()
+	if !changed || err != nil || len(signing.Published) != 3 || len(signing.ZSKs) != 1 ||
+		signing.ZSKs[0].DNSKEY.KeyTag() != keys.Keys[2].KeyTag || keys.Keys[1].Retired.IsZero() {
+		t.Fatal("expected successor to take over signing", err, keys.Keys)
+	}
+
+	// remove old key
+	changed, err = keys.Update(policy, nil, start.Add(31*24*time.Hour))
+	signing, _ = keys.signingKeys()
+	if !changed || err != nil || len(signing.Published) != 2 || keys.Keys[1].Removed.IsZero() {
+		t.Error("expected old key to be removed", err, keys.Keys)
+	}
+
+	keys.Keys[2].Retired = time.Now()
+	if _, err := keys.updateZSK(policy, time.Now()); err == nil {
+		t.Error("expected error due to no active ZSK")
+	}
+	if _, err := keys.signingKeys(); err == nil {
+		t.Error("expected error due to no active ZSK")
+	}
+}
+
+func TestUpdateKSKRollover(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	newTestSigningKeys(t, keyDir)
+	keys, _ := loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	policy := testKeyPolicy()
+	policy.ZSKLifetime = 30 * 24 * time.Hour
+	policy.KSKLifetime = 365 * 24 * time.Hour
+	start := keys.Keys[0].Active
+	checker := &mockDSChecker{}
+
+	// nothing to do yet
+	if changed, err := keys.updateKSK(policy, checker, start.Add(time.Hour)); changed || err != nil {
+		t.Error("expected no change", err)
+	}
+
+	// requested rollover. Both KSKs sign the DNSKEY RRset
+	keys.KSKRolloverRequested = true
+	now := start.Add(2 * time.Hour)
+	changed, err := keys.updateKSK(policy, checker, now)
+	signing, _ := keys.signingKeys()
+	if !changed || err != nil || keys.KSKRolloverRequested || len(keys.Keys) != 3 || len(signing.KSKs) != 2 ||
+		!keysExist(filepath.Join(keyDir, keys.Keys[2].Prefix)) {
+		t.Fatal("expected new KSK to be published and signing", err, keys.Keys)
+	}
+
+	// DS isn't announced until the new DNSKEY RRset has propagated
+	checker.found = true
+	if changed, err := keys.updateKSK(policy, checker, now.Add(time.Hour)); changed || err != nil || !keys.Keys[2].DSAnnounced.IsZero() ||
+		!keys.Keys[2].DSSeen.IsZero() {
+		t.Error("expected to wait for propagation delay before announcing DS", err)
+	}
+	if prefix, _ := keys.cdsKeyPrefix(); prefix != filepath.Join(keyDir, keys.Keys[0].Prefix) {
+		t.Error("expected CDS to point to old KSK until the DS is announced", prefix)
+	}
+	if err := keys.ConfirmDS(now.Add(time.Hour)); err == nil {
+		t.Error("expected error since the DS hasn't been announced")
+	}
+
+	// DS announced but not at parent yet
+	var out bytes.Buffer
+	keys.output = &out
+	checker.found = false
+	checker.err = errors.New("fail")
+	if changed, err := keys.updateKSK(policy, checker, now.Add(24*time.Hour)); !changed || err != nil || keys.Keys[2].DSAnnounced.IsZero() ||
+		!keys.Keys[2].DSSeen.IsZero() {
+		t.Error("expected DS to be announced while parent check fails", err)
+	}
+	if prefix, _ := keys.cdsKeyPrefix(); prefix != filepath.Join(keyDir, keys.Keys[2].Prefix) {
+		t.Error("expected CDS to point to new KSK once the DS is announced", prefix)
+	}
+	if !strings.Contains(out.String(), "Submit new DS record to the parent of example.com:") ||
+		!strings.Contains(out.String(), "Unable to check parent DS for example.com fail") {
+		t.Error("expected announcement and parent check failure on the output", out.String())
+	}
+	checker.err = nil
+	if changed, err := keys.updateKSK(policy, checker, now.Add(25*time.Hour)); changed || err != nil || !keys.Keys[2].DSSeen.IsZero() {
+		t.Error("expected no change until parent publishes DS", err)
+	}
+
+	// DS found. Old KSK removed after the propagation delay
+	checker.found = true
+	if changed, err := keys.updateKSK(policy, checker, now.Add(26*time.Hour)); !changed || err != nil || keys.Keys[2].DSSeen.IsZero() {
+		t.Error("expected DS to be seen", err)
+	}
+	if changed, err := keys.updateKSK(policy, checker, now.Add(27*time.Hour)); changed || err != nil {
+		t.Error("expected to wait for propagation delay", err)
+	}
+	changed, err = keys.updateKSK(policy, checker, now.Add(50*time.Hour))
+	signing, _ = keys.signingKeys()
+	if !changed || err != nil || len(signing.KSKs) != 1 || len(signing.Published) != 2 || keys.Keys[0].Removed.IsZero() ||
+		signing.KSKs[0].DNSKEY.KeyTag() != keys.Keys[2].KeyTag {
+		t.Error("expected old KSK to be removed", err, keys.Keys)
+	}
+
+	// roll after KSK lifetime
+	changed, err = keys.updateKSK(policy, nil, now.Add(366*24*time.Hour))
+	if !changed || err != nil || len(keys.findKeys("KSK", (*keyState).isActive)) != 2 {
+		t.Error("expected rollover at end of KSK lifetime", err, keys.Keys)
+	}
+	if changed, err := keys.updateKSK(policy, nil, now.Add(367*24*time.Hour)); !changed || err != nil {
+		t.Error("expected DS to be announced", err)
+	}
+	if err := keys.ConfirmDS(now.Add(367 * 24 * time.Hour)); err != nil || keys.Keys[3].DSSeen.IsZero() {
+		t.Error("expected DS to be confirmed", err)
+	}
+
+	keys.Keys = keys.findKeys("ZSK", (*keyState).isActive)
+	if _, err := keys.updateKSK(policy, nil, time.Now()); err == nil {
+		t.Error("expected error due to no active KSK")
+	}
+	if err := keys.ConfirmDS(time.Now()); err == nil {
+		t.Error("expected error due to no rollover in progress")
+	}
+}
+
+func TestUpdateAlgorithmRollover(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	newTestSigningKeys(t, keyDir)
+	keys, _ := loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	policy := testKeyPolicy()
+	policy.Algorithm = "ECDSAP256SHA256"
+	now := keys.Keys[0].Active.Add(time.Hour)
+
+	// new keys sign but aren't published
+	changed, err := keys.Update(policy, nil, now)
+	signing, _ := keys.signingKeys()
+	if !changed || err != nil || keys.AlgorithmRollover == nil || len(keys.Keys) != 4 || len(signing.Published) != 2 ||
+		len(signing.KSKs) != 2 || len(signing.ZSKs) != 2 || keys.Keys[2].Algorithm != "ECDSAP256SHA256" {
+		t.Fatal("expected new keys to sign the zone", err, keys.Keys)
+	}
+	if changed, err := keys.Update(policy, nil, now.Add(time.Hour)); changed || err != nil {
+		t.Error("expected to wait for propagation delay", err)
+	}
+	policy.Algorithm = "ED25519"
+	if _, err := keys.Update(policy, nil, now.Add(time.Hour)); err == nil {
+		t.Error("expected error due to algorithm change during rollover")
+	}
+	policy.Algorithm = "ECDSAP256SHA256"
+
+	// new keys published
+	now = now.Add(24 * time.Hour)
+	changed, err = keys.Update(policy, nil, now)
+	signing, _ = keys.signingKeys()
+	if !changed || err != nil || len(signing.Published) != 4 || keys.AlgorithmRollover.Step != algorithmStepPublished {
+		t.Fatal("expected new keys to be published", err, keys.Keys)
+	}
+	if err := keys.ConfirmDS(now); err == nil {
+		t.Error("expected error since DS isn't expected yet")
+	}
+	if prefix, _ := keys.cdsKeyPrefix(); prefix != filepath.Join(keyDir, "example.com.RSASHA256.KSK") {
+		t.Error("expected CDS to point to old KSK until new keys are published", prefix)
+	}
+
+	// wait for DS of the new KSK
+	now = now.Add(24 * time.Hour)
+	if changed, err := keys.Update(policy, nil, now); !changed || err != nil || keys.AlgorithmRollover.Step != algorithmStepDS {
+		t.Fatal("expected to wait for DS", err)
+	}
+	if prefix, _ := keys.cdsKeyPrefix(); prefix != filepath.Join(keyDir, keys.Keys[2].Prefix) {
+		t.Error("expected CDS to point to new KSK", prefix)
+	}
+	checker := &mockDSChecker{}
+	if changed, err := keys.Update(policy, checker, now.Add(48*time.Hour)); changed || err != nil {
+		t.Error("expected no change until parent publishes DS", err)
+	}
+	if err := keys.ConfirmDS(now); err != nil || keys.Keys[2].DSSeen.IsZero() {
+		t.Error("expected DS to be confirmed", err)
+	}
+
+	// old keys removed from the DNSKEY RRset but still signing
+	now = now.Add(24 * time.Hour)
+	changed, err = keys.Update(policy, checker, now)
+	signing, _ = keys.signingKeys()
+	if !changed || err != nil || len(signing.Published) != 2 || len(signing.ZSKs) != 2 || keys.AlgorithmRollover.Step != algorithmStepRemoved {
+		t.Fatal("expected old keys to be removed from DNSKEY RRset", err, keys.Keys)
+	}
+
+	// old keys stop signing
+	now = now.Add(24 * time.Hour)
+	changed, err = keys.Update(policy, checker, now)
+	signing, _ = keys.signingKeys()
+	if !changed || err != nil || keys.AlgorithmRollover != nil || keys.Algorithm != "ECDSAP256SHA256" || len(signing.KSKs) != 1 ||
+		len(signing.ZSKs) != 1 || signing.ZSKs[0].DNSKEY.Algorithm != dns.ECDSAP256SHA256 {
+		t.Error("expected rollover to complete", err, keys.Keys)
+	}
+	if changed, err := keys.Update(policy, checker, now.Add(time.Hour)); changed || err != nil {
+		t.Error("expected no change after rollover", err)
+	}
+}
+
+func TestCDSKeyPrefix(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	newTestSigningKeys(t, keyDir)
+	keys, _ := loadDomainKeys(keyDir, "example.com", testKeyPolicy())
+	if prefix, err := keys.cdsKeyPrefix(); err != nil || prefix != filepath.Join(keyDir, "example.com.RSASHA256.KSK") {
+		t.Error("expected current KSK", err, prefix)
+	}
+	keys.Keys = append(keys.Keys, &keyState{Prefix: "example.com.RSASHA256.KSK.new", Type: "KSK", Algorithm: "RSASHA256", Active: time.Now()})
+	if prefix, _ := keys.cdsKeyPrefix(); prefix != filepath.Join(keyDir, "example.com.RSASHA256.KSK") {
+		t.Error("expected current KSK until the DS of the new KSK is announced", prefix)
+	}
+	keys.Keys[2].DSAnnounced = time.Now()
+	if prefix, _ := keys.cdsKeyPrefix(); prefix != filepath.Join(keyDir, "example.com.RSASHA256.KSK.new") {
+		t.Error("expected new KSK during rollover", prefix)
+	}
+	keys.Keys = nil
+	if _, err := keys.cdsKeyPrefix(); err == nil {
+		t.Error("expected error due to no active KSK")
+	}
+}
+
+func TestHasDS(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	keys := newTestSigningKeys(t, keyDir)
+	ksk := keys.KSKs[0].DNSKEY
+	ds := ksk.ToDS(dns.SHA256)
+	sha1 := ksk.ToDS(dns.SHA1)
+	other := keys.ZSKs[0].DNSKEY.ToDS(dns.SHA256)
+	if !hasDS([]dns.RR{other, ds}, ksk) || !hasDS([]dns.RR{sha1}, ksk) {
+		t.Error("expected DS to be found")
+	}
+	ds.Digest = "0000"
+	if hasDS([]dns.RR{other, ds}, ksk) {
+		t.Error("expected DS not to be found")
+	}
+}
+
+func TestKeyPolicyValidate(t *testing.T) {
+	if err := (keyPolicy{ZSKLifetime: zskLifetime, PropagationDelay: keyPropagationDelay}).validate(); err != nil {
+		t.Error("expected defaults to be valid", err)
+	}
+	if err := (keyPolicy{ZSKLifetime: zskLifetime}).validate(); err == nil {
+		t.Error("expected error due to missing propagation delay")
+	}
+	if err := (keyPolicy{ZSKLifetime: time.Hour, PropagationDelay: time.Hour}).validate(); err == nil {
+		t.Error("expected error due to lifetime shorter than propagation delay")
+	}
+	if err := (keyPolicy{ZSKLifetime: zskLifetime, KSKLifetime: time.Hour, PropagationDelay: time.Hour}).validate(); err == nil {
+		t.Error("expected error due to KSK lifetime shorter than propagation delay")
+	}
+	if err := (keyPolicy{Algorithm: "ED25519", ZSKLifetime: zskLifetime, PropagationDelay: keyPropagationDelay}).validate(); err != nil {
+		t.Error("expected fixed size algorithm to ignore RSA key sizes", err)
+	}
+	policy := testKeyPolicy()
+	policy.RSAZSKBits = 8192
+	if err := policy.validate(); err == nil {
+		t.Error("expected error due to RSA key too large")
+	}
+	policy = testKeyPolicy()
+	policy.Algorithm = "DSA"
+	if err := policy.validate(); err == nil {
+		t.Error("expected error due to unsupported algorithm")
+	}
+}
+
+func testKeyPolicy() keyPolicy {
+	return keyPolicy{Algorithm: "RSASHA256", RSAKSKBits: rsaKSKBits, RSAZSKBits: rsaZSKBits, ZSKLifetime: zskLifetime,
+		PropagationDelay: 24 * time.Hour}
+}
+
+type mockDSChecker struct {
+	found bool
+	err   error
+}
+
+func (c *mockDSChecker) HasDS(domain string, key *dns.DNSKEY) (bool, error) {
+	return c.found, c.err
+}
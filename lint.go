@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+type lintLevel int
+
+const (
+	lintWarning lintLevel = iota // published anyway
+	lintError                    // the zone isn't written
+)
+
+// lintProblem is a record that breaks the DNS RFCs. Name is the fully qualified name the problem was found at
+type lintProblem struct {
+	Level   lintLevel
+	Name    string
+	Message string
+}
+
+func (p lintProblem) String() string {
+	return p.Name + " " + p.Message
+}
+
+// lintRecord is a record of the zone with its owner name and, for records that point at another name, its
+// target made fully qualified and lower case
+type lintRecord struct {
+	Name   string
+	Type   string
+	Target string
+}
+
+// Lint checks the records built for the zone. Problems that would break resolution are returned together
+// as an error, the others as warnings:
+//   - a CNAME can't share its name with other records (RFC 1034 3.6.2, RFC 2181 10.1)
+//   - labels are at most 63 bytes and names 255 (RFC 1035 2.3.4)
+//   - name servers, mail servers and SRV targets are valid host names (RFC 1123 2.1) and not CNAMEs (RFC 2181 10.3)
+//   - name servers inside the zone have an address in the zone (RFC 1034 4.2.1)
+//
+// Address records with names that aren't host names and mail servers in the zone without an address are warnings
+func (d *domain) Lint() ([]lintProblem, error) {
+	origin := dns.CanonicalName(d.Name)
+	records := lintRecords(d.DNSRecords, origin)
+	problems := []lintProblem{}
+	add := func(level lintLevel, name string, message string) {
+		problems = append(problems, lintProblem{Level: level, Name: name, Message: message})
+	}
+
+	names := []string{}
+	types := make(map[string][]string)
+	checked := make(map[string]bool)
+	invalid := make(map[string]bool) // names with bad lengths aren't also checked as host names
+	for _, r := range records {
+		for _, name := range []string{r.Name, r.Target} {
+			if name != "" && !checked[name] {
+				checked[name] = true
+				if message := checkNameLength(name); message != "" {
+					add(lintError, name, message)
+					invalid[name] = true
+				}
+			}
+		}
+		if _, ok := types[r.Name]; !ok {
+			names = append(names, r.Name)
+		}
+		types[r.Name] = append(types[r.Name], r.Type)
+	}
+
+	hasAddress := func(name string) bool {
+		return hasString(types[name], "A") || hasString(types[name], "AAAA")
+	}
+	for _, name := range names {
+		if !hasString(types[name], "CNAME") {
+			continue
+		}
+		others := []string{}
+		cnames := 0
+		for _, t := range types[name] {
+			if t == "CNAME" {
+				cnames++
+			} else if !hasString(others, t) {
+				others = append(others, t)
+			}
+		}
+		if cnames > 1 {
+			add(lintError, name, "has more than one CNAME")
+		}
+		if len(others) > 0 {
+			sort.Strings(others)
+			add(lintError, name, "CNAME can't share its name with other records ("+strings.Join(others, ", ")+")")
+		}
+	}
+
+	for _, r := range records {
+		switch r.Type {
+		case "A", "AAAA":
+			if !invalid[r.Name] && !isHostname(r.Name) {
+				add(lintWarning, r.Name, r.Type+" record name isn't a valid host name")
+			}
+		case "SOA", "NS", "MX", "SRV":
+			if r.Target == "." && (r.Type == "MX" || r.Type == "SRV") {
+				continue // null MX (RFC 7505) or service not available (RFC 2782)
+			}
+			if !invalid[r.Target] && !isHostname(r.Target) {
+				add(lintError, r.Name, r.Type+" target "+r.Target+" isn't a valid host name")
+			}
+			if !dns.IsSubDomain(origin, r.Target) || r.Type == "SOA" {
+				continue
+			}
+			if hasString(types[r.Target], "CNAME") {
+				add(lintError, r.Name, r.Type+" target "+r.Target+" is a CNAME")
+			} else if r.Type == "NS" && !hasAddress(r.Target) {
+				add(lintError, r.Name, "name server "+r.Target+" is in the zone but has no A or AAAA record")
+			} else if r.Type == "MX" && !hasAddress(r.Target) {
+				add(lintWarning, r.Name, "mail server "+r.Target+" is in the zone but has no A or AAAA record")
+			}
+		}
+	}
+
+	warnings := []lintProblem{}
+	errs := []string{}
+	for _, problem := range problems {
+		if problem.Level == lintError {
+			errs = append(errs, problem.String())
+		} else {
+			warnings = append(warnings, problem)
+		}
+	}
+	if len(errs) > 0 {
+		return warnings, errors.New("Zone has errors: " + strings.Join(errs, "; "))
+	}
+	if _, err := parseZone(d.String("1"), origin, d.Name+".txt"); err != nil {
+		return warnings, errors.New("Zone has errors: " + err.Error())
+	}
+	return warnings, nil
+}
+
+// lintRecords resolves the owner and target names of the records the way the zone file is read. An empty owner
+// name is the owner of the record before it
+func lintRecords(dnsRecords []dnsRecord, origin string) []lintRecord {
+	records := []lintRecord{}
+	owner := origin
+	for _, record := range dnsRecords {
+		if record.Name != "" {
+			owner = absoluteOwner(record.Name, origin)
+		}
+		r := lintRecord{Name: owner, Type: record.RecordType}
+		fields := strings.Fields(record.Data)
+		switch {
+		case len(fields) == 0:
+		case record.RecordType == "CNAME" || record.RecordType == "NS" || record.RecordType == "SOA":
+			r.Target = absoluteOwner(strings.TrimPrefix(fields[0], "("), origin)
+		case record.RecordType == "MX" && len(fields) == 2:
+			r.Target = absoluteOwner(fields[1], origin)
+		case record.RecordType == "SRV" && len(fields) == 4:
+			r.Target = absoluteOwner(fields[3], origin)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func absoluteOwner(name string, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case name == ".":
+		return "."
+	case strings.HasSuffix(name, "."):
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name + "." + origin)
+}
+
+// checkNameLength returns why the fully qualified name is too long or an empty string if it isn't
+func checkNameLength(name string) string {
+	if name == "." {
+		return ""
+	}
+	length := 1
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			return "has an empty label"
+		}
+		if len(label) > 63 {
+			return "has a label longer than 63 bytes (" + label + ")"
+		}
+		length += len(label) + 1
+	}
+	if length > 255 {
+		return "is longer than 255 bytes"
+	}
+	return ""
+}
+
+// isHostname reports whether the name is made of letters, digits and hyphens. A wildcard label is allowed first
+func isHostname(name string) bool {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	if labels[0] == "*" {
+		labels = labels[1:]
+	}
+	for _, label := range labels {
+		if !hostnameLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
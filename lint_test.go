@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	d := &domain{Name: "example.com", ARecords: []aRecord{aRecord{IPAddress: "10.1.0.6"}, aRecord{Name: "ns1", IPAddress: "10.1.0.7"}},
+		NsRecords: []nsRecord{nsRecord{Value: "ns1"}}, CNameRecords: []cnameRecord{cnameRecord{Name: "www", CanonicalName: "example.com."}}}
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
+	if warnings, err := d.Lint(); err != nil || len(warnings) != 0 {
+		t.Error("expected valid zone", warnings, err)
+	}
+
+	// SPF for a mail server that is a CNAME
+	d = &domain{Name: "example.com", NsRecords: []nsRecord{nsRecord{Value: "ns1.example.net."}},
+		MxRecords: []mxRecord{mxRecord{Value: "mail", Priority: 10}}, CNameRecords: []cnameRecord{cnameRecord{Name: "mail", CanonicalName: "mx.example.net."}}}
+	d.BuildDNSRecords("bogus", "bogus", newTestTemplate())
+	_, err := d.Lint()
+	if err == nil || !strings.Contains(err.Error(), "mail.example.com. CNAME can't share its name with other records (TXT)") ||
+		!strings.Contains(err.Error(), "example.com. MX target mail.example.com. is a CNAME") {
+		t.Error("expected CNAME errors", err)
+	}
+}
+
+func TestLintRecords(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	tests := []struct {
+		records []dnsRecord
+		warning string
+		err     string
+	}{
+		{[]dnsRecord{*newCNameRecord("www", "a.example.net."), *newCNameRecord("www", "b.example.net.")}, "", "www.example.com. has more than one CNAME"},
+		{[]dnsRecord{*newARecord(long, "10.1.0.6")}, "", "has a label longer than 63 bytes"},
+		{[]dnsRecord{*newARecord(strings.Repeat("abcdefghi.", 25)+"a", "10.1.0.6")}, "", "is longer than 255 bytes"},
+		{[]dnsRecord{*newARecord("a..b", "10.1.0.6")}, "", "has an empty label"},
+		{[]dnsRecord{*newNsRecord("example.com", "", "ns_1.example.net.")}, "", "NS target ns_1.example.net. isn't a valid host name"},
+		{[]dnsRecord{*newNsRecord("example.com", "", "ns1"), *newCNameRecord("ns1", "ns.example.net.")}, "", "NS target ns1.example.com. is a CNAME"},
+		{[]dnsRecord{*newNsRecord("example.com", "sub", "ns1.sub")}, "", "name server ns1.sub.example.com. is in the zone but has no A or AAAA record"},
+		{[]dnsRecord{*newSrvRecord("example.com", "sip", "tcp", 10, 10, 5060, "sip"), *newCNameRecord("sip", "sip.example.net.")}, "", "SRV target sip.example.com. is a CNAME"},
+		{[]dnsRecord{*newARecord("_host", "10.1.0.6")}, "_host.example.com. A record name isn't a valid host name", ""},
+		{[]dnsRecord{*newMxRecord("example.com", "", "mail", 10)}, "mail server mail.example.com. is in the zone but has no A or AAAA record", ""},
+		{[]dnsRecord{*newMxRecord("example.com", "", ".", 0), *newARecord("*", "10.1.0.6")}, "", ""},
+		{[]dnsRecord{*newNsRecord("example.com", "sub", "ns1.sub"), *newARecord("ns1.sub", "10.1.0.6")}, "", ""},
+		{[]dnsRecord{*newDNSRecord("bogus", "A", "not an address")}, "", "dns: bad A A"},
+	}
+	for i, test := range tests {
+		d := &domain{Name: "example.com", DNSRecords: []dnsRecord{*newSoaRecord("example.com", "ns1.example.net.", "hostmaster", refresh, retry, expire, negativeTTL)}}
+		d.DNSRecords = append(d.DNSRecords, test.records...)
+		warnings, err := d.Lint()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Error("unexpected error", i, err)
+		}
+		if test.warning == "" && len(warnings) != 0 || test.warning != "" && (len(warnings) != 1 || !strings.Contains(warnings[0].String(), test.warning)) {
+			t.Error("unexpected warnings", i, warnings)
+		}
+	}
+}
+
+func TestIsHostname(t *testing.T) {
+	for _, name := range []string{"example.com.", "*.example.com.", "a-1.example.com.", "1.example.com"} {
+		if !isHostname(name) {
+			t.Error("expected host name", name)
+		}
+	}
+	for _, name := range []string{"-a.example.com.", "a-.example.com.", "_dmarc.example.com.", "a.*.example.com.", "."} {
+		if isHostname(name) {
+			t.Error("expected invalid host name", name)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// zoneError is the failure of a single zone
+type zoneError struct {
+	Zone string
+	Err  error
+}
+
+// zoneErrors collects the failures of zones that were processed together
+type zoneErrors []zoneError
+
+// Error lists every failed zone and why, one per line after a count
+func (e zoneErrors) Error() string {
+	messages := []string{fmt.Sprintf("%d zones failed", len(e))}
+	if len(e) == 1 {
+		messages[0] = "1 zone failed"
+	}
+	for i := range e {
+		messages = append(messages, "  "+e[i].Zone+": "+e[i].Err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// forEachZone calls fn with the index of every zone from up to workers goroutines. Every zone is processed even
+// if others fail. Returns zoneErrors holding the failures in zone order or nil if there were none
+func forEachZone(zones []domain, workers int, fn func(i int) error) error {
+	errs := make([]error, len(zones))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < workers && n < len(zones); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := range zones {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	failed := zoneErrors{}
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, zoneError{Zone: zones[i].Name, Err: err})
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachZone(t *testing.T) {
+	zones := []domain{domain{Name: "a.com"}, domain{Name: "b.com"}, domain{Name: "c.com"}, domain{Name: "d.com"}, domain{Name: "e.com"}}
+	var running, maxRunning, processed int32
+	err := forEachZone(zones, 2, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&processed, 1)
+		if zones[i].Name == "b.com" || zones[i].Name == "d.com" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if processed != 5 || maxRunning != 2 {
+		t.Error("expected every zone processed by at most 2 workers", processed, maxRunning)
+	}
+	failed, ok := err.(zoneErrors)
+	if !ok || len(failed) != 2 || failed[0].Zone != "b.com" || failed[1].Zone != "d.com" || err.Error() != "2 zones failed\n  b.com: failed\n  d.com: failed" {
+		t.Error("expected failures in zone order", err)
+	}
+
+	if err := (zoneErrors{zoneError{Zone: "a.com", Err: errors.New("failed")}}).Error(); err != "1 zone failed\n  a.com: failed" {
+		t.Error("expected single failure", err)
+	}
+	if err := forEachZone(zones, 3, func(i int) error { return nil }); err != nil {
+		t.Error("expected nil error when every zone succeeds", err)
+	}
+	if err := forEachZone(nil, 3, func(i int) error { return errors.New("failed") }); err != nil {
+		t.Error("expected nothing to be processed", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// buildReverseZones creates an in-addr.arpa or ip6.arpa zone for each of the space separated prefixes
+// with a PTR record for every A and AAAA record in domains that falls inside it. Overrides take
+// precedence for addresses that serve multiple names
+func buildReverseZones(prefixes string, domains []domain, overrides []ptrRecord, soa soaSettings, template *zoneTemplate) ([]domain, error) {
+	ptrs := getPTRNames(domains)
+	for _, override := range overrides {
+		ip := net.ParseIP(override.IPAddress)
+		if ip == nil {
+			return nil, errors.New("Invalid PTR record IP address " + override.IPAddress)
+		}
+		ptrs[ip.String()] = ptrRecord{IPAddress: ip.String(), Name: absoluteName(override.Name), TTL: override.TTL}
+	}
+
+	zones := []domain{}
+	for _, prefix := range strings.Fields(prefixes) {
+		zone, network, err := newReverseZone(prefix)
+		if err != nil {
+			return nil, err
+		}
+		zone.SOA = soa
+		zone.NsRecords = template.getNsRecords()
+		if err := zone.BuildPTRRecords(network, ptrs); err != nil {
+			return nil, err
+		}
+		zones = append(zones, *zone)
+	}
+	return zones, nil
+}
+
+func newReverseZone(prefix string) (*domain, *net.IPNet, error) {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, nil, errors.New("Invalid reverse zone prefix " + err.Error())
+	}
+	ones, bits := network.Mask.Size()
+	labelBits := 4
+	if network.IP.To4() != nil {
+		labelBits = 8
+	}
+	if ones == 0 || ones%labelBits != 0 {
+		return nil, nil, fmt.Errorf("Reverse zone prefix %s must have a length that is a multiple of %d", prefix, labelBits)
+	}
+	labels := strings.Split(strings.TrimSuffix(reverseName(network.IP), "."), ".")
+	addressLabels := bits / labelBits
+	name := strings.Join(labels[addressLabels-ones/labelBits:], ".")
+	return &domain{Name: name}, network, nil
+}
+
+// getPTRNames maps each address published by the domains to its fully qualified name. If an address is
+// used by more than one name, the first name alphabetically is used
+func getPTRNames(domains []domain) map[string]ptrRecord {
+	ptrs := make(map[string]ptrRecord)
+	for _, d := range domains {
+		for _, server := range d.ARecords {
+			name := server.Name
+			if name == "" {
+				name = d.Name + "."
+			} else if !strings.HasSuffix(name, ".") {
+				name = name + "." + d.Name + "."
+			}
+			for _, address := range getIPs(server.IPAddress, server.DynamicFQDN) {
+				ip := net.ParseIP(address)
+				if ip == nil {
+					continue
+				}
+				if current, ok := ptrs[ip.String()]; !ok || name < current.Name {
+					ptrs[ip.String()] = ptrRecord{IPAddress: ip.String(), Name: name, TTL: server.TTL}
+				}
+			}
+		}
+	}
+	return ptrs
+}
+
+func (d *domain) BuildPTRRecords(network *net.IPNet, ptrs map[string]ptrRecord) error {
+	d.DefaultTTL = defaultTTL
+	d.SOA = d.SOA.withDefaults(getDefaultSOA())
+	if len(d.NsRecords) == 0 {
+		return errors.New("No name servers found for " + d.Name)
+	}
+	d.Add(newSoaRecord(d.Name, d.NsRecords[0].Value, d.SOA.Hostmaster, d.SOA.Refresh, d.SOA.Retry, d.SOA.Expire, d.SOA.NegativeTTL))
+	for _, nameServer := range d.NsRecords {
+		d.Add(newNsRecord(d.Name, nameServer.Name, nameServer.Value).withTTL(nameServer.TTL))
+	}
+
+	addresses := []string{}
+	for address := range ptrs {
+		if network.Contains(net.ParseIP(address)) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		d.Add(newPtrRecord(reverseName(net.ParseIP(address)), ptrs[address].Name).withTTL(ptrs[address].TTL))
+	}
+	return nil
+}
+
+// reverseName returns the fully qualified in-addr.arpa or ip6.arpa name for ip
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip6 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip6) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x.%x", ip6[i]&0x0f, ip6[i]>>4))
+	}
+	return strings.Join(nibbles, ".") + ".ip6.arpa."
+}
+
+func absoluteName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
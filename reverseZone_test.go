@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBuildReverseZones(t *testing.T) {
+	domains := []domain{
+		domain{Name: "example.com", ARecords: []aRecord{aRecord{Name: "", IPAddress: "10.1.0.6"}, aRecord{Name: "www", IPAddress: "10.1.0.6"},
+			aRecord{Name: "mail", IPAddress: "10.1.0.7", TTL: 300}, aRecord{Name: "v6", IPAddress: "2001:db8::1"}, aRecord{Name: "other", IPAddress: "192.168.1.1"}}},
+		domain{Name: "example2.com", ARecords: []aRecord{aRecord{Name: "host.example2.com.", IPAddress: "10.1.0.8"}}},
+	}
+	overrides := []ptrRecord{ptrRecord{IPAddress: "10.1.0.8", Name: "override.example.com"}}
+	soa := getDefaultSOA()
+	soa.Hostmaster = "hostmaster@example.com"
+	zones, err := buildReverseZones("10.1.0.0/24 2001:db8::/32", domains, overrides, soa, newTestTemplate())
+	if err != nil || len(zones) != 2 || zones[0].Name != "0.1.10.in-addr.arpa" || zones[1].Name != "8.b.d.0.1.0.0.2.ip6.arpa" {
+		t.Fatal("expected IPv4 and IPv6 reverse zones", err, zones)
+	}
+
+	v4 := zones[0].DNSRecords
+	if len(v4) != 6 || v4[0].RecordType != "SOA" || v4[0].Data != "ns1.example.net. hostmaster.example.com. (SERIALNUMBER 7200 1800 1209600 1800)" ||
+		v4[1].RecordType != "NS" || v4[2].RecordType != "NS" ||
+		v4[3].Name != "6.0.1.10.in-addr.arpa." || v4[3].RecordType != "PTR" || v4[3].Data != "example.com." ||
+		v4[4].Name != "7.0.1.10.in-addr.arpa." || v4[4].Data != "mail.example.com." || v4[4].TTL != "300" ||
+		v4[5].Name != "8.0.1.10.in-addr.arpa." || v4[5].Data != "override.example.com." {
+		t.Fatal("expected SOA, NS and PTR records in IPv4 reverse zone", v4)
+	}
+
+	v6 := zones[1].DNSRecords
+	if len(v6) != 4 || v6[3].Name != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa." || v6[3].Data != "v6.example.com." {
+		t.Fatal("expected PTR record in IPv6 reverse zone", v6)
+	}
+
+	if _, err := buildReverseZones("10.1.0.0/24", domains, []ptrRecord{ptrRecord{IPAddress: "bogus"}}, soa, newTestTemplate()); err == nil {
+		t.Error("expected error due to invalid override address")
+	}
+	if _, err := buildReverseZones("10.1.0.0/20", domains, nil, soa, newTestTemplate()); err == nil {
+		t.Error("expected error due to prefix not on an octet boundary")
+	}
+	if _, err := buildReverseZones("10.1.0.0/24", domains, nil, soa, &zoneTemplate{}); err == nil {
+		t.Error("expected error due to missing name servers")
+	}
+}
+
+func TestNewReverseZone(t *testing.T) {
+	zone, network, err := newReverseZone("10.1.0.0/16")
+	if err != nil || zone.Name != "1.10.in-addr.arpa" || network.String() != "10.1.0.0/16" {
+		t.Error("expected /16 reverse zone", err, zone, network)
+	}
+
+	if _, _, err := newReverseZone("bogus"); err == nil {
+		t.Error("expected error parsing prefix")
+	}
+
+	if _, _, err := newReverseZone("2001:db8::/30"); err == nil {
+		t.Error("expected error due to prefix not on a nibble boundary")
+	}
+
+	if _, _, err := newReverseZone("0.0.0.0/0"); err == nil {
+		t.Error("expected error due to empty prefix")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if name := reverseName(net.ParseIP("123.45.67.89")); name != "89.67.45.123.in-addr.arpa." {
+		t.Error("expected IPv4 reverse name", name)
+	}
+	if name := reverseName(net.ParseIP("2001:db8::567:89ab")); name != "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa." {
+		t.Error("expected IPv6 reverse name", name)
+	}
+}
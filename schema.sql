@@ -2,17 +2,46 @@
 Generated by Postgres.tt
 ******************************************************/
 
+CREATE TABLE Templates (
+Id                        SMALLSERIAL     NOT NULL,
+Name                      VARCHAR(50)     NOT NULL,
+NameServers               VARCHAR(255)    NULL,
+MailServers               VARCHAR(255)    NULL,
+SPF                       VARCHAR(255)    NULL,
+DMARCPolicy               VARCHAR(10)     NULL,
+DMARCReportAddress        VARCHAR(255)    NULL,
+CAAIssuers                VARCHAR(255)    NULL,
+TLSAPorts                 VARCHAR(50)     NULL,
+CONSTRAINT PK_Templates PRIMARY KEY (Id),
+CONSTRAINT UQ_Templates_Name UNIQUE (Name)
+);
+
 CREATE TABLE Domains (
 Id                        SMALLSERIAL     NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
-CONSTRAINT PK_Zones PRIMARY KEY (Id)
+TTL                       INTEGER         NULL,
+Refresh                   INTEGER         NULL,
+Retry                     INTEGER         NULL,
+Expire                    INTEGER         NULL,
+NegativeTTL               INTEGER         NULL,
+Hostmaster                VARCHAR(255)    NULL,
+TemplateId                SMALLINT        NULL,
+PublishCDS                BOOLEAN         NULL,
+DNSSECDelete              BOOLEAN         NULL,
+DenialType                VARCHAR(5)      NULL,
+NSEC3Iterations           SMALLINT        NULL,
+NSEC3Salt                 VARCHAR(510)    NULL,
+NSEC3OptOut               BOOLEAN         NULL,
+CONSTRAINT PK_Zones PRIMARY KEY (Id),
+CONSTRAINT FK_Domains_Templates FOREIGN KEY (TemplateId) REFERENCES Templates(Id)
 );
 
 CREATE TABLE ARecords (
 DomainId                  SMALLINT        NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
-IpAddress                 VARCHAR(15)     NOT NULL,
+IpAddress                 VARCHAR(45)     NOT NULL,
 DynamicFQDN               VARCHAR(255)    NOT NULL,
+TTL                       INTEGER         NULL,
 CONSTRAINT PK_ARecordss PRIMARY KEY (DomainId,Name,IpAddress,DynamicFQDN),
 CONSTRAINT FK_ARecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
 );
@@ -21,6 +50,7 @@ CREATE TABLE CNameRecords (
 DomainId                  SMALLINT        NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
 CanonicalName             VARCHAR(255)    NULL,
+TTL                       INTEGER         NULL,
 CONSTRAINT PK_CNameRecords PRIMARY KEY (DomainId,Name),
 CONSTRAINT FK_CNameRecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
 );
@@ -29,6 +59,7 @@ CREATE TABLE DKIMRecords (
 DomainId                  SMALLINT        NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
 Value                     VARCHAR(255)    NOT NULL,
+TTL                       INTEGER         NULL,
 CONSTRAINT PK_DKIMRecords PRIMARY KEY (DomainId,Name),
 CONSTRAINT FK_DKIMRecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
 );
@@ -37,6 +68,7 @@ CREATE TABLE DMARCRecords (
 DomainId                  SMALLINT        NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
 Value                     VARCHAR(255)    NOT NULL,
+TTL                       INTEGER         NULL,
 CONSTRAINT PK_DMARCRecords PRIMARY KEY (DomainId,Name),
 CONSTRAINT FK_DMARCRecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
 );
@@ -46,6 +78,7 @@ DomainId                  SMALLINT        NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
 Value                     VARCHAR(255)    NOT NULL,
 Priority                  SMALLINT        NOT NULL,
+TTL                       INTEGER         NULL,
 CONSTRAINT PK_MxRecords PRIMARY KEY (DomainId,Name,Value),
 CONSTRAINT FK_MxRecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
 );
@@ -55,6 +88,7 @@ DomainId                  SMALLINT        NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
 Value                     VARCHAR(255)    NOT NULL,
 SortOrder                 SMALLINT        NOT NULL,
+TTL                       INTEGER         NULL,
 CONSTRAINT PK_NsRecords PRIMARY KEY (DomainId,Name,Value),
 CONSTRAINT FK_NsRecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
 );
@@ -63,6 +97,7 @@ CREATE TABLE SPFRecords (
 DomainId                  SMALLINT        NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
 Value                     VARCHAR(255)    NOT NULL,
+TTL                       INTEGER         NULL,
 CONSTRAINT PK_SPFRecords PRIMARY KEY (DomainId,Name),
 CONSTRAINT FK_SPFRecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
 );
@@ -71,18 +106,75 @@ CREATE TABLE SRVRecords (
 DomainId                  SMALLINT        NOT NULL,
 Service                   VARCHAR(20)     NOT NULL,
 Protocol                  VARCHAR(10)     NOT NULL,
-Priority                  SMALLINT        NOT NULL,
-Weight                    SMALLINT        NOT NULL,
-Port                      SMALLINT        NOT NULL,
+Priority                  INTEGER         NOT NULL,
+Weight                    INTEGER         NOT NULL,
+Port                      INTEGER         NOT NULL,
 Target                    VARCHAR(50)     NOT NULL,
+TTL                       INTEGER         NULL,
 CONSTRAINT PK_SRVRecords PRIMARY KEY (DomainId,Service,Protocol,Port,Target),
+CONSTRAINT CK_SRVRecords_Range CHECK (Priority BETWEEN 0 AND 65535 AND Weight BETWEEN 0 AND 65535 AND Port BETWEEN 0 AND 65535),
 CONSTRAINT FK_SRVRecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
 );
 
 CREATE TABLE TXTRecords (
 DomainId                  SMALLINT        NOT NULL,
 Name                      VARCHAR(50)     NOT NULL,
-Value                     VARCHAR(50)     NOT NULL,
-CONSTRAINT PK_TXTRecords PRIMARY KEY (DomainId,Name),
+Value                     VARCHAR(1024)   NOT NULL,
+TTL                       INTEGER         NULL,
+CONSTRAINT PK_TXTRecords PRIMARY KEY (DomainId,Name,Value),
 CONSTRAINT FK_TXTRecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
-);
\ No newline at end of file
+);
+
+CREATE TABLE CAARecords (
+DomainId                  SMALLINT        NOT NULL,
+Name                      VARCHAR(50)     NOT NULL,
+Flags                     SMALLINT        NOT NULL,
+Tag                       VARCHAR(15)     NOT NULL,
+Value                     VARCHAR(255)    NOT NULL,
+TTL                       INTEGER         NULL,
+CONSTRAINT PK_CAARecords PRIMARY KEY (DomainId,Name,Tag,Value),
+CONSTRAINT FK_CAARecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
+);
+
+CREATE TABLE PTRRecords (
+IpAddress                 VARCHAR(45)     NOT NULL,
+Name                      VARCHAR(255)    NOT NULL,
+TTL                       INTEGER         NULL,
+CONSTRAINT PK_PTRRecords PRIMARY KEY (IpAddress)
+);
+
+/* Latest version in schemaUpgrade.sql. Only those after it are applied on upgrade */
+CREATE TABLE SchemaVersion (
+Version                   SMALLINT        NOT NULL
+);
+INSERT INTO SchemaVersion (Version) VALUES (11);
+
+/* Tells a running dnsZoneWriter daemon which domain changed. 0 when any domain could be affected */
+CREATE OR REPLACE FUNCTION NotifyDomainChange() RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_TABLE_NAME = 'domains' THEN
+    IF TG_OP <> 'INSERT' THEN PERFORM pg_notify('dnszonewriter', OLD.Id::text); END IF;
+    IF TG_OP <> 'DELETE' THEN PERFORM pg_notify('dnszonewriter', NEW.Id::text); END IF;
+  ELSIF TG_TABLE_NAME IN ('templates', 'ptrrecords') THEN
+    PERFORM pg_notify('dnszonewriter', '0');
+  ELSE
+    IF TG_OP <> 'INSERT' THEN PERFORM pg_notify('dnszonewriter', OLD.DomainId::text); END IF;
+    IF TG_OP <> 'DELETE' THEN PERFORM pg_notify('dnszonewriter', NEW.DomainId::text); END IF;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER Templates_Notify AFTER INSERT OR UPDATE OR DELETE ON Templates FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER Domains_Notify AFTER INSERT OR UPDATE OR DELETE ON Domains FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER ARecords_Notify AFTER INSERT OR UPDATE OR DELETE ON ARecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER CNameRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON CNameRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER DKIMRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON DKIMRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER DMARCRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON DMARCRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER MxRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON MxRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER NsRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON NsRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER SPFRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON SPFRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER SRVRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON SRVRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER TXTRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON TXTRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER CAARecords_Notify AFTER INSERT OR UPDATE OR DELETE ON CAARecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
+CREATE TRIGGER PTRRecords_Notify AFTER INSERT OR UPDATE OR DELETE ON PTRRecords FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange();
@@ -0,0 +1,118 @@
+/******************************************************
+Upgrades an existing database to match schema.sql.
+Each version is applied once, in order, and recorded in
+SchemaVersion. Add changes as a new version at the end
+and update the version schema.sql inserts to match.
+******************************************************/
+
+-- Version 1
+CREATE TABLE IF NOT EXISTS SchemaVersion (
+Version                   SMALLINT        NOT NULL
+);
+ALTER TABLE TXTRecords ALTER COLUMN Value TYPE VARCHAR(1024);
+ALTER TABLE TXTRecords DROP CONSTRAINT IF EXISTS PK_TXTRecords;
+ALTER TABLE TXTRecords ADD CONSTRAINT PK_TXTRecords PRIMARY KEY (DomainId,Name,Value);
+
+-- Version 2
+ALTER TABLE ARecords ALTER COLUMN IpAddress TYPE VARCHAR(45);
+
+-- Version 3
+CREATE TABLE IF NOT EXISTS CAARecords (
+DomainId                  SMALLINT        NOT NULL,
+Name                      VARCHAR(50)     NOT NULL,
+Flags                     SMALLINT        NOT NULL,
+Tag                       VARCHAR(15)     NOT NULL,
+Value                     VARCHAR(255)    NOT NULL,
+CONSTRAINT PK_CAARecords PRIMARY KEY (DomainId,Name,Tag,Value),
+CONSTRAINT FK_CAARecords_Domains FOREIGN KEY (DomainId) REFERENCES Domains(Id)
+);
+
+-- Version 4
+CREATE TABLE IF NOT EXISTS PTRRecords (
+IpAddress                 VARCHAR(45)     NOT NULL,
+Name                      VARCHAR(255)    NOT NULL,
+CONSTRAINT PK_PTRRecords PRIMARY KEY (IpAddress)
+);
+
+-- Version 5
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE ARecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE CNameRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE DKIMRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE DMARCRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE MxRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE NsRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE SPFRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE SRVRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE TXTRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE CAARecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+ALTER TABLE PTRRecords ADD COLUMN IF NOT EXISTS TTL INTEGER NULL;
+
+-- Version 6
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS Refresh INTEGER NULL;
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS Retry INTEGER NULL;
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS Expire INTEGER NULL;
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS NegativeTTL INTEGER NULL;
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS Hostmaster VARCHAR(255) NULL;
+
+-- Version 7
+CREATE TABLE IF NOT EXISTS Templates (
+Id                        SMALLSERIAL     NOT NULL,
+Name                      VARCHAR(50)     NOT NULL,
+NameServers               VARCHAR(255)    NULL,
+MailServers               VARCHAR(255)    NULL,
+SPF                       VARCHAR(255)    NULL,
+DMARCPolicy               VARCHAR(10)     NULL,
+DMARCReportAddress        VARCHAR(255)    NULL,
+CAAIssuers                VARCHAR(255)    NULL,
+TLSAPorts                 VARCHAR(50)     NULL,
+CONSTRAINT PK_Templates PRIMARY KEY (Id),
+CONSTRAINT UQ_Templates_Name UNIQUE (Name)
+);
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS TemplateId SMALLINT NULL CONSTRAINT FK_Domains_Templates REFERENCES Templates(Id);
+
+-- Version 8
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS PublishCDS BOOLEAN NULL;
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS DNSSECDelete BOOLEAN NULL;
+
+-- Version 9
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS DenialType VARCHAR(5) NULL;
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS NSEC3Iterations SMALLINT NULL;
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS NSEC3Salt VARCHAR(510) NULL;
+ALTER TABLE Domains ADD COLUMN IF NOT EXISTS NSEC3OptOut BOOLEAN NULL;
+
+-- Version 10
+CREATE OR REPLACE FUNCTION NotifyDomainChange() RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_TABLE_NAME = 'domains' THEN
+    IF TG_OP <> 'INSERT' THEN PERFORM pg_notify('dnszonewriter', OLD.Id::text); END IF;
+    IF TG_OP <> 'DELETE' THEN PERFORM pg_notify('dnszonewriter', NEW.Id::text); END IF;
+  ELSIF TG_TABLE_NAME IN ('templates', 'ptrrecords') THEN
+    PERFORM pg_notify('dnszonewriter', '0');
+  ELSE
+    IF TG_OP <> 'INSERT' THEN PERFORM pg_notify('dnszonewriter', OLD.DomainId::text); END IF;
+    IF TG_OP <> 'DELETE' THEN PERFORM pg_notify('dnszonewriter', NEW.DomainId::text); END IF;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DO $$
+DECLARE
+  tableName TEXT;
+BEGIN
+  FOREACH tableName IN ARRAY ARRAY['templates', 'domains', 'arecords', 'cnamerecords', 'dkimrecords', 'dmarcrecords', 'mxrecords',
+    'nsrecords', 'spfrecords', 'srvrecords', 'txtrecords', 'caarecords', 'ptrrecords'] LOOP
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = tableName || '_notify') THEN
+      EXECUTE format('CREATE TRIGGER %I AFTER INSERT OR UPDATE OR DELETE ON %I FOR EACH ROW EXECUTE PROCEDURE NotifyDomainChange()',
+        tableName || '_notify', tableName);
+    END IF;
+  END LOOP;
+END;
+$$;
+
+-- Version 11
+ALTER TABLE SRVRecords ALTER COLUMN Priority TYPE INTEGER;
+ALTER TABLE SRVRecords ALTER COLUMN Weight TYPE INTEGER;
+ALTER TABLE SRVRecords ALTER COLUMN Port TYPE INTEGER;
+ALTER TABLE SRVRecords ADD CONSTRAINT CK_SRVRecords_Range CHECK (Priority BETWEEN 0 AND 65535 AND Weight BETWEEN 0 AND 65535 AND Port BETWEEN 0 AND 65535);
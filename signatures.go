@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const signatureValidity time.Duration = 30 * 24 * time.Hour
+const signatureRefresh time.Duration = 3 * 24 * time.Hour
+const signatureJitter time.Duration = 24 * time.Hour
+
+// signaturePolicy controls how long signatures are valid and when a zone is re-signed. Expirations are
+// spread over the jitter window so zones signed together don't all need re-signing at once (RFC 6781 4.4.2)
+type signaturePolicy struct {
+	Validity time.Duration
+	Refresh  time.Duration // re-sign once the earliest signature expires within this window
+	Jitter   time.Duration
+}
+
+func (p signaturePolicy) validate() error {
+	if p.Validity <= 0 || p.Refresh <= 0 || p.Jitter < 0 {
+		return errors.New("Signature validity and refresh must be greater than zero and jitter can't be negative")
+	}
+	if p.Refresh+p.Jitter >= p.Validity {
+		return errors.New("Signature refresh plus jitter must be less than the signature validity")
+	}
+	return nil
+}
+
+// expiration returns the expiration for signatures made now, less a random part of the jitter window
+func (p signaturePolicy) expiration(now time.Time) time.Time {
+	expiration := now.Add(p.Validity)
+	if p.Jitter > 0 {
+		expiration = expiration.Add(-time.Duration(rand.Int63n(int64(p.Jitter))))
+	}
+	return expiration
+}
+
+func (p signaturePolicy) needsRefresh(expiry time.Time, now time.Time) bool {
+	return !expiry.After(now.Add(p.Refresh))
+}
+
+// earliestSignature returns the RRSIG in the signed zone file that expires first
+func earliestSignature(filename string) (*dns.RRSIG, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseZone(string(data), ".", filename)
+	if err != nil {
+		return nil, err
+	}
+	var earliest *dns.RRSIG
+	for _, rr := range records {
+		if sig, ok := rr.(*dns.RRSIG); ok && (earliest == nil || sig.Expiration < earliest.Expiration) {
+			earliest = sig
+		}
+	}
+	if earliest == nil {
+		return nil, errors.New("No signatures found in " + filename)
+	}
+	return earliest, nil
+}
+
+func signatureExpiry(sig *dns.RRSIG) time.Time {
+	return time.Unix(int64(sig.Expiration), 0)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignaturePolicy(t *testing.T) {
+	policy := signaturePolicy{Validity: signatureValidity, Refresh: signatureRefresh, Jitter: signatureJitter}
+	if err := policy.validate(); err != nil {
+		t.Error("expected defaults to be valid", err)
+	}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		expiration := policy.expiration(now)
+		if expiration.After(now.Add(policy.Validity)) || !expiration.After(now.Add(policy.Validity-policy.Jitter)) {
+			t.Error("expected expiration within jitter window", expiration)
+		}
+	}
+	if policy.needsRefresh(now.Add(4*24*time.Hour), now) || !policy.needsRefresh(now.Add(2*24*time.Hour), now) || !policy.needsRefresh(now.Add(-time.Hour), now) {
+		t.Error("expected refresh within 3 days of expiry")
+	}
+
+	policy.Jitter = 0
+	if policy.expiration(now) != now.Add(policy.Validity) {
+		t.Error("expected exact expiration without jitter")
+	}
+	for _, p := range []signaturePolicy{signaturePolicy{Refresh: time.Hour}, signaturePolicy{Validity: time.Hour},
+		signaturePolicy{Validity: 48 * time.Hour, Refresh: time.Hour, Jitter: -time.Hour},
+		signaturePolicy{Validity: 48 * time.Hour, Refresh: 24 * time.Hour, Jitter: 24 * time.Hour}} {
+		if err := p.validate(); err == nil {
+			t.Error("expected error", p)
+		}
+	}
+}
+
+func TestEarliestSignature(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	filename := filepath.Join(keyDir, "example.com.txt")
+	ioutil.WriteFile(filename, []byte(testZone), 0644)
+	signZoneFile(filename, "example.com", newTestSigningKeys(t, keyDir), denialSettings{}, time.Now().Add(time.Hour))
+
+	// a signature that expires sooner than the rest
+	data, _ := ioutil.ReadFile(filename + ".signed")
+	data = append(data, []byte("ns1.example.com. 1800 IN RRSIG A 8 3 1800 20200101000000 20191201000000 12345 example.com. AAAA\n")...)
+	ioutil.WriteFile(filename+".signed", data, 0644)
+	sig, err := earliestSignature(filename + ".signed")
+	if err != nil || sig.Hdr.Name != "ns1.example.com." || signatureExpiry(sig).Year() != 2020 {
+		t.Error("expected earliest signature", err, sig)
+	}
+
+	if _, err := earliestSignature(filename); err == nil {
+		t.Error("expected error due to unsigned zone")
+	}
+	if _, err := earliestSignature(filepath.Join(keyDir, "bogus")); err == nil {
+		t.Error("expected error due to missing file")
+	}
+}
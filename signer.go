@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const signatureInception time.Duration = time.Hour
+const maxNSEC3Iterations int16 = 100 // validators may treat zones with more iterations as insecure (RFC 9276 3.2)
+
+type signingKey struct {
+	DNSKEY *dns.DNSKEY
+	Signer crypto.Signer
+}
+
+// zoneKeys holds every key in the zone's DNSKEY RRset along with the keys that sign it
+type zoneKeys struct {
+	Published []*signingKey
+	KSKs      []*signingKey // sign the DNSKEY RRset
+	ZSKs      []*signingKey // sign everything else
+}
+
+// denialSettings controls authenticated denial of existence. The default follows RFC 9276: NSEC3
+// with no additional iterations and an empty salt
+type denialSettings struct {
+	Type       string // NSEC or NSEC3
+	Iterations int16  // additional NSEC3 hash iterations
+	Salt       string // hex encoded NSEC3 salt. Empty or - for none
+	OptOut     bool   // leave insecure delegations out of the NSEC3 chain
+}
+
+func (s denialSettings) validate() error {
+	switch strings.ToUpper(s.Type) {
+	case "", "NSEC3":
+	case "NSEC":
+		return nil
+	default:
+		return errors.New("Unknown denial of existence type " + s.Type + ". Expected NSEC or NSEC3")
+	}
+	if s.Iterations < 0 || s.Iterations > maxNSEC3Iterations {
+		return fmt.Errorf("NSEC3 iterations must be between 0 and %d", maxNSEC3Iterations)
+	}
+	salt := s.salt()
+	if _, err := hex.DecodeString(salt); err != nil || len(salt) > 510 {
+		return errors.New("NSEC3 salt " + s.Salt + " must be up to 255 hex encoded bytes")
+	}
+	return nil
+}
+
+func (s denialSettings) isNSEC() bool {
+	return strings.EqualFold(s.Type, "NSEC")
+}
+
+func (s denialSettings) salt() string {
+	if s.Salt == "-" {
+		return ""
+	}
+	return strings.ToUpper(s.Salt)
+}
+
+// rrset holds the records of one type at one owner name along with their signatures
+type rrset struct {
+	Name    string
+	Type    uint16
+	Records []dns.RR
+	RRSIGs  []*dns.RRSIG
+}
+
+// readDNSKEY reads the DNSKEY record from <prefix>.key
+func readDNSKEY(prefix string) (*dns.DNSKEY, error) {
+	data, err := ioutil.ReadFile(prefix + ".key")
+	if err != nil {
+		return nil, err
+	}
+	rr, err := dns.NewRR(string(data))
+	if err != nil {
+		return nil, errors.New("Unable to parse key file " + prefix + ".key " + err.Error())
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, errors.New("Key file " + prefix + ".key doesn't contain a DNSKEY record")
+	}
+	return dnskey, nil
+}
+
+// readSigningKey reads the DNSKEY from <prefix>.key and the matching private key from <prefix>.private
+func readSigningKey(prefix string) (*signingKey, error) {
+	dnskey, err := readDNSKEY(prefix)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(prefix + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	privateKey, err := dnskey.ReadPrivateKey(f, prefix+".private")
+	if err != nil {
+		return nil, errors.New("Unable to read private key " + prefix + ".private " + err.Error())
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Private key " + prefix + ".private can't be used for signing")
+	}
+	return &signingKey{DNSKEY: dnskey, Signer: signer}, nil
+}
+
+// writeSigningKey generates a new key and writes the .key, .private and .ds files with the given prefix.
+// rsaBits is only used for RSA algorithms
+func writeSigningKey(prefix string, domain string, signingAlgorithm string, isKSK bool, rsaBits int) error {
+	algorithm, ok := dns.StringToAlgorithm[strings.ToUpper(signingAlgorithm)]
+	if !ok {
+		return errors.New("Unknown signing algorithm " + signingAlgorithm)
+	}
+	bits, err := keyBits(algorithm, rsaBits)
+	if err != nil {
+		return err
+	}
+	dnskey := &dns.DNSKEY{Hdr: dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: uint32(defaultTTL.Seconds())},
+		Flags: dns.ZONE, Protocol: 3, Algorithm: algorithm}
+	if isKSK {
+		dnskey.Flags |= dns.SEP
+	}
+	privateKey, err := dnskey.Generate(bits)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(prefix+".private", []byte(dnskey.PrivateKeyString(privateKey)), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(prefix+".key", []byte(dnskey.String()+"\n"), 0644); err != nil {
+		return err
+	}
+	return writeFileAtomic(prefix+".ds", []byte(dnskey.ToDS(dns.SHA256).String()+"\n"), 0644)
+}
+
+// keyBits returns the key size to generate for the algorithm. ECDSA and Ed25519 keys have a fixed size
+func keyBits(algorithm uint8, rsaBits int) (int, error) {
+	switch algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512:
+		if rsaBits < 1024 || rsaBits > 4096 {
+			return 0, fmt.Errorf("Invalid RSA key size %d. Expected 1024 to 4096 bits", rsaBits)
+		}
+		return rsaBits, nil
+	case dns.ECDSAP256SHA256, dns.ED25519:
+		return 256, nil
+	case dns.ECDSAP384SHA384:
+		return 384, nil
+	}
+	return 0, errors.New("Unsupported signing algorithm " + dns.AlgorithmToString[algorithm])
+}
+
+// signZoneFile signs the zone in filename and writes it to filename.signed. The DNSKEY RRset is signed
+// with the KSKs and everything else with the ZSKs. CDS and CDNSKEY are signed with both since the parent
+// expects a signature from a key referenced by its DS (RFC 7344 4.1)
+func signZoneFile(filename string, origin string, keys *zoneKeys, denial denialSettings, expiration time.Time) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	origin = dns.CanonicalName(origin)
+	records, err := parseZone(string(data), origin, filename)
+	if err != nil {
+		return err
+	}
+	var soa *dns.SOA
+	for _, rr := range records {
+		if s, ok := rr.(*dns.SOA); ok && dns.CanonicalName(s.Hdr.Name) == origin {
+			soa = s
+		}
+	}
+	if soa == nil {
+		return errors.New("No SOA record found for " + origin)
+	}
+
+	for _, key := range keys.Published {
+		dnskey := *key.DNSKEY
+		dnskey.Hdr.Name = origin
+		dnskey.Hdr.Ttl = soa.Hdr.Ttl
+		records = append(records, &dnskey)
+	}
+
+	sets, delegations := groupRRsets(records, origin)
+	if denial.isNSEC() {
+		sets = append(sets, nsecChain(sets, delegations, origin, soa)...)
+	} else {
+		sets = append(sets, nsec3Chain(sets, delegations, origin, soa, denial)...)
+	}
+
+	inception := time.Now().Add(-signatureInception)
+	for _, set := range sets {
+		if !isSigned(set, origin, delegations) {
+			continue
+		}
+		signers := keys.ZSKs
+		if set.Type == dns.TypeDNSKEY {
+			signers = keys.KSKs
+		} else if set.Type == dns.TypeCDS || set.Type == dns.TypeCDNSKEY {
+			signers = append(append([]*signingKey{}, keys.ZSKs...), keys.KSKs...)
+		}
+		for _, key := range signers {
+			rrsig := &dns.RRSIG{Hdr: dns.RR_Header{Ttl: set.Records[0].Header().Ttl}, Algorithm: key.DNSKEY.Algorithm,
+				KeyTag: key.DNSKEY.KeyTag(), SignerName: origin, Inception: uint32(inception.Unix()), Expiration: uint32(expiration.Unix())}
+			if err := rrsig.Sign(key.Signer, set.Records); err != nil {
+				return errors.New("Unable to sign " + set.Name + " " + dns.TypeToString[set.Type] + " " + err.Error())
+			}
+			set.RRSIGs = append(set.RRSIGs, rrsig)
+		}
+	}
+
+	sortRRsets(sets)
+	var buffer bytes.Buffer
+	for _, set := range sets {
+		for _, rr := range set.Records {
+			buffer.WriteString(rr.String() + "\n")
+		}
+		for _, rrsig := range set.RRSIGs {
+			buffer.WriteString(rrsig.String() + "\n")
+		}
+	}
+	return writeFileAtomic(filename+".signed", buffer.Bytes(), 0644)
+}
+
+func parseZone(zone string, origin string, filename string) ([]dns.RR, error) {
+	records := []dns.RR{}
+	parser := dns.NewZoneParser(strings.NewReader(zone), origin, filename)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		records = append(records, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, errors.New("Unable to parse zone " + filename + " " + err.Error())
+	}
+	return records, nil
+}
+
+// groupRRsets splits the records into RRsets with a single TTL (RFC 2181 5.2) and
+// returns them along with the delegation points found in the zone
+func groupRRsets(records []dns.RR, origin string) ([]*rrset, map[string]bool) {
+	setMap := make(map[string]*rrset)
+	sets := []*rrset{}
+	delegations := make(map[string]bool)
+	for _, rr := range records {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			continue
+		}
+		rr.Header().Name = name
+		key := fmt.Sprintf("%s/%d", name, rr.Header().Rrtype)
+		set, ok := setMap[key]
+		if !ok {
+			set = &rrset{Name: name, Type: rr.Header().Rrtype}
+			setMap[key] = set
+			sets = append(sets, set)
+		} else {
+			rr.Header().Ttl = set.Records[0].Header().Ttl
+		}
+		set.Records = append(set.Records, rr)
+		if rr.Header().Rrtype == dns.TypeNS && name != origin {
+			delegations[name] = true
+		}
+	}
+	return sets, delegations
+}
+
+// isOccluded reports whether name is below a delegation point, making its records glue
+func isOccluded(name string, origin string, delegations map[string]bool) bool {
+	for name != origin {
+		i, end := dns.NextLabel(name, 0)
+		if end {
+			return false
+		}
+		name = name[i:]
+		if delegations[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// isSigned reports whether the zone is authoritative for the RRset. NS records at a delegation point and glue are not signed
+func isSigned(set *rrset, origin string, delegations map[string]bool) bool {
+	if isOccluded(set.Name, origin, delegations) {
+		return false
+	}
+	if delegations[set.Name] {
+		return set.Type == dns.TypeDS || set.Type == dns.TypeNSEC
+	}
+	return true
+}
+
+// nameTypes returns the types present at every authoritative name in the zone including RRSIG where signed
+func nameTypes(sets []*rrset, delegations map[string]bool, origin string) map[string][]uint16 {
+	types := make(map[string][]uint16)
+	for _, set := range sets {
+		if isOccluded(set.Name, origin, delegations) {
+			continue
+		}
+		types[set.Name] = append(types[set.Name], set.Type)
+		if isSigned(set, origin, delegations) && !hasType(types[set.Name], dns.TypeRRSIG) {
+			types[set.Name] = append(types[set.Name], dns.TypeRRSIG)
+		}
+	}
+	return types
+}
+
+// denialTTL is the lesser of the SOA TTL and minimum field (RFC 9077)
+func denialTTL(soa *dns.SOA) uint32 {
+	if soa.Minttl < soa.Hdr.Ttl {
+		return soa.Minttl
+	}
+	return soa.Hdr.Ttl
+}
+
+// nsecChain returns the NSEC RRsets linking every authoritative name in the zone in canonical order
+func nsecChain(sets []*rrset, delegations map[string]bool, origin string, soa *dns.SOA) []*rrset {
+	types := nameTypes(sets, delegations, origin)
+	names := []string{}
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return compareCanonical(names[i], names[j]) < 0 })
+
+	chain := []*rrset{}
+	for i, name := range names {
+		bitmap := append(types[name], dns.TypeNSEC)
+		if !hasType(bitmap, dns.TypeRRSIG) {
+			bitmap = append(bitmap, dns.TypeRRSIG)
+		}
+		sort.Slice(bitmap, func(a, b int) bool { return bitmap[a] < bitmap[b] })
+		chain = append(chain, &rrset{Name: name, Type: dns.TypeNSEC, Records: []dns.RR{&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: denialTTL(soa)},
+			NextDomain: names[(i+1)%len(names)], TypeBitMap: bitmap}}})
+	}
+	return chain
+}
+
+// nsec3Chain returns the NSEC3PARAM and NSEC3 RRsets for every authoritative name in the zone
+// including empty non-terminals. With opt-out, insecure delegations and the empty non-terminals
+// only they need are left out
+func nsec3Chain(sets []*rrset, delegations map[string]bool, origin string, soa *dns.SOA, denial denialSettings) []*rrset {
+	types := make(map[string][]uint16)
+	for _, set := range sets {
+		if isOccluded(set.Name, origin, delegations) {
+			continue
+		}
+		if denial.OptOut && delegations[set.Name] && !hasSetType(sets, set.Name, dns.TypeDS) {
+			continue
+		}
+		types[set.Name] = append(types[set.Name], set.Type)
+		if isSigned(set, origin, delegations) && !hasType(types[set.Name], dns.TypeRRSIG) {
+			types[set.Name] = append(types[set.Name], dns.TypeRRSIG)
+		}
+		for parent := set.Name; parent != origin; {
+			i, _ := dns.NextLabel(parent, 0)
+			parent = parent[i:]
+			if _, ok := types[parent]; !ok {
+				types[parent] = []uint16{}
+			}
+		}
+	}
+	types[origin] = append(types[origin], dns.TypeNSEC3PARAM)
+
+	salt := denial.salt()
+	iterations := uint16(denial.Iterations)
+	hashes := make(map[string]string)
+	hashed := []string{}
+	for name := range types {
+		hash := strings.ToLower(dns.HashName(name, dns.SHA1, iterations, salt))
+		hashes[hash] = name
+		hashed = append(hashed, hash)
+	}
+	sort.Strings(hashed)
+
+	var flags uint8
+	if denial.OptOut {
+		flags = 1
+	}
+	chain := []*rrset{&rrset{Name: origin, Type: dns.TypeNSEC3PARAM, Records: []dns.RR{&dns.NSEC3PARAM{
+		Hdr:  dns.RR_Header{Name: origin, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET},
+		Hash: dns.SHA1, Iterations: iterations, SaltLength: uint8(len(salt) / 2), Salt: salt}}}}
+	for i, hash := range hashed {
+		bitmap := types[hashes[hash]]
+		sort.Slice(bitmap, func(a, b int) bool { return bitmap[a] < bitmap[b] })
+		name := hash + "." + origin
+		chain = append(chain, &rrset{Name: name, Type: dns.TypeNSEC3, Records: []dns.RR{&dns.NSEC3{
+			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: denialTTL(soa)},
+			Hash: dns.SHA1, Flags: flags, Iterations: iterations, SaltLength: uint8(len(salt) / 2), Salt: salt, HashLength: 20,
+			NextDomain: strings.ToUpper(hashed[(i+1)%len(hashed)]), TypeBitMap: bitmap}}})
+	}
+	return chain
+}
+
+func hasSetType(sets []*rrset, name string, t uint16) bool {
+	for _, set := range sets {
+		if set.Name == name && set.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, value := range types {
+		if value == t {
+			return true
+		}
+	}
+	return false
+}
+
+// sortRRsets puts the RRsets in canonical name order (RFC 4034 6.1) with the SOA first
+func sortRRsets(sets []*rrset) {
+	sort.SliceStable(sets, func(i, j int) bool {
+		if c := compareCanonical(sets[i].Name, sets[j].Name); c != 0 {
+			return c < 0
+		}
+		if sets[i].Type == dns.TypeSOA || sets[j].Type == dns.TypeSOA {
+			return sets[i].Type == dns.TypeSOA
+		}
+		return sets[i].Type < sets[j].Type
+	})
+}
+
+func compareCanonical(a, b string) int {
+	aLabels := dns.SplitDomainName(a)
+	bLabels := dns.SplitDomainName(b)
+	for i, j := len(aLabels)-1, len(bLabels)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(strings.ToLower(aLabels[i]), strings.ToLower(bLabels[j])); c != 0 {
+			return c
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
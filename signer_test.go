@@ -0,0 +1,257 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 1800
+example.com.		IN	SOA	ns1.example.com. hostmaster.example.com. (2016010100 7200 1800 1209600 900)
+example.com.		IN	NS	ns1.example.com.
+example.com.		IN	CDS	12345 8 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF
+ns1		IN	A	10.1.0.6
+a.b.c		IN	TXT	"deep"
+sub		IN	NS	ns.sub.example.com.
+sub		IN	DS	12345 8 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF
+ns.sub		IN	A	10.1.0.7
+`
+
+func TestReadSigningKey(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	prefix := filepath.Join(keyDir, "example.com.RSASHA256.KSK")
+	if err := writeSigningKey(prefix, "example.com", "RSASHA256", true, rsaKSKBits); err != nil {
+		t.Fatal("expected success", err)
+	}
+	key, err := readSigningKey(prefix)
+	if err != nil || key.DNSKEY.Flags != 257 || key.DNSKEY.Algorithm != dns.RSASHA256 || key.Signer == nil {
+		t.Error("expected to read KSK", err, key)
+	}
+	ds, _ := ioutil.ReadFile(prefix + ".ds")
+	if !strings.Contains(string(ds), "\tDS\t") {
+		t.Error("expected DS record to be written", string(ds))
+	}
+
+	if _, err := readSigningKey("testData/example.com.ALG.KSK"); err == nil {
+		t.Error("expected error due to empty key file")
+	}
+	if _, err := readSigningKey("testData/bogus"); err == nil {
+		t.Error("expected error due to missing key file")
+	}
+	os.Remove(prefix + ".private")
+	if _, err := readSigningKey(prefix); err == nil {
+		t.Error("expected error due to missing private key")
+	}
+}
+
+func TestWriteSigningKeyAlgorithms(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	a, _ := dns.NewRR("example.com. 1800 IN A 10.1.0.6")
+	for _, algorithm := range []string{"ECDSAP256SHA256", "ECDSAP384SHA384", "ED25519", "RSASHA512"} {
+		prefix := filepath.Join(keyDir, "example.com."+algorithm+".ZSK")
+		if err := writeSigningKey(prefix, "example.com", algorithm, false, rsaZSKBits); err != nil {
+			t.Fatal("expected success", algorithm, err)
+		}
+		key, err := readSigningKey(prefix)
+		if err != nil || dns.AlgorithmToString[key.DNSKEY.Algorithm] != algorithm {
+			t.Fatal("expected to read key", algorithm, err)
+		}
+		rrsig := &dns.RRSIG{Hdr: dns.RR_Header{Ttl: 1800}, Algorithm: key.DNSKEY.Algorithm, KeyTag: key.DNSKEY.KeyTag(),
+			SignerName: "example.com.", Inception: uint32(time.Now().Unix()), Expiration: uint32(time.Now().Add(time.Hour).Unix())}
+		if err := rrsig.Sign(key.Signer, []dns.RR{a}); err != nil || rrsig.Verify(key.DNSKEY, []dns.RR{a}) != nil {
+			t.Error("expected valid signature", algorithm, err)
+		}
+	}
+
+	if err := writeSigningKey(filepath.Join(keyDir, "dsa"), "example.com", "DSA", false, rsaZSKBits); err == nil {
+		t.Error("expected error due to unsupported algorithm")
+	}
+	if err := writeSigningKey(filepath.Join(keyDir, "small"), "example.com", "RSASHA256", false, 512); err == nil {
+		t.Error("expected error due to RSA key too small")
+	}
+}
+
+func TestSignZoneFile(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	keys := newTestSigningKeys(t, keyDir)
+	filename := filepath.Join(keyDir, "example.com.txt")
+	ioutil.WriteFile(filename, []byte(testZone), 0644)
+
+	if err := signZoneFile(filename, "example.com", keys, denialSettings{}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal("expected success", err)
+	}
+	data, _ := ioutil.ReadFile(filename + ".signed")
+	records, err := parseZone(string(data), "example.com.", filename)
+	if err != nil {
+		t.Fatal("expected signed zone to parse", err)
+	}
+
+	dnskeys := make(map[uint16]*dns.DNSKEY)
+	signed := make(map[string]bool)
+	nsec3 := 0
+	for _, rr := range records {
+		switch r := rr.(type) {
+		case *dns.DNSKEY:
+			dnskeys[r.KeyTag()] = r
+		case *dns.NSEC3:
+			nsec3++
+		case *dns.RRSIG:
+			signed[r.Hdr.Name+dns.TypeToString[r.TypeCovered]] = true
+		}
+	}
+	for _, rr := range records {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		set := []dns.RR{}
+		for _, r := range records {
+			if r.Header().Name == sig.Hdr.Name && r.Header().Rrtype == sig.TypeCovered {
+				set = append(set, r)
+			}
+		}
+		if err := sig.Verify(dnskeys[sig.KeyTag], set); err != nil || !sig.ValidityPeriod(time.Now()) {
+			t.Error("expected valid signature", err, sig)
+		}
+		if sig.TypeCovered == dns.TypeDNSKEY && sig.KeyTag != keys.KSKs[0].DNSKEY.KeyTag() {
+			t.Error("expected DNSKEY to be signed by the KSK", sig)
+		}
+		if sig.KeyTag == keys.KSKs[0].DNSKEY.KeyTag() {
+			signed[sig.Hdr.Name+dns.TypeToString[sig.TypeCovered]+" KSK"] = true
+		}
+	}
+
+	// apex, ns1, a.b.c, b.c, c and sub. Glue below the delegation is left out
+	if nsec3 != 6 {
+		t.Error("expected NSEC3 record for each name and empty non-terminal", nsec3)
+	}
+	if !signed["example.com.SOA"] || !signed["example.com.DNSKEY"] || !signed["example.com.NSEC3PARAM"] || !signed["sub.example.com.DS"] {
+		t.Error("expected authoritative RRsets to be signed", signed)
+	}
+	if signed["sub.example.com.NS"] || signed["ns.sub.example.com.A"] {
+		t.Error("expected delegation NS and glue not to be signed", signed)
+	}
+	if !signed["example.com.CDS"] || !signed["example.com.CDS KSK"] || signed["example.com.SOA KSK"] {
+		t.Error("expected CDS to be signed by the ZSK and KSK", signed)
+	}
+	if records[0].Header().Rrtype != dns.TypeSOA {
+		t.Error("expected SOA to be first", records[0])
+	}
+
+	if err := signZoneFile(filepath.Join(keyDir, "bogus.txt"), "example.com", keys, denialSettings{}, time.Now()); err == nil {
+		t.Error("expected error due to missing zone file")
+	}
+	ioutil.WriteFile(filename, []byte("example.com. IN A 10.1.0.6\n"), 0644)
+	if err := signZoneFile(filename, "example.com", keys, denialSettings{}, time.Now()); err == nil {
+		t.Error("expected error due to missing SOA")
+	}
+	ioutil.WriteFile(filename, []byte("example.com. IN TLSA 3 0 1 TLSA_KEY_FILE_NOT_FOUND\n"), 0644)
+	if err := signZoneFile(filename, "example.com", keys, denialSettings{}, time.Now()); err == nil {
+		t.Error("expected error due to invalid record")
+	}
+}
+
+func TestSignZoneFileDenial(t *testing.T) {
+	keyDir := tempDir()
+	defer os.RemoveAll(keyDir)
+	keys := newTestSigningKeys(t, keyDir)
+	filename := filepath.Join(keyDir, "example.com.txt")
+	zone := testZone + "insecure\tIN\tNS\tns.example.net.\n"
+	signed := make(map[uint16]int)
+	read := func(denial denialSettings) map[uint16][]dns.RR {
+		ioutil.WriteFile(filename, []byte(zone), 0644)
+		if err := signZoneFile(filename, "example.com", keys, denial, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal("expected success", err)
+		}
+		data, _ := ioutil.ReadFile(filename + ".signed")
+		records, _ := parseZone(string(data), "example.com.", filename)
+		byType := make(map[uint16][]dns.RR)
+		signed = make(map[uint16]int)
+		for _, rr := range records {
+			byType[rr.Header().Rrtype] = append(byType[rr.Header().Rrtype], rr)
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				signed[sig.TypeCovered]++
+			}
+		}
+		return byType
+	}
+
+	// NSEC chain covers apex, ns1, a.b.c, sub and insecure. Signed at delegations too
+	records := read(denialSettings{Type: "nsec"})
+	if len(records[dns.TypeNSEC]) != 5 || len(records[dns.TypeNSEC3]) != 0 || signed[dns.TypeNSEC] != 5 {
+		t.Error("expected signed NSEC chain", len(records[dns.TypeNSEC]), signed[dns.TypeNSEC])
+	}
+	for _, rr := range records[dns.TypeNSEC] {
+		nsec := rr.(*dns.NSEC)
+		if nsec.Hdr.Name == "insecure.example.com." && (nsec.NextDomain != "ns1.example.com." || len(nsec.TypeBitMap) != 3) {
+			t.Error("expected insecure delegation to have NS, RRSIG and NSEC", nsec)
+		}
+		if nsec.Hdr.Name == "sub.example.com." && nsec.NextDomain != "example.com." {
+			t.Error("expected chain to loop back to the apex", nsec)
+		}
+	}
+
+	// salt and iterations
+	records = read(denialSettings{Iterations: 10, Salt: "aabbccdd"})
+	param := records[dns.TypeNSEC3PARAM][0].(*dns.NSEC3PARAM)
+	nsec3 := records[dns.TypeNSEC3][0].(*dns.NSEC3)
+	if param.Iterations != 10 || param.Salt != "AABBCCDD" || nsec3.Iterations != 10 || nsec3.Salt != "AABBCCDD" || nsec3.Flags != 0 ||
+		len(records[dns.TypeNSEC3]) != 7 {
+		t.Error("expected NSEC3 parameters to be applied", param, nsec3, len(records[dns.TypeNSEC3]))
+	}
+
+	// opt-out leaves the insecure delegation out
+	records = read(denialSettings{Type: "NSEC3", Salt: "-", OptOut: true})
+	param = records[dns.TypeNSEC3PARAM][0].(*dns.NSEC3PARAM)
+	nsec3 = records[dns.TypeNSEC3][0].(*dns.NSEC3)
+	if param.Iterations != 0 || param.Salt != "" || param.Flags != 0 || nsec3.Flags != 1 || len(records[dns.TypeNSEC3]) != 6 {
+		t.Error("expected opt-out chain", param, nsec3, len(records[dns.TypeNSEC3]))
+	}
+}
+
+func TestDenialSettingsValidate(t *testing.T) {
+	for _, s := range []denialSettings{denialSettings{}, denialSettings{Type: "NSEC", Iterations: -1}, denialSettings{Type: "nsec3", Salt: "-"},
+		denialSettings{Iterations: 100, Salt: "aabb", OptOut: true}} {
+		if err := s.validate(); err != nil {
+			t.Error("expected valid settings", s, err)
+		}
+	}
+	for _, s := range []denialSettings{denialSettings{Type: "NSEC5"}, denialSettings{Iterations: -1}, denialSettings{Iterations: 101},
+		denialSettings{Salt: "xyz"}, denialSettings{Salt: "abc"}, denialSettings{Salt: strings.Repeat("ab", 256)}} {
+		if err := s.validate(); err == nil {
+			t.Error("expected error", s)
+		}
+	}
+}
+
+func TestCompareCanonical(t *testing.T) {
+	names := []string{"example.com.", "a.example.com.", "yljkjljk.a.example.com.", "Z.a.example.com.", "zABC.a.EXAMPLE.com.", "z.example.com."}
+	for i := 1; i < len(names); i++ {
+		if compareCanonical(names[i-1], names[i]) >= 0 {
+			t.Error("expected canonical order", names[i-1], names[i])
+		}
+	}
+}
+
+func newTestSigningKeys(t *testing.T, keyDir string) *zoneKeys {
+	kskPrefix := filepath.Join(keyDir, "example.com.RSASHA256.KSK")
+	zskPrefix := filepath.Join(keyDir, "example.com.RSASHA256.ZSK")
+	if err := writeSigningKey(kskPrefix, "example.com", "RSASHA256", true, rsaKSKBits); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSigningKey(zskPrefix, "example.com", "RSASHA256", false, rsaZSKBits); err != nil {
+		t.Fatal(err)
+	}
+	ksk, _ := readSigningKey(kskPrefix)
+	zsk, _ := readSigningKey(zskPrefix)
+	return &zoneKeys{Published: []*signingKey{ksk, zsk}, KSKs: []*signingKey{ksk}, ZSKs: []*signingKey{zsk}}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// zoneTemplate holds the records given to every domain that doesn't define its own. The default
+// template comes from dnsZoneWriter.conf and named templates from the Templates table. Any setting
+// a named template leaves empty is taken from the default template
+type zoneTemplate struct {
+	ID                 int16
+	Name               string
+	NameServers        string // space separated: ns1.example.com. ns2.example.com.
+	MailServers        string // space separated priority and host pairs: 10 mail1.example.com. 20 mail2.example.com.
+	SPF                string // SPF mechanisms: include:_spf.example.com
+	DMARCPolicy        string // none, quarantine or reject
+	DMARCReportAddress string // address aggregate DMARC reports are sent to
+	CAAIssuers         string // space separated: letsencrypt.org
+	TLSAPorts          string // space separated: 25 443
+}
+
+func (t zoneTemplate) withDefaults(defaults zoneTemplate) zoneTemplate {
+	if t.NameServers == "" {
+		t.NameServers = defaults.NameServers
+	}
+	if t.MailServers == "" {
+		t.MailServers = defaults.MailServers
+	}
+	if t.SPF == "" {
+		t.SPF = defaults.SPF
+	}
+	if t.DMARCPolicy == "" {
+		t.DMARCPolicy = defaults.DMARCPolicy
+	}
+	if t.DMARCReportAddress == "" {
+		t.DMARCReportAddress = defaults.DMARCReportAddress
+	}
+	if t.CAAIssuers == "" {
+		t.CAAIssuers = defaults.CAAIssuers
+	}
+	if t.TLSAPorts == "" {
+		t.TLSAPorts = defaults.TLSAPorts
+	}
+	return t
+}
+
+func (t *zoneTemplate) validate() error {
+	if _, err := t.getMxRecords(); err != nil {
+		return err
+	}
+	if _, err := t.getTLSAPorts(); err != nil {
+		return err
+	}
+	switch t.DMARCPolicy {
+	case "", "none", "quarantine", "reject":
+	default:
+		return errors.New("Template " + t.Name + " has invalid DMARC policy " + t.DMARCPolicy)
+	}
+	return nil
+}
+
+func (t *zoneTemplate) getNsRecords() []nsRecord {
+	ns := []nsRecord{}
+	for i, value := range strings.Fields(t.NameServers) {
+		ns = append(ns, nsRecord{Name: "", Value: value, SortOrder: int16(i + 1)})
+	}
+	return ns
+}
+
+func (t *zoneTemplate) getMxRecords() ([]mxRecord, error) {
+	fields := strings.Fields(t.MailServers)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("Template " + t.Name + " mail servers must be priority and host pairs")
+	}
+	mx := []mxRecord{}
+	for i := 0; i < len(fields); i += 2 {
+		priority, err := strconv.ParseInt(fields[i], 10, 16)
+		if err != nil {
+			return nil, errors.New("Template " + t.Name + " has invalid mail server priority " + fields[i])
+		}
+		mx = append(mx, mxRecord{Name: "", Value: fields[i+1], Priority: int16(priority)})
+	}
+	return mx, nil
+}
+
+func (t *zoneTemplate) getSPFRecords() []spfRecord {
+	if t.SPF == "" {
+		return nil
+	}
+	return []spfRecord{spfRecord{Name: "", Value: t.SPF}}
+}
+
+func (t *zoneTemplate) getDMARCRecords(domain string) []dmarcRecord {
+	if t.DMARCPolicy == "" {
+		return nil
+	}
+	return []dmarcRecord{dmarcRecord{Name: domain + ".", Value: t.DMARCPolicy}}
+}
+
+func (t *zoneTemplate) getCAARecords() []caaRecord {
+	return getDefaultCAA(t.CAAIssuers)
+}
+
+func (t *zoneTemplate) getTLSAPorts() ([]int, error) {
+	ports := []int{}
+	for _, value := range strings.Fields(t.TLSAPorts) {
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, errors.New("Template " + t.Name + " has invalid TLSA port " + value)
+		}
+		ports = append(ports, int(port))
+	}
+	return ports, nil
+}
+
+// getTemplates returns the template for each template ID with any missing settings filled from the default template
+func getTemplates(defaultTemplate zoneTemplate, templates []zoneTemplate) (map[int16]*zoneTemplate, error) {
+	templateMap := make(map[int16]*zoneTemplate)
+	for i := range templates {
+		template := templates[i].withDefaults(defaultTemplate)
+		if err := template.validate(); err != nil {
+			return nil, err
+		}
+		templateMap[template.ID] = &template
+	}
+	return templateMap, nil
+}
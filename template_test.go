@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTemplateWithDefaults(t *testing.T) {
+	template := zoneTemplate{ID: 1, Name: "customer", NameServers: "ns1.example.org.", TLSAPorts: "443"}.withDefaults(*newTestTemplate())
+	if template.ID != 1 || template.Name != "customer" || template.NameServers != "ns1.example.org." || template.TLSAPorts != "443" ||
+		template.MailServers != "10 mail1.example.net. 20 mail2.example.net." || template.SPF != "include:_spf.example.net" ||
+		template.DMARCPolicy != "quarantine" || template.DMARCReportAddress != "dmarc-report@example.net" || template.CAAIssuers != "letsencrypt.org" {
+		t.Error("expected template settings merged with defaults", template)
+	}
+}
+
+func TestTemplateValidate(t *testing.T) {
+	if err := newTestTemplate().validate(); err != nil {
+		t.Error("expected valid template", err)
+	}
+	if err := (&zoneTemplate{}).validate(); err != nil {
+		t.Error("expected empty template to be valid", err)
+	}
+	if err := (&zoneTemplate{MailServers: "10"}).validate(); err == nil {
+		t.Error("expected error due to missing mail server host")
+	}
+	if err := (&zoneTemplate{TLSAPorts: "70000"}).validate(); err == nil {
+		t.Error("expected error due to invalid port")
+	}
+	if err := (&zoneTemplate{DMARCPolicy: "bogus"}).validate(); err == nil {
+		t.Error("expected error due to invalid DMARC policy")
+	}
+}
+
+func TestTemplateRecords(t *testing.T) {
+	template := newTestTemplate()
+	ns := template.getNsRecords()
+	if len(ns) != 2 || ns[0].Value != "ns1.example.net." || ns[1].Value != "ns2.example.net." {
+		t.Error("expected name servers", ns)
+	}
+
+	mx, err := template.getMxRecords()
+	if err != nil || len(mx) != 2 || mx[0].Value != "mail1.example.net." || mx[0].Priority != 10 || mx[1].Priority != 20 {
+		t.Error("expected mail servers", err, mx)
+	}
+	if _, err := (&zoneTemplate{MailServers: "high mail1.example.net."}).getMxRecords(); err == nil {
+		t.Error("expected error due to invalid priority")
+	}
+
+	spf := template.getSPFRecords()
+	if len(spf) != 1 || spf[0].Value != "include:_spf.example.net" || len((&zoneTemplate{}).getSPFRecords()) != 0 {
+		t.Error("expected SPF record", spf)
+	}
+
+	dmarc := template.getDMARCRecords("example.com")
+	if len(dmarc) != 1 || dmarc[0].Name != "example.com." || dmarc[0].Value != "quarantine" || len((&zoneTemplate{}).getDMARCRecords("example.com")) != 0 {
+		t.Error("expected DMARC record", dmarc)
+	}
+
+	caa := template.getCAARecords()
+	if len(caa) != 1 || caa[0].Value != "letsencrypt.org" {
+		t.Error("expected CAA record", caa)
+	}
+
+	ports, err := template.getTLSAPorts()
+	if err != nil || len(ports) != 2 || ports[0] != 25 || ports[1] != 443 {
+		t.Error("expected TLSA ports", err, ports)
+	}
+}
+
+func TestGetTemplatesMergesDefaults(t *testing.T) {
+	templates, err := getTemplates(*newTestTemplate(), []zoneTemplate{zoneTemplate{ID: 2, Name: "customer", NameServers: "ns1.example.org."}})
+	if err != nil || len(templates) != 1 || templates[2].NameServers != "ns1.example.org." || templates[2].SPF != "include:_spf.example.net" {
+		t.Error("expected templates merged with defaults", err, templates)
+	}
+
+	_, err = getTemplates(*newTestTemplate(), []zoneTemplate{zoneTemplate{ID: 2, DMARCPolicy: "bogus"}})
+	if err == nil {
+		t.Error("expected error due to invalid template")
+	}
+}
+
+func newTestTemplate() *zoneTemplate {
+	return &zoneTemplate{Name: "test", NameServers: "ns1.example.net. ns2.example.net.", MailServers: "10 mail1.example.net. 20 mail2.example.net.",
+		SPF: "include:_spf.example.net", DMARCPolicy: "quarantine", DMARCReportAddress: "dmarc-report@example.net",
+		CAAIssuers: "letsencrypt.org", TLSAPorts: "25 443"}
+}